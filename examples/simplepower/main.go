@@ -37,7 +37,7 @@ func powerReadyCallback(powerReady bool, pdo pdmsg.PDO, rdo pdmsg.RequestDO) {
 
 func main() {
 	fmt.Print("starting up\r\n")
-	pc := fusb302.New(getI2C(), mpn)
+	pc := newPortController()
 	pe := tcpe.New(pc)
 	dpm := tcdpm.NewPolicyManager(pe, powerReadyCallback)
 	err := dpm.SetPolicy(tcdpm.NewLogger(os.Stdout, "\r\n", policy), true)
@@ -14,7 +14,7 @@ import (
 const mpn = fusb302.FUSB302BMPX
 
 func main() {
-	pc := fusb302.New(getI2C(), mpn)
+	pc := newPortController()
 	pe := tcpe.New(pc)
 	dpm := tcdpm.NewPolicyManager(pe, nil)
 	_ = dpm.SetPolicy(tcdpm.NewLogger(os.Stdout, "\r\n", nil), false)
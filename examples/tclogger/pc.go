@@ -0,0 +1,12 @@
+//go:build !loopback
+
+package main
+
+import (
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/tcpcdriver/fusb302"
+)
+
+func newPortController() typec.PortController {
+	return fusb302.New(getI2C(), mpn)
+}
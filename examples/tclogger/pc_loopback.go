@@ -0,0 +1,27 @@
+//go:build loopback
+
+package main
+
+import (
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver/loopback"
+)
+
+// newPortController returns a port controller attached to a simulated source
+// offering 5V, 9V and 15V at 3A, and 3.3-11V at 3A PPS.
+func newPortController() typec.PortController {
+	fixed := pdmsg.NewFixedSupplyPDO()
+	fixed.SetMaxCurrent(3000)
+	fixed.SetVoltage(5000)
+	v5 := fixed
+	fixed.SetVoltage(9000)
+	v9 := fixed
+	fixed.SetVoltage(15000)
+	v15 := fixed
+	pps := pdmsg.NewPPSPDO()
+	pps.SetMinVoltage(3300)
+	pps.SetMaxVoltage(11000)
+	pps.SetMaxCurrent(3000)
+	return loopback.New(pdmsg.PDO(v5), pdmsg.PDO(v9), pdmsg.PDO(v15), pdmsg.PDO(pps))
+}
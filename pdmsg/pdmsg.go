@@ -10,11 +10,20 @@ const (
 	// MaxMessageBytes is the maximum number of bytes in a message which includes
 	// the header and the data objects.
 	MaxMessageBytes = 2 + 4*MaxDataObjects // 2 bytes header, and 7 data objects, each 32 bits (4 bytes)
+
+	// MaxExtendedChunkBytes is the maximum number of data bytes in a single
+	// chunk of an extended message, excluding the extended header.
+	MaxExtendedChunkBytes = 4*MaxDataObjects - 2
 )
 
 // Message represents a power delivery message.
 // Decoding of extended messages is not supported.
 type Message struct {
+	// SOP is the type of start of packet ordered set the message is framed
+	// with, which determines whether the message is for the port partner or
+	// the cable plugs. It is not part of the serialized message.
+	SOP SOP
+
 	Header uint16
 
 	// Data varies depending on the type of the message. For TypeSourceCap and
@@ -27,6 +36,16 @@ type Message struct {
 	Data [MaxDataObjects]uint32
 }
 
+// SOP represents the type of start of packet ordered set of a message.
+type SOP uint8
+
+// Start of packet types.
+const (
+	SOPPort        SOP = 0 // SOP: communication with the port partner
+	SOPPrime       SOP = 1 // SOP': communication with the near end cable plug
+	SOPDoublePrime SOP = 2 // SOP'': communication with the far end cable plug
+)
+
 // ToBytes serializes the message to a byte slice and returns the number of
 // bytes written.
 //
@@ -66,7 +85,7 @@ func (m Message) ID() uint8 {
 
 // SetID sets the message ID.
 func (m *Message) SetID(id uint8) {
-	m.Header = (m.Header & ^(uint16(0b111) << 9)) | (uint16(id) << 9)
+	m.Header = (m.Header & ^(uint16(0b111) << 9)) | (uint16(id&0b111) << 9)
 }
 
 // DataObjectCount returns the number of data objects in the message.
@@ -76,7 +95,7 @@ func (m Message) DataObjectCount() uint8 {
 
 // SetDataObjectCount sets the number of data objects in the message.
 func (m *Message) SetDataObjectCount(n uint8) {
-	m.Header = (m.Header & ^(uint16(0b111) << 12)) | (uint16(n) << 12)
+	m.Header = (m.Header & ^(uint16(0b111) << 12)) | (uint16(n&0b111) << 12)
 }
 
 // IsData returns true of the message is a data message, otherwise it's a
@@ -85,16 +104,16 @@ func (m Message) IsData() bool {
 	return m.DataObjectCount() > 0
 }
 
-// Type returns the message type. As data and control messages share the same
-// value of some types, the user must check IsData in addition to Type, to
-// determine the correct type of the message.
+// Type returns the message type. As control, data and extended messages share
+// the same value of some types, the user must check IsData and IsExtended in
+// addition to Type, to determine the correct type of the message.
 func (m Message) Type() Type {
 	return Type(m.Header & 0b11111)
 }
 
 // SetType sets the message type.
 func (m *Message) SetType(t Type) {
-	m.Header = (m.Header & ^uint16(0b11111)) | uint16(t)
+	m.Header = (m.Header & ^uint16(0b11111)) | uint16(t&0b11111)
 }
 
 // Type represents the PD message type. For control messages, the value of the
@@ -104,22 +123,157 @@ type Type uint8
 
 // Control message types
 const (
-	TypeGoodCRC      Type = 0b00001
-	TypeAccept       Type = 0b00011
-	TypeReject       Type = 0b00100
-	TypePing         Type = 0b00101
-	TypePSReady      Type = 0b00110
-	TypeGetSourceCap Type = 0b00111
-	TypeGetSinkCap   Type = 0b01000
-	TypeWait         Type = 0b01100
-	TypeSoftReset    Type = 0b01101
+	TypeGoodCRC              Type = 0b00001
+	TypeGotoMin              Type = 0b00010 // deprecated in PD 3.0
+	TypeAccept               Type = 0b00011
+	TypeReject               Type = 0b00100
+	TypePing                 Type = 0b00101
+	TypePSReady              Type = 0b00110
+	TypeGetSourceCap         Type = 0b00111
+	TypeGetSinkCap           Type = 0b01000
+	TypeDRSwap               Type = 0b01001
+	TypePRSwap               Type = 0b01010
+	TypeWait                 Type = 0b01100
+	TypeSoftReset            Type = 0b01101
+	TypeNotSupported         Type = 0b10000
+	TypeGetSourceCapExtended Type = 0b10001
+	TypeGetStatus            Type = 0b10010
+	TypeFRSwap               Type = 0b10011
 )
 
 // Data message types
 const (
-	TypeSourceCap Type = 0b00001
-	TypeRequest   Type = 0b00010
-	TypeSinkCap   Type = 0b00100
+	TypeSourceCap  Type = 0b00001
+	TypeRequest    Type = 0b00010
+	TypeBIST       Type = 0b00011
+	TypeSinkCap    Type = 0b00100
+	TypeAlert      Type = 0b00110
+	TypeEPRRequest Type = 0b01001
+	TypeEPRMode    Type = 0b01010
+)
+
+// Extended message types
+const (
+	TypeSourceCapExtended Type = 0b00001
+	TypeStatus            Type = 0b00010
+	TypeGetBatteryCap     Type = 0b00011
+	TypeBatteryCap        Type = 0b00101
+	TypeExtendedControl   Type = 0b10000
+	TypeEPRSourceCap      Type = 0b10001
+)
+
+// ExtendedHeader returns the extended header of an extended message.
+func (m Message) ExtendedHeader() ExtendedHeader {
+	return ExtendedHeader(m.Data[0] & 0xffff)
+}
+
+// SetExtendedHeader sets the extended header of an extended message.
+func (m *Message) SetExtendedHeader(h ExtendedHeader) {
+	m.Data[0] = (m.Data[0] & ^uint32(0xffff)) | uint32(h)
+}
+
+// ExtendedData copies the data bytes of the chunk carried by an extended
+// message into b and returns the number of bytes copied. The number of bytes is
+// limited by the data size in the extended header, the chunk size and len(b).
+func (m Message) ExtendedData(b []byte) int {
+	h := m.ExtendedHeader()
+	n := int(h.DataSize()) - int(h.ChunkNumber())*MaxExtendedChunkBytes
+	if c := int(m.DataObjectCount())*4 - 2; n > c {
+		n = c
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	if n < 0 {
+		return 0
+	}
+	for i := 0; i < n; i++ {
+		k := i + 2
+		b[i] = byte(m.Data[k/4] >> (8 * (k % 4)))
+	}
+	return n
+}
+
+// SetExtendedData sets the extended header and the data of a single chunk
+// extended message to b and updates the data object count accordingly. b must
+// be no longer than MaxExtendedChunkBytes.
+func (m *Message) SetExtendedData(b []byte) {
+	var h ExtendedHeader
+	h.SetChunked(true)
+	h.SetDataSize(uint16(len(b)))
+	m.Data = [MaxDataObjects]uint32{uint32(h)}
+	for i, v := range b {
+		k := i + 2
+		m.Data[k/4] |= uint32(v) << (8 * (k % 4))
+	}
+	m.SetDataObjectCount(uint8((2 + len(b) + 3) / 4))
+}
+
+// ExtendedHeader represents the header of an extended message which follows
+// the message header.
+type ExtendedHeader uint16
+
+// IsChunked returns true if the message is chunked.
+func (h ExtendedHeader) IsChunked() bool {
+	return h&(1<<15) != 0
+}
+
+// SetChunked sets the chunked flag.
+func (h *ExtendedHeader) SetChunked(c bool) {
+	var b ExtendedHeader
+	if c {
+		b = 1 << 15
+	}
+	*h = (*h & ^(ExtendedHeader(1) << 15)) | b
+}
+
+// ChunkNumber returns the number of the chunk carried by the message,
+// starting at 0.
+func (h ExtendedHeader) ChunkNumber() uint8 {
+	return uint8(h>>11) & 0b1111
+}
+
+// SetChunkNumber sets the chunk number.
+func (h *ExtendedHeader) SetChunkNumber(n uint8) {
+	*h = (*h & ^(ExtendedHeader(0b1111) << 11)) | ExtendedHeader(n&0b1111)<<11
+}
+
+// IsRequestChunk returns true if the message is a request for the chunk
+// specified by ChunkNumber.
+func (h ExtendedHeader) IsRequestChunk() bool {
+	return h&(1<<10) != 0
+}
+
+// SetRequestChunk sets the request chunk flag.
+func (h *ExtendedHeader) SetRequestChunk(r bool) {
+	var b ExtendedHeader
+	if r {
+		b = 1 << 10
+	}
+	*h = (*h & ^(ExtendedHeader(1) << 10)) | b
+}
+
+// DataSize returns the total number of data bytes of the extended message
+// across all chunks.
+func (h ExtendedHeader) DataSize() uint16 {
+	return uint16(h) & (1<<9 - 1)
+}
+
+// SetDataSize sets the total number of data bytes of the extended message.
+func (h *ExtendedHeader) SetDataSize(s uint16) {
+	*h = (*h & ^ExtendedHeader(1<<9-1)) | ExtendedHeader(s&(1<<9-1))
+}
+
+// ExtendedControlType represents the type of an extended control message,
+// which is the first byte of its data.
+type ExtendedControlType uint8
+
+// Extended control message types.
+const (
+	ExtendedControlEPRGetSourceCap ExtendedControlType = 1
+	ExtendedControlEPRGetSinkCap   ExtendedControlType = 2
+	ExtendedControlEPRKeepAlive    ExtendedControlType = 3
+	ExtendedControlEPRKeepAliveAck ExtendedControlType = 4
 )
 
 // Revision returns the power delivery revision number of the message.
@@ -129,7 +283,7 @@ func (m Message) Revision() Revision {
 
 // SetRevision sets the power delivery revision number of the message.
 func (m *Message) SetRevision(r Revision) {
-	m.Header = (m.Header & ^(uint16(0b11) << 6)) | uint16(r<<6)
+	m.Header = (m.Header & ^(uint16(0b11) << 6)) | uint16(r&0b11)<<6
 }
 
 // Revision represents the power delivery revision number of a message.
@@ -149,7 +303,7 @@ func (m Message) PowerRole() PowerRole {
 
 // SetPowerRole sets the power role of the sender of the message.
 func (m *Message) SetPowerRole(r PowerRole) {
-	m.Header = (m.Header & ^(uint16(1) << 8)) | (uint16(r) << 8)
+	m.Header = (m.Header & ^(uint16(1) << 8)) | (uint16(r&1) << 8)
 }
 
 // PowerRole represents the power role of the sender of a message.
@@ -168,7 +322,7 @@ func (m Message) DataRole() DataRole {
 
 // SetDataRole sets the data role of the sender of the message.
 func (m *Message) SetDataRole(r DataRole) {
-	m.Header = (m.Header & ^(uint16(1) << 5)) | uint16(r<<5)
+	m.Header = (m.Header & ^(uint16(1) << 5)) | uint16(r&1)<<5
 }
 
 // DataRole represents the data role of the sender of a message.
@@ -233,6 +387,145 @@ func (o *FixedSupplyPDO) SetMaxCurrent(v uint16) {
 	*o = (*o & ^(FixedSupplyPDO(1)<<10 - 1)) | (FixedSupplyPDO(v)/10)&(1<<10-1)
 }
 
+// IsUnconstrainedPower returns true if the source has an external power source
+// available that is sufficient to adequately power the sink while it's
+// charging. Only meaningful for the first PDO of source capabilities.
+func (o FixedSupplyPDO) IsUnconstrainedPower() bool {
+	return o&(1<<27) != 0
+}
+
+// SetUnconstrainedPower sets the unconstrained power flag.
+func (o *FixedSupplyPDO) SetUnconstrainedPower(u bool) {
+	if u {
+		*o |= 1 << 27
+	} else {
+		*o &= ^FixedSupplyPDO(1 << 27)
+	}
+}
+
+// PeakCurrent returns the overload capability of the source for the PDO.
+func (o FixedSupplyPDO) PeakCurrent() PeakCurrent {
+	return PeakCurrent((o >> 20) & 0b11)
+}
+
+// SetPeakCurrent sets the overload capability of the source for the PDO.
+func (o *FixedSupplyPDO) SetPeakCurrent(p PeakCurrent) {
+	*o = (*o & ^(FixedSupplyPDO(0b11) << 20)) | FixedSupplyPDO(p&0b11)<<20
+}
+
+// IsEPRModeCapable returns true if the source supports Extended Power Range
+// mode. Only meaningful for the first PDO of source capabilities.
+func (o FixedSupplyPDO) IsEPRModeCapable() bool {
+	return o&(1<<23) != 0
+}
+
+// SetEPRModeCapable sets the EPR mode capable flag.
+func (o *FixedSupplyPDO) SetEPRModeCapable(c bool) {
+	if c {
+		*o |= 1 << 23
+	} else {
+		*o &= ^FixedSupplyPDO(1 << 23)
+	}
+}
+
+// PeakCurrent represents the overload capability of a fixed supply source, i.e.
+// how much current above the max current of the PDO the source can briefly
+// supply. Higher values provide more overload capability.
+type PeakCurrent uint8
+
+// Overload capabilities as percentage of the max current of the PDO for 1ms at
+// 5% duty cycle, 2ms at 10% and 10ms at 50%, as defined in table 6-10 of the
+// PD specification.
+const (
+	PeakCurrentNone     PeakCurrent = 0b00 // no overload capability
+	PeakCurrent150To110 PeakCurrent = 0b01 // 150% for 1ms, 125% for 2ms, 110% for 10ms
+	PeakCurrent200To125 PeakCurrent = 0b10 // 200% for 1ms, 150% for 2ms, 125% for 10ms
+	PeakCurrent200To150 PeakCurrent = 0b11 // 200% for 1ms, 175% for 2ms, 150% for 10ms
+)
+
+// VariableSupplyPDO represents a Variable Supply (non-Battery) Power Data
+// Object
+type VariableSupplyPDO uint32
+
+// NewVariableSupplyPDO returns a new blank VariableSupplyPDO.
+func NewVariableSupplyPDO() VariableSupplyPDO {
+	return VariableSupplyPDO(0b10) << 30
+}
+
+// MaxVoltage returns maximum voltage in millivolts.
+func (o VariableSupplyPDO) MaxVoltage() uint16 {
+	return uint16(((o >> 20) & (1<<10 - 1)) * 50)
+}
+
+// SetMaxVoltage sets the maximum voltage in millivolts. The voltage will be
+// rounded to the nearest 50mV.
+func (o *VariableSupplyPDO) SetMaxVoltage(v uint16) {
+	*o = (*o & ^((VariableSupplyPDO(1)<<10 - 1) << 20)) | ((VariableSupplyPDO(v)/50)&(1<<10-1))<<20
+}
+
+// MinVoltage returns minimum voltage in millivolts.
+func (o VariableSupplyPDO) MinVoltage() uint16 {
+	return uint16(((o >> 10) & (1<<10 - 1)) * 50)
+}
+
+// SetMinVoltage sets the minimum voltage in millivolts. The voltage will be
+// rounded to the nearest 50mV.
+func (o *VariableSupplyPDO) SetMinVoltage(v uint16) {
+	*o = (*o & ^((VariableSupplyPDO(1)<<10 - 1) << 10)) | ((VariableSupplyPDO(v)/50)&(1<<10-1))<<10
+}
+
+// MaxCurrent returns maximum current in milliamps.
+func (o VariableSupplyPDO) MaxCurrent() uint16 {
+	return uint16((o & (1<<10 - 1)) * 10)
+}
+
+// SetMaxCurrent sets the maximum current in milliamps. The current will be
+// rounded to the nearest 10mA.
+func (o *VariableSupplyPDO) SetMaxCurrent(c uint16) {
+	*o = (*o & ^(VariableSupplyPDO(1)<<10 - 1)) | (VariableSupplyPDO(c)/10)&(1<<10-1)
+}
+
+// BatteryPDO represents a Battery Supply Power Data Object
+type BatteryPDO uint32
+
+// NewBatteryPDO returns a new blank BatteryPDO.
+func NewBatteryPDO() BatteryPDO {
+	return BatteryPDO(0b01) << 30
+}
+
+// MaxVoltage returns maximum voltage in millivolts.
+func (o BatteryPDO) MaxVoltage() uint16 {
+	return uint16(((o >> 20) & (1<<10 - 1)) * 50)
+}
+
+// SetMaxVoltage sets the maximum voltage in millivolts. The voltage will be
+// rounded to the nearest 50mV.
+func (o *BatteryPDO) SetMaxVoltage(v uint16) {
+	*o = (*o & ^((BatteryPDO(1)<<10 - 1) << 20)) | ((BatteryPDO(v)/50)&(1<<10-1))<<20
+}
+
+// MinVoltage returns minimum voltage in millivolts.
+func (o BatteryPDO) MinVoltage() uint16 {
+	return uint16(((o >> 10) & (1<<10 - 1)) * 50)
+}
+
+// SetMinVoltage sets the minimum voltage in millivolts. The voltage will be
+// rounded to the nearest 50mV.
+func (o *BatteryPDO) SetMinVoltage(v uint16) {
+	*o = (*o & ^((BatteryPDO(1)<<10 - 1) << 10)) | ((BatteryPDO(v)/50)&(1<<10-1))<<10
+}
+
+// MaxPower returns maximum allowable power in milliwatts.
+func (o BatteryPDO) MaxPower() uint32 {
+	return uint32(o&(1<<10-1)) * 250
+}
+
+// SetMaxPower sets the maximum allowable power in milliwatts. The power will be
+// rounded to the nearest 250mW.
+func (o *BatteryPDO) SetMaxPower(p uint32) {
+	*o = (*o & ^(BatteryPDO(1)<<10 - 1)) | (BatteryPDO(p)/250)&(1<<10-1)
+}
+
 // PPSPDO represents a Programmable Power Supply Power Data Object
 type PPSPDO uint32
 
@@ -285,10 +578,286 @@ func (o PPSPDO) MaxCurrent() uint16 {
 // SetMaxCurrent sets the maximum current in milliamps. The current will be
 // rounded to the nearest 50mA.
 func (o *PPSPDO) SetMaxCurrent(c uint16) {
-	*o = (*o & ^(PPSPDO(1)<<8 - 1)) | PPSPDO((c/50)&(1<<7-1))
+	*o = (*o & ^(PPSPDO(1)<<7 - 1)) | PPSPDO((c/50)&(1<<7-1))
+}
+
+// EPRAVSPDO represents an Extended Power Range Adjustable Voltage Supply
+// Power Data Object
+type EPRAVSPDO uint32
+
+// NewEPRAVSPDO returns a new blank EPR adjustable voltage supply power data
+// object.
+func NewEPRAVSPDO() EPRAVSPDO {
+	return EPRAVSPDO(0b1101) << 28
+}
+
+// MinVoltage returns minimum voltage in millivolts.
+func (o EPRAVSPDO) MinVoltage() uint16 {
+	return uint16((o>>8)&(1<<8-1)) * 100
+}
+
+// SetMinVoltage sets the minimum voltage in millivolts. The voltage will be
+// rounded to the nearest 100mV.
+func (o *EPRAVSPDO) SetMinVoltage(v uint16) {
+	*o = (*o & ^((EPRAVSPDO(1)<<8 - 1) << 8)) | EPRAVSPDO((v/100)&(1<<8-1))<<8
+}
+
+// MaxVoltage returns maximum voltage in millivolts.
+func (o EPRAVSPDO) MaxVoltage() uint16 {
+	return uint16((o>>17)&(1<<9-1)) * 100
+}
+
+// SetMaxVoltage sets the maximum voltage in millivolts. The voltage will be
+// rounded to the nearest 100mV.
+func (o *EPRAVSPDO) SetMaxVoltage(v uint16) {
+	*o = (*o & ^((EPRAVSPDO(1)<<9 - 1) << 17)) | EPRAVSPDO((v/100)&(1<<9-1))<<17
+}
+
+// MaxPower returns the PD power (PDP) in milliwatts.
+func (o EPRAVSPDO) MaxPower() uint32 {
+	return uint32(o&(1<<8-1)) * 1000
+}
+
+// SetMaxPower sets the PD power (PDP) in milliwatts. The power will be rounded
+// to the nearest 1W.
+func (o *EPRAVSPDO) SetMaxPower(p uint32) {
+	*o = (*o & ^(EPRAVSPDO(1)<<8 - 1)) | EPRAVSPDO((p/1000)&(1<<8-1))
+}
+
+// BISTDO represents a BIST Data Object.
+type BISTDO uint32
+
+// Mode returns the BIST mode.
+func (o BISTDO) Mode() BISTMode {
+	return BISTMode(o >> 28)
+}
+
+// SetMode sets the BIST mode.
+func (o *BISTDO) SetMode(m BISTMode) {
+	*o = (*o & ^(BISTDO(0b1111) << 28)) | BISTDO(m&0b1111)<<28
+}
+
+// BISTMode represents the mode of a BIST data object.
+type BISTMode uint8
+
+// BIST modes.
+const (
+	BISTModeCarrier  BISTMode = 0b0101
+	BISTModeTestData BISTMode = 0b1000
+)
+
+// AlertDO represents an Alert Data Object.
+type AlertDO uint32
+
+// Type returns the type of alert which may have multiple alert bits set.
+func (o AlertDO) Type() AlertType {
+	return AlertType(o >> 24)
+}
+
+// SetType sets the type of alert.
+func (o *AlertDO) SetType(t AlertType) {
+	*o = (*o & ^(AlertDO(0xff) << 24)) | AlertDO(t)<<24
+}
+
+// AlertType represents the type of alert in an alert data object. Multiple
+// alert types can be combined.
+type AlertType uint8
+
+// Alert types.
+const (
+	AlertBatteryStatusChange      AlertType = 1 << 1
+	AlertOverCurrent              AlertType = 1 << 2
+	AlertOverTemperature          AlertType = 1 << 3
+	AlertOperatingConditionChange AlertType = 1 << 4
+	AlertSourceInputChange        AlertType = 1 << 5
+	AlertOverVoltage              AlertType = 1 << 6
+	AlertExtended                 AlertType = 1 << 7
+)
+
+// EPRModeDO represents an EPR Mode Data Object.
+type EPRModeDO uint32
+
+// Action returns the action of the EPR mode data object.
+func (o EPRModeDO) Action() EPRModeAction {
+	return EPRModeAction(o >> 24)
+}
+
+// SetAction sets the action of the EPR mode data object.
+func (o *EPRModeDO) SetAction(a EPRModeAction) {
+	*o = (*o & ^(EPRModeDO(0xff) << 24)) | EPRModeDO(a)<<24
+}
+
+// Data returns the action specific data. For EPRModeEnter, it is the PD power
+// of the sink in watts.
+func (o EPRModeDO) Data() uint8 {
+	return uint8(o >> 16)
+}
+
+// SetData sets the action specific data.
+func (o *EPRModeDO) SetData(d uint8) {
+	*o = (*o & ^(EPRModeDO(0xff) << 16)) | EPRModeDO(d)<<16
+}
+
+// EPRModeAction represents the action of an EPR mode data object.
+type EPRModeAction uint8
+
+// EPR mode actions.
+const (
+	EPRModeEnter             EPRModeAction = 1
+	EPRModeEnterAcknowledged EPRModeAction = 2
+	EPRModeEnterSucceeded    EPRModeAction = 3
+	EPRModeEnterFailed       EPRModeAction = 4
+	EPRModeExit              EPRModeAction = 5
+)
+
+// Status represents the decoded Status Data Block carried by a status
+// message.
+type Status struct {
+	// Internal temperature of the source in degrees celsius. 0 means not
+	// supported and 1 means less than 2 degrees.
+	InternalTemp        uint8
+	PresentInput        StatusInput
+	PresentBatteryInput StatusBatteryInput
+	EventFlags          StatusEvent
+	TemperatureStatus   TemperatureStatus
+}
+
+// ParseStatus decodes the Status Data Block b. Fields missing from b are left
+// as zero.
+func ParseStatus(b []byte) Status {
+	var d [5]byte
+	copy(d[:], b)
+	return Status{
+		InternalTemp:        d[0],
+		PresentInput:        StatusInput(d[1]),
+		PresentBatteryInput: StatusBatteryInput(d[2]),
+		EventFlags:          StatusEvent(d[3]),
+		TemperatureStatus:   TemperatureStatus(d[4]>>1) & 0b11,
+	}
+}
+
+// BatteryCapabilities represents the decoded Battery Capability Data Block
+// carried by a battery capabilities message.
+type BatteryCapabilities struct {
+	VID uint16 // Vendor ID of the battery
+	PID uint16 // Product ID of the battery
+	// Design capacity and last full charge capacity of the battery in units of
+	// 0.1Wh. 0 means battery not present and 0xFFFF means unknown.
+	DesignCapacity          uint16
+	LastFullChargeCapacity  uint16
+	InvalidBatteryReference bool // set if the requested battery does not exist
+}
+
+// ParseBatteryCapabilities decodes the Battery Capability Data Block b. Fields
+// missing from b are left as zero.
+func ParseBatteryCapabilities(b []byte) BatteryCapabilities {
+	var d [9]byte
+	copy(d[:], b)
+	return BatteryCapabilities{
+		VID:                     uint16(d[0]) | uint16(d[1])<<8,
+		PID:                     uint16(d[2]) | uint16(d[3])<<8,
+		DesignCapacity:          uint16(d[4]) | uint16(d[5])<<8,
+		LastFullChargeCapacity:  uint16(d[6]) | uint16(d[7])<<8,
+		InvalidBatteryReference: d[8]&1 != 0,
+	}
+}
+
+// SourceCapabilitiesExtended represents the decoded Source Capabilities
+// Extended Data Block carried by a source capabilities extended message, which
+// identifies the source and describes its capabilities beyond its PDOs.
+type SourceCapabilitiesExtended struct {
+	VID             uint16 // USB vendor ID of the source
+	PID             uint16 // product ID of the source
+	XID             uint32 // USB-IF assigned ID, 0 if none
+	FirmwareVersion uint8  // assigned by the vendor
+	HardwareVersion uint8  // assigned by the vendor
+	// Time in milliseconds the source maintains its output at nominal load
+	// after losing its input power.
+	HoldupTime uint8
+	// Source inputs, with bit 0 set if an external supply is present, bit 1
+	// set if it is unconstrained and bit 2 set if an internal battery is
+	// present.
+	SourceInputs          uint8
+	FixedBatteries        uint8 // number of fixed batteries
+	HotSwappableBatteries uint8 // number of hot swappable battery slots
+	SourcePDP             uint8 // PD power in watts
+	EPRSourcePDP          uint8 // EPR PD power in watts, 0 if not supported
+}
+
+// ParseSourceCapabilitiesExtended decodes the Source Capabilities Extended
+// Data Block b. Fields missing from b are left as zero.
+func ParseSourceCapabilitiesExtended(b []byte) SourceCapabilitiesExtended {
+	var d [25]byte
+	copy(d[:], b)
+	return SourceCapabilitiesExtended{
+		VID:                   uint16(d[0]) | uint16(d[1])<<8,
+		PID:                   uint16(d[2]) | uint16(d[3])<<8,
+		XID:                   uint32(d[4]) | uint32(d[5])<<8 | uint32(d[6])<<16 | uint32(d[7])<<24,
+		FirmwareVersion:       d[8],
+		HardwareVersion:       d[9],
+		HoldupTime:            d[11],
+		SourceInputs:          d[21] & 0b111,
+		FixedBatteries:        d[22] & 0b1111,
+		HotSwappableBatteries: d[22] >> 4,
+		SourcePDP:             d[23] & 0x7f,
+		EPRSourcePDP:          d[24],
+	}
 }
 
-// RequestDO represents a Request Data Object.
+// StatusInput represents the present input field of a status which may have
+// multiple input bits set.
+type StatusInput uint8
+
+// Status inputs.
+const (
+	StatusInputExternalPower      StatusInput = 1 << 1
+	StatusInputExternalPowerAC    StatusInput = 1 << 2 // AC if set, DC otherwise
+	StatusInputInternalBattery    StatusInput = 1 << 3
+	StatusInputInternalNonBattery StatusInput = 1 << 4
+)
+
+// StatusBatteryInput represents the present battery input field of a status.
+type StatusBatteryInput uint8
+
+// FixedBatteries returns the bitmap of the fixed batteries present, one bit
+// per battery.
+func (i StatusBatteryInput) FixedBatteries() uint8 {
+	return uint8(i) & 0b1111
+}
+
+// HotSwappableBatteries returns the bitmap of the hot swappable batteries
+// present, one bit per battery.
+func (i StatusBatteryInput) HotSwappableBatteries() uint8 {
+	return uint8(i) >> 4
+}
+
+// StatusEvent represents the event flags field of a status which may have
+// multiple event bits set.
+type StatusEvent uint8
+
+// Status events.
+const (
+	StatusEventOverCurrent     StatusEvent = 1 << 1
+	StatusEventOverTemperature StatusEvent = 1 << 2
+	StatusEventOverVoltage     StatusEvent = 1 << 3
+	StatusEventCurrentLimit    StatusEvent = 1 << 4 // operating in current limit (CF) mode
+)
+
+// TemperatureStatus represents the temperature status field of a status.
+type TemperatureStatus uint8
+
+// Temperature statuses.
+const (
+	TemperatureNotSupported TemperatureStatus = 0b00
+	TemperatureNormal       TemperatureStatus = 0b01
+	TemperatureWarning      TemperatureStatus = 0b10
+	TemperatureOver         TemperatureStatus = 0b11
+)
+
+// RequestDO represents a Request Data Object. The encoding of the RDO depends on
+// the type of the PDO it selects, and the accessors must be used accordingly.
+// Requests for fixed and variable supply PDOs share the same encoding and use
+// the Fixed prefixed accessors.
 type RequestDO uint32
 
 // EmptyRequestDO is returned by device policy managers to indicate that they do
@@ -304,7 +873,7 @@ func (o RequestDO) SelectedObjectPosition() uint8 {
 // SetSelectedObjectPosition sets the position number of the PDO the source
 // capability message, starting at 1.
 func (o *RequestDO) SetSelectedObjectPosition(p uint8) {
-	*o = (*o & ^(RequestDO(0b1111) << 28)) | RequestDO(p)<<28
+	*o = (*o & ^(RequestDO(0b1111) << 28)) | RequestDO(p&0b1111)<<28
 }
 
 // CapabilityMismatch returns true if capability mismatch flag of the RDO is
@@ -322,30 +891,73 @@ func (o *RequestDO) SetCapabilityMismatch(m bool) {
 	*o = (*o & ^(RequestDO(1) << 26)) | b
 }
 
-// FixedOperatingCurrent returns current in milliamps for fixed request
-// objects.
+// IsGiveBack returns true if the GiveBack flag of the RDO is set, in which case
+// the max operating current or power fields of fixed, variable and battery
+// request objects hold the minimum operating current or power instead.
+// GiveBack is deprecated in PD 3.0 and must not be set by PD 3.0 sinks.
+func (o RequestDO) IsGiveBack() bool {
+	return o&(1<<27) != 0
+}
+
+// SetGiveBack sets the GiveBack flag of the RDO.
+func (o *RequestDO) SetGiveBack(g bool) {
+	var b RequestDO
+	if g {
+		b = 1 << 27
+	}
+	*o = (*o & ^(RequestDO(1) << 27)) | b
+}
+
+// IsEPRModeCapable returns true if the sink supports Extended Power Range mode.
+func (o RequestDO) IsEPRModeCapable() bool {
+	return o&(1<<22) != 0
+}
+
+// SetEPRModeCapable sets the EPR mode capable flag of the RDO.
+func (o *RequestDO) SetEPRModeCapable(c bool) {
+	var b RequestDO
+	if c {
+		b = 1 << 22
+	}
+	*o = (*o & ^(RequestDO(1) << 22)) | b
+}
+
+// FixedOperatingCurrent returns current in milliamps for fixed and variable
+// request objects.
 func (o RequestDO) FixedOperatingCurrent() uint16 {
 	return uint16(((o >> 10) & (1<<10 - 1)) * 10)
 }
 
 // SetFixedOperatingCurrent sets current in milliamps rounded to nearest 10mA
-// for fixed request objects.
+// for fixed and variable request objects.
 func (o *RequestDO) SetFixedOperatingCurrent(c uint16) {
 	*o = (*o & ^((RequestDO(1)<<10 - 1) << 10)) | ((RequestDO(c)/10)&(1<<10-1))<<10
 }
 
-// FixedMaxOperatingCurrent returns current in milliamps for fixed request
-// objects without GiveBack support.
+// FixedMaxOperatingCurrent returns current in milliamps for fixed and variable
+// request objects without GiveBack support.
 func (o RequestDO) FixedMaxOperatingCurrent() uint16 {
 	return uint16((o & (1<<10 - 1)) * 10)
 }
 
 // SetFixedMaxOperatingCurrent sets current in milliamps rounded to nearest
-// 10mA for fixed request objects without GiveBack support.
+// 10mA for fixed and variable request objects without GiveBack support.
 func (o *RequestDO) SetFixedMaxOperatingCurrent(c uint16) {
 	*o = (*o & ^(RequestDO(1)<<10 - 1)) | ((RequestDO(c) / 10) & (1<<10 - 1))
 }
 
+// FixedMinOperatingCurrent returns current in milliamps for fixed and variable
+// request objects with GiveBack support.
+func (o RequestDO) FixedMinOperatingCurrent() uint16 {
+	return o.FixedMaxOperatingCurrent()
+}
+
+// SetFixedMinOperatingCurrent sets current in milliamps rounded to nearest
+// 10mA for fixed and variable request objects with GiveBack support.
+func (o *RequestDO) SetFixedMinOperatingCurrent(c uint16) {
+	o.SetFixedMaxOperatingCurrent(c)
+}
+
 // PPSOutputVoltage returns voltage in millivolts for PPS data objects.
 func (o RequestDO) PPSOutputVoltage() uint16 {
 	return uint16(((o >> 9) & (1<<12 - 1)) * 20)
@@ -367,3 +979,61 @@ func (o RequestDO) PPSOutputCurrent() uint16 {
 func (o *RequestDO) SetPPSOutputCurrent(v uint16) {
 	*o = (*o & ^(RequestDO(1)<<7 - 1)) | (RequestDO(v)/50)&(1<<7-1)
 }
+
+// AVSOutputVoltage returns voltage in millivolts for EPR AVS data objects.
+func (o RequestDO) AVSOutputVoltage() uint16 {
+	return uint16(((o >> 9) & (1<<12 - 1)) * 25)
+}
+
+// SetAVSOutputVoltage sets voltage in millivolts rounded to nearest 100mV for
+// EPR AVS data objects.
+func (o *RequestDO) SetAVSOutputVoltage(v uint16) {
+	*o = (*o & ^((RequestDO(1)<<12 - 1) << 9)) | ((RequestDO(v)/100*4)&(1<<12-1))<<9
+}
+
+// AVSOutputCurrent returns current in milliamps for EPR AVS data objects.
+func (o RequestDO) AVSOutputCurrent() uint16 {
+	return uint16((o & (1<<7 - 1)) * 50)
+}
+
+// SetAVSOutputCurrent sets current in milliamps rounded to nearest 50mA for
+// EPR AVS data objects.
+func (o *RequestDO) SetAVSOutputCurrent(v uint16) {
+	*o = (*o & ^(RequestDO(1)<<7 - 1)) | (RequestDO(v)/50)&(1<<7-1)
+}
+
+// BatteryOperatingPower returns power in milliwatts for battery request
+// objects.
+func (o RequestDO) BatteryOperatingPower() uint32 {
+	return uint32((o>>10)&(1<<10-1)) * 250
+}
+
+// SetBatteryOperatingPower sets power in milliwatts rounded to nearest 250mW
+// for battery request objects.
+func (o *RequestDO) SetBatteryOperatingPower(p uint32) {
+	*o = (*o & ^((RequestDO(1)<<10 - 1) << 10)) | ((RequestDO(p)/250)&(1<<10-1))<<10
+}
+
+// BatteryMaxOperatingPower returns power in milliwatts for battery request
+// objects without GiveBack support.
+func (o RequestDO) BatteryMaxOperatingPower() uint32 {
+	return uint32(o&(1<<10-1)) * 250
+}
+
+// SetBatteryMaxOperatingPower sets power in milliwatts rounded to nearest
+// 250mW for battery request objects without GiveBack support.
+func (o *RequestDO) SetBatteryMaxOperatingPower(p uint32) {
+	*o = (*o & ^(RequestDO(1)<<10 - 1)) | ((RequestDO(p) / 250) & (1<<10 - 1))
+}
+
+// BatteryMinOperatingPower returns power in milliwatts for battery request
+// objects with GiveBack support.
+func (o RequestDO) BatteryMinOperatingPower() uint32 {
+	return o.BatteryMaxOperatingPower()
+}
+
+// SetBatteryMinOperatingPower sets power in milliwatts rounded to nearest
+// 250mW for battery request objects with GiveBack support.
+func (o *RequestDO) SetBatteryMinOperatingPower(p uint32) {
+	o.SetBatteryMaxOperatingPower(p)
+}
@@ -0,0 +1,398 @@
+package pdmsg
+
+import (
+	"math/bits"
+	"testing"
+)
+
+// field describes a bit field of a 32 bit word with its setter and getter.
+// Values are quantized down to step and limited to the width of the field.
+type field struct {
+	name string
+	mask uint32 // bits of the field within the word
+	step uint32
+	set  func(w *uint32, v uint32)
+	get  func(w uint32) uint32
+}
+
+// testWords are the initial words the fields are set in, so that a setter
+// disturbing other bits is caught both when they are clear and set.
+var testWords = [...]uint32{0, 0xffffffff, 0xa5a5a5a5, 0x5a5a5a5a}
+
+// checkFields sets each field to a range of values within each of testWords,
+// and checks that the getter returns the value quantized to the step of the
+// field, and that no bits outside the field are changed, even when the value
+// is out of range.
+func checkFields(t *testing.T, fields []field) {
+	t.Helper()
+	for _, f := range fields {
+		max := (f.mask >> bits.TrailingZeros32(f.mask)) * f.step
+		for _, w := range testWords {
+			for _, v := range []uint32{0, 1, f.step - 1, f.step, f.step + 1, max / 3, max/2 + 7, max - 1, max, max + f.step} {
+				got := w
+				f.set(&got, v)
+				if (got^w)&^f.mask != 0 {
+					t.Errorf("%s: set %d in %#08x: changed bits outside field: %#08x", f.name, v, w, got)
+				}
+				if want := v / f.step * f.step; v <= max && f.get(got) != want {
+					t.Errorf("%s: set %d in %#08x: got %d, want %d", f.name, v, w, f.get(got), want)
+				}
+			}
+		}
+	}
+}
+
+// headerField returns a field of the message header in the lower 16 bits of
+// the word.
+func headerField(name string, mask uint32, set func(m *Message, v uint32), get func(m Message) uint32) field {
+	return field{name, mask, 1,
+		func(w *uint32, v uint32) {
+			m := Message{Header: uint16(*w)}
+			set(&m, v)
+			*w = *w&^0xffff | uint32(m.Header)
+		},
+		func(w uint32) uint32 { return get(Message{Header: uint16(w)}) },
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	checkFields(t, []field{
+		headerField("Type", 0x1f,
+			func(m *Message, v uint32) { m.SetType(Type(v)) },
+			func(m Message) uint32 { return uint32(m.Type()) }),
+		headerField("DataRole", 1<<5,
+			func(m *Message, v uint32) { m.SetDataRole(DataRole(v)) },
+			func(m Message) uint32 { return uint32(m.DataRole()) }),
+		headerField("Revision", 0b11<<6,
+			func(m *Message, v uint32) { m.SetRevision(Revision(v)) },
+			func(m Message) uint32 { return uint32(m.Revision()) }),
+		headerField("PowerRole", 1<<8,
+			func(m *Message, v uint32) { m.SetPowerRole(PowerRole(v)) },
+			func(m Message) uint32 { return uint32(m.PowerRole()) }),
+		headerField("ID", 0b111<<9,
+			func(m *Message, v uint32) { m.SetID(uint8(v)) },
+			func(m Message) uint32 { return uint32(m.ID()) }),
+		headerField("DataObjectCount", 0b111<<12,
+			func(m *Message, v uint32) { m.SetDataObjectCount(uint8(v)) },
+			func(m Message) uint32 { return uint32(m.DataObjectCount()) }),
+		headerField("Extended", 1<<15,
+			func(m *Message, v uint32) { m.SetExtended(v != 0) },
+			func(m Message) uint32 {
+				if m.IsExtended() {
+					return 1
+				}
+				return 0
+			}),
+	})
+}
+
+func TestHeaderToBytes(t *testing.T) {
+	var m Message
+	m.SetType(TypeRequest)
+	m.SetRevision(Revision30)
+	m.SetID(5)
+	m.SetDataObjectCount(1)
+	m.Data[0] = 0x12345678
+	var b [MaxMessageBytes]byte
+	if n := m.ToBytes(b[:]); n != 6 {
+		t.Fatalf("got %d bytes, want 6", n)
+	}
+	if got := uint16(b[1])<<8 | uint16(b[0]); got != m.Header {
+		t.Errorf("got header %#04x, want %#04x", got, m.Header)
+	}
+	if got := uint32(b[5])<<24 | uint32(b[4])<<16 | uint32(b[3])<<8 | uint32(b[2]); got != m.Data[0] {
+		t.Errorf("got data %#08x, want %#08x", got, m.Data[0])
+	}
+}
+
+func TestPDORoundTrip(t *testing.T) {
+	checkFields(t, []field{
+		{"FixedSupplyPDO.Voltage", (1<<10 - 1) << 10, 50,
+			func(w *uint32, v uint32) { o := FixedSupplyPDO(*w); o.SetVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(FixedSupplyPDO(w).Voltage()) }},
+		{"FixedSupplyPDO.MaxCurrent", 1<<10 - 1, 10,
+			func(w *uint32, v uint32) { o := FixedSupplyPDO(*w); o.SetMaxCurrent(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(FixedSupplyPDO(w).MaxCurrent()) }},
+		{"FixedSupplyPDO.PeakCurrent", 0b11 << 20, 1,
+			func(w *uint32, v uint32) { o := FixedSupplyPDO(*w); o.SetPeakCurrent(PeakCurrent(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(FixedSupplyPDO(w).PeakCurrent()) }},
+		{"VariableSupplyPDO.MaxVoltage", (1<<10 - 1) << 20, 50,
+			func(w *uint32, v uint32) { o := VariableSupplyPDO(*w); o.SetMaxVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(VariableSupplyPDO(w).MaxVoltage()) }},
+		{"VariableSupplyPDO.MinVoltage", (1<<10 - 1) << 10, 50,
+			func(w *uint32, v uint32) { o := VariableSupplyPDO(*w); o.SetMinVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(VariableSupplyPDO(w).MinVoltage()) }},
+		{"VariableSupplyPDO.MaxCurrent", 1<<10 - 1, 10,
+			func(w *uint32, v uint32) { o := VariableSupplyPDO(*w); o.SetMaxCurrent(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(VariableSupplyPDO(w).MaxCurrent()) }},
+		{"BatteryPDO.MaxVoltage", (1<<10 - 1) << 20, 50,
+			func(w *uint32, v uint32) { o := BatteryPDO(*w); o.SetMaxVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(BatteryPDO(w).MaxVoltage()) }},
+		{"BatteryPDO.MinVoltage", (1<<10 - 1) << 10, 50,
+			func(w *uint32, v uint32) { o := BatteryPDO(*w); o.SetMinVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(BatteryPDO(w).MinVoltage()) }},
+		{"BatteryPDO.MaxPower", 1<<10 - 1, 250,
+			func(w *uint32, v uint32) { o := BatteryPDO(*w); o.SetMaxPower(v); *w = uint32(o) },
+			func(w uint32) uint32 { return BatteryPDO(w).MaxPower() }},
+		{"PPSPDO.MaxVoltage", (1<<8 - 1) << 17, 100,
+			func(w *uint32, v uint32) { o := PPSPDO(*w); o.SetMaxVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(PPSPDO(w).MaxVoltage()) }},
+		{"PPSPDO.MinVoltage", (1<<8 - 1) << 8, 100,
+			func(w *uint32, v uint32) { o := PPSPDO(*w); o.SetMinVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(PPSPDO(w).MinVoltage()) }},
+		{"PPSPDO.MaxCurrent", 1<<7 - 1, 50,
+			func(w *uint32, v uint32) { o := PPSPDO(*w); o.SetMaxCurrent(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(PPSPDO(w).MaxCurrent()) }},
+		{"EPRAVSPDO.MaxVoltage", (1<<9 - 1) << 17, 100,
+			func(w *uint32, v uint32) { o := EPRAVSPDO(*w); o.SetMaxVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(EPRAVSPDO(w).MaxVoltage()) }},
+		{"EPRAVSPDO.MinVoltage", (1<<8 - 1) << 8, 100,
+			func(w *uint32, v uint32) { o := EPRAVSPDO(*w); o.SetMinVoltage(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(EPRAVSPDO(w).MinVoltage()) }},
+		{"EPRAVSPDO.MaxPower", 1<<8 - 1, 1000,
+			func(w *uint32, v uint32) { o := EPRAVSPDO(*w); o.SetMaxPower(v); *w = uint32(o) },
+			func(w uint32) uint32 { return EPRAVSPDO(w).MaxPower() }},
+	})
+}
+
+func TestRDORoundTrip(t *testing.T) {
+	checkFields(t, []field{
+		{"SelectedObjectPosition", 0b1111 << 28, 1,
+			func(w *uint32, v uint32) { o := RequestDO(*w); o.SetSelectedObjectPosition(uint8(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(RequestDO(w).SelectedObjectPosition()) }},
+		{"FixedOperatingCurrent", (1<<10 - 1) << 10, 10,
+			func(w *uint32, v uint32) { o := RequestDO(*w); o.SetFixedOperatingCurrent(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(RequestDO(w).FixedOperatingCurrent()) }},
+		{"FixedMaxOperatingCurrent", 1<<10 - 1, 10,
+			func(w *uint32, v uint32) {
+				o := RequestDO(*w)
+				o.SetFixedMaxOperatingCurrent(uint16(v))
+				*w = uint32(o)
+			},
+			func(w uint32) uint32 { return uint32(RequestDO(w).FixedMaxOperatingCurrent()) }},
+		{"PPSOutputCurrent", 1<<7 - 1, 50,
+			func(w *uint32, v uint32) { o := RequestDO(*w); o.SetPPSOutputCurrent(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(RequestDO(w).PPSOutputCurrent()) }},
+		{"AVSOutputCurrent", 1<<7 - 1, 50,
+			func(w *uint32, v uint32) { o := RequestDO(*w); o.SetAVSOutputCurrent(uint16(v)); *w = uint32(o) },
+			func(w uint32) uint32 { return uint32(RequestDO(w).AVSOutputCurrent()) }},
+		{"BatteryOperatingPower", (1<<10 - 1) << 10, 250,
+			func(w *uint32, v uint32) { o := RequestDO(*w); o.SetBatteryOperatingPower(v); *w = uint32(o) },
+			func(w uint32) uint32 { return RequestDO(w).BatteryOperatingPower() }},
+		{"BatteryMaxOperatingPower", 1<<10 - 1, 250,
+			func(w *uint32, v uint32) { o := RequestDO(*w); o.SetBatteryMaxOperatingPower(v); *w = uint32(o) },
+			func(w uint32) uint32 { return RequestDO(w).BatteryMaxOperatingPower() }},
+	})
+}
+
+func TestRDOPPSOutputVoltage(t *testing.T) {
+
+	// Field holds up to 81.9V which doesn't fit the uint16 millivolts
+
+	for _, v := range []uint16{0, 19, 20, 21, 3300, 5019, 21000, 65519, 65535} {
+		for _, w := range testWords {
+			o := RequestDO(w)
+			o.SetPPSOutputVoltage(v)
+			if want := v / 20 * 20; o.PPSOutputVoltage() != want {
+				t.Errorf("set %d in %#08x: got %d, want %d", v, w, o.PPSOutputVoltage(), want)
+			}
+			if (uint32(o)^w)&^((1<<12-1)<<9) != 0 {
+				t.Errorf("set %d in %#08x: changed bits outside field: %#08x", v, w, uint32(o))
+			}
+		}
+	}
+}
+
+func TestRDOAVSOutputVoltage(t *testing.T) {
+
+	// AVS voltage is encoded in 25mV units but only 100mV steps are allowed
+
+	for _, v := range []uint16{0, 99, 100, 15000, 15099, 48000, 48050} {
+		for _, w := range testWords {
+			o := RequestDO(w)
+			o.SetAVSOutputVoltage(v)
+			if want := v / 100 * 100; o.AVSOutputVoltage() != want {
+				t.Errorf("set %d in %#08x: got %d, want %d", v, w, o.AVSOutputVoltage(), want)
+			}
+			if (uint32(o)^w)&^((1<<12-1)<<9) != 0 {
+				t.Errorf("set %d in %#08x: changed bits outside field: %#08x", v, w, uint32(o))
+			}
+		}
+	}
+}
+
+func TestRDOFlags(t *testing.T) {
+	flags := []struct {
+		name string
+		bit  uint32
+		set  func(o *RequestDO, v bool)
+		get  func(o RequestDO) bool
+	}{
+		{"CapabilityMismatch", 1 << 26, (*RequestDO).SetCapabilityMismatch, RequestDO.CapabilityMismatch},
+		{"GiveBack", 1 << 27, (*RequestDO).SetGiveBack, RequestDO.IsGiveBack},
+		{"EPRModeCapable", 1 << 22, (*RequestDO).SetEPRModeCapable, RequestDO.IsEPRModeCapable},
+	}
+	for _, f := range flags {
+		for _, w := range testWords {
+			for _, v := range []bool{false, true} {
+				o := RequestDO(w)
+				f.set(&o, v)
+				if f.get(o) != v {
+					t.Errorf("%s: set %t in %#08x: got %t", f.name, v, w, f.get(o))
+				}
+				if (uint32(o)^w)&^f.bit != 0 {
+					t.Errorf("%s: set %t in %#08x: changed bits outside flag: %#08x", f.name, v, w, uint32(o))
+				}
+			}
+		}
+	}
+}
+
+func TestPPSPDOAllFields(t *testing.T) {
+	for _, c := range []struct {
+		minV, maxV, maxC uint16
+		limited          bool
+	}{
+		{3300, 5900, 3000, false},
+		{3300, 11000, 5000, true},
+		{5000, 21000, 3250, true},
+		{25500, 25500, 6350, false}, // all fields at their max
+		{0, 0, 0, true},
+	} {
+		p := NewPPSPDO()
+		p.SetMaxVoltage(c.maxV)
+		p.SetMinVoltage(c.minV)
+		p.SetMaxCurrent(c.maxC)
+		p.SetPowerLimited(c.limited)
+		if PDO(p).Type() != PDOTypePPS {
+			t.Errorf("%+v: got type %d, want PPS", c, PDO(p).Type())
+		}
+		if p.MinVoltage() != c.minV || p.MaxVoltage() != c.maxV || p.MaxCurrent() != c.maxC || p.IsPowerLimited() != c.limited {
+			t.Errorf("%+v: got %d-%dmV %dmA limited %t", c, p.MinVoltage(), p.MaxVoltage(), p.MaxCurrent(), p.IsPowerLimited())
+		}
+	}
+}
+
+func TestParseSourceCapabilitiesExtended(t *testing.T) {
+	b := []byte{
+		0x34, 0x12, // VID
+		0x78, 0x56, // PID
+		0x04, 0x03, 0x02, 0x01, // XID
+		7, 9, // firmware and hardware version
+		0,                         // voltage regulation
+		3,                         // holdup time
+		0, 0, 0, 0, 0, 0, 0, 0, 0, // compliance, touch current and peak currents
+		0xfd, // source inputs, reserved bits set
+		0x21, // batteries
+		0xe4, // PDP with reserved bit 7 set
+		140,  // EPR PDP
+	}
+	want := SourceCapabilitiesExtended{
+		VID:                   0x1234,
+		PID:                   0x5678,
+		XID:                   0x01020304,
+		FirmwareVersion:       7,
+		HardwareVersion:       9,
+		HoldupTime:            3,
+		SourceInputs:          0b101,
+		FixedBatteries:        1,
+		HotSwappableBatteries: 2,
+		SourcePDP:             100,
+		EPRSourcePDP:          140,
+	}
+	if got := ParseSourceCapabilitiesExtended(b); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Source capabilities extended of PD 3.0 sources lack EPR source PDP
+
+	want.EPRSourcePDP = 0
+	if got := ParseSourceCapabilitiesExtended(b[:24]); got != want {
+		t.Errorf("got %+v from 24 bytes, want %+v", got, want)
+	}
+}
+
+// fuzzMessage returns a message with header h and data objects from b.
+func fuzzMessage(h uint16, b []byte) Message {
+	m := Message{Header: h}
+	for i := range m.Data {
+		for j := 0; j < 4 && i*4+j < len(b); j++ {
+			m.Data[i] |= uint32(b[i*4+j]) << (8 * j)
+		}
+	}
+	return m
+}
+
+func FuzzExtendedData(f *testing.F) {
+	var m Message
+	m.SetExtended(true)
+	m.SetType(TypeStatus)
+	m.SetExtendedData([]byte{40, 2, 0, 0, 4, 0, 0})
+	var b [MaxMessageBytes]byte
+	n := m.ToBytes(b[:])
+	f.Add(m.Header, b[2:n], 7)
+	f.Add(uint16(0xffff), []byte{0xff, 0xff, 0xff, 0xff}, 260)
+	f.Add(uint16(0), []byte{}, 0)
+	f.Fuzz(func(t *testing.T, h uint16, data []byte, size int) {
+		if size < 0 || size > 1024 {
+			return
+		}
+		m := fuzzMessage(h, data)
+		buf := make([]byte, size)
+		n := m.ExtendedData(buf)
+		if n < 0 || n > size || n > MaxExtendedChunkBytes {
+			t.Fatalf("got %d bytes for buffer of %d", n, size)
+		}
+		ParseStatus(buf[:n])
+		ParseBatteryCapabilities(buf[:n])
+		ParseSourceCapabilitiesExtended(buf[:n])
+	})
+}
+
+func FuzzSetExtendedData(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1, 2, 3, 4, 5})
+	f.Add(make([]byte, MaxExtendedChunkBytes))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) > MaxExtendedChunkBytes {
+			return
+		}
+		var m Message
+		m.SetExtended(true)
+		m.SetExtendedData(b)
+		var got [MaxExtendedChunkBytes]byte
+		n := m.ExtendedData(got[:])
+		if string(got[:n]) != string(b) {
+			t.Fatalf("got %x, want %x", got[:n], b)
+		}
+	})
+}
+
+func FuzzPDO(f *testing.F) {
+	for _, p := range []uint32{0, 0x0001912c, 0xc8dc213c, 0x9001912c, 0xd1a4645a, 0xffffffff} {
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, p uint32) {
+		switch PDO(p).Type() {
+		case PDOTypeFixedSupply:
+			o := FixedSupplyPDO(p)
+			_, _, _, _, _ = o.Voltage(), o.MaxCurrent(), o.PeakCurrent(), o.IsUnconstrainedPower(), o.IsEPRModeCapable()
+		case PDOTypeVariableSupply:
+			o := VariableSupplyPDO(p)
+			_, _, _ = o.MinVoltage(), o.MaxVoltage(), o.MaxCurrent()
+		case PDOTypeBattery:
+			o := BatteryPDO(p)
+			_, _, _ = o.MinVoltage(), o.MaxVoltage(), o.MaxPower()
+		case PDOTypePPS:
+			o := PPSPDO(p)
+			_, _, _, _ = o.MinVoltage(), o.MaxVoltage(), o.MaxCurrent(), o.IsPowerLimited()
+		case PDOTypeEPRAVS:
+			o := EPRAVSPDO(p)
+			_, _, _ = o.MinVoltage(), o.MaxVoltage(), o.MaxPower()
+		default:
+			if p>>30 != 0b11 {
+				t.Fatalf("%#08x: unexpected type %d", p, PDO(p).Type())
+			}
+		}
+	})
+}
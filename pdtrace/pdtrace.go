@@ -0,0 +1,187 @@
+// Package pdtrace records the PD messages exchanged by a policy engine and
+// replays them into the mock port controller, turning captures from the field
+// into reproducible sessions.
+//
+// Recordings are text, one message per line, with comma separated fields:
+//
+//	<microseconds since the first message>,<tx|rx>,<SOP>,<message bytes in hex>
+//
+// where SOP is the pdmsg.SOP value, i.e. 0 for SOP, 1 for SOP' and 2 for SOP
+// double prime, and the message bytes are as serialized by
+// pdmsg.Message.ToBytes. For example, source capabilities offering 5V and 9V
+// at 3A, followed by a request for 9V:
+//
+//	0,rx,0,a1212c9101002cd10200
+//	1204,tx,0,82102cb10420
+package pdtrace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver/mock"
+)
+
+// Record is a single message of a recording.
+type Record struct {
+	Time    time.Duration // since the first message of the recording
+	Tx      bool          // true if sent by the policy engine
+	Message pdmsg.Message
+}
+
+// Recorder writes the messages passed to Observe to a writer.
+// All its methods may be called concurrently from multiple goroutines.
+type Recorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	err   error
+
+	// Buffers defined once here to avoid heap allocations.
+	msg  [pdmsg.MaxMessageBytes]byte
+	line []byte
+}
+
+// NewRecorder creates a new recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Observe records m, with tx set to true for sent messages. Its signature
+// matches the message observer of the policy engine so it can be passed to
+// tcpe.WithMessageObserver or tcpe.PolicyEngine.SetMessageObserver. Nothing is
+// written after the first write error, which is returned by Err.
+func (r *Recorder) Observe(m pdmsg.Message, tx bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if r.start.IsZero() {
+		r.start = now
+	}
+	dir := "rx"
+	if tx {
+		dir = "tx"
+	}
+	n := m.ToBytes(r.msg[:])
+	l := r.line[:0]
+	l = strconv.AppendInt(l, now.Sub(r.start).Microseconds(), 10)
+	l = append(l, ',')
+	l = append(l, dir...)
+	l = append(l, ',')
+	l = strconv.AppendUint(l, uint64(m.SOP), 10)
+	l = append(l, ',')
+	var h [2 * pdmsg.MaxMessageBytes]byte
+	l = append(l, h[:hex.Encode(h[:], r.msg[:n])]...)
+	l = append(l, '\n')
+	r.line = l
+	_, r.err = r.w.Write(l)
+}
+
+// Err returns the first error encountered writing the recording, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+var errBadRecord = errors.New("pdtrace: malformed record")
+
+// Read reads all records of a recording from rd. Empty lines are ignored.
+func Read(rd io.Reader) ([]Record, error) {
+	var recs []Record
+	s := bufio.NewScanner(rd)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		rec, err := parseRecord(line)
+		if err != nil {
+			return recs, fmt.Errorf("%w on line %d", err, n)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, s.Err()
+}
+
+// parseRecord parses a single line of a recording.
+func parseRecord(line string) (Record, error) {
+	var rec Record
+	f := strings.Split(line, ",")
+	if len(f) != 4 {
+		return rec, errBadRecord
+	}
+	us, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil || us < 0 {
+		return rec, errBadRecord
+	}
+	rec.Time = time.Duration(us) * time.Microsecond
+	switch f[1] {
+	case "tx":
+		rec.Tx = true
+	case "rx":
+	default:
+		return rec, errBadRecord
+	}
+	sop, err := strconv.ParseUint(f[2], 10, 8)
+	if err != nil || sop > uint64(pdmsg.SOPDoublePrime) {
+		return rec, errBadRecord
+	}
+	rec.Message.SOP = pdmsg.SOP(sop)
+	b, err := hex.DecodeString(f[3])
+	if err != nil || len(b) < 2 || len(b) > pdmsg.MaxMessageBytes {
+		return rec, errBadRecord
+	}
+	rec.Message.Header = uint16(b[1])<<8 | uint16(b[0])
+	if len(b) != 2+int(rec.Message.DataObjectCount())*4 {
+		return rec, errBadRecord
+	}
+	for i := range rec.Message.Data[:rec.Message.DataObjectCount()] {
+		o := 2 + i*4
+		rec.Message.Data[i] = uint32(b[o]) | uint32(b[o+1])<<8 | uint32(b[o+2])<<16 | uint32(b[o+3])<<24
+	}
+	return rec, nil
+}
+
+// Replay scripts pc to play the port partner of a recording. typec.EventAttached
+// and the received messages recorded before the first sent message are queued
+// right away. The received messages recorded after each sent message are
+// queued when the policy engine sends its next message, regardless of its
+// content, so the sent messages can be compared with the recording afterwards
+// using pc.Sent. Timing is not reproduced. Replay replaces the Tx handler of
+// pc.
+func Replay(pc *mock.PortController, recs []Record) {
+	var mu sync.Mutex
+	i := 0
+
+	// queueRx queues the received messages up to the next sent message.
+	queueRx := func() {
+		for ; i < len(recs) && !recs[i].Tx; i++ {
+			pc.QueueRx(recs[i].Message)
+		}
+	}
+
+	pc.QueueEvent(typec.EventAttached)
+	queueRx()
+	pc.SetTxHandler(func(pdmsg.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if i < len(recs) {
+			i++ // skip the sent message
+			queueRx()
+		}
+		return nil
+	})
+}
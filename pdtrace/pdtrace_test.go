@@ -0,0 +1,121 @@
+package pdtrace
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver/mock"
+	"github.com/oxplot/go-typec/tcpe"
+)
+
+// example is the recording of the package documentation: source capabilities
+// offering 5V and 9V at 3A, followed by a request for 9V.
+const example = `0,rx,0,a1212c9101002cd10200
+1204,tx,0,82102cb10420
+`
+
+func TestReadExample(t *testing.T) {
+	recs, err := Read(strings.NewReader(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	caps, req := recs[0], recs[1]
+	if caps.Time != 0 || caps.Tx || caps.Message.Type() != pdmsg.TypeSourceCap || caps.Message.DataObjectCount() != 2 {
+		t.Errorf("got first record %+v, want source capabilities received at 0", caps)
+	}
+	for i, v := range []uint16{5000, 9000} {
+		p := pdmsg.FixedSupplyPDO(caps.Message.Data[i])
+		if p.Voltage() != v || p.MaxCurrent() != 3000 {
+			t.Errorf("got PDO %d at %dmV %dmA, want %dmV 3000mA", i+1, p.Voltage(), p.MaxCurrent(), v)
+		}
+	}
+	if req.Time != 1204*time.Microsecond || !req.Tx || req.Message.Type() != pdmsg.TypeRequest {
+		t.Errorf("got second record %+v, want request sent at 1204us", req)
+	}
+	if p := pdmsg.RequestDO(req.Message.Data[0]).SelectedObjectPosition(); p != 2 {
+		t.Errorf("got request for position %d, want 2", p)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	for _, line := range []string{
+		"0,rx,0",
+		"-1,rx,0,a1212c9101002cd10200",
+		"0,up,0,a1212c9101002cd10200",
+		"0,rx,3,a1212c9101002cd10200",
+		"0,rx,0,a1212c91",
+		"0,rx,0,zz",
+	} {
+		if _, err := Read(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: got no error, want one", line)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	want, err := Read(strings.NewReader(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay the example into a policy engine which requests 3A from the last
+	// PDO, as in the recording, and record the session again.
+
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	pc := mock.New()
+	Replay(pc, want)
+	pe := tcpe.New(pc,
+		tcpe.WithCapabilityEvaluator(tcpe.CapabilityEvaluatorFunc(func(pdos []pdmsg.PDO) pdmsg.RequestDO {
+			rdo := pdmsg.EmptyRequestDO
+			rdo.SetSelectedObjectPosition(uint8(len(pdos)))
+			rdo.SetFixedOperatingCurrent(3000)
+			rdo.SetFixedMaxOperatingCurrent(3000)
+			return rdo
+		})),
+		tcpe.WithMessageObserver(rec.Observe),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pe.Run(ctx)
+	}()
+	for deadline := time.Now().Add(2 * time.Second); len(pc.Sent()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			cancel()
+			wg.Wait()
+			t.Fatal("timed out waiting for request")
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	if sent := pc.Sent()[0]; sent != want[1].Message {
+		t.Errorf("got sent message %+v, want %+v", sent, want[1].Message)
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < len(want) {
+		t.Fatalf("got %d records, want at least %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Tx != w.Tx || got[i].Message != w.Message {
+			t.Errorf("got record %d %+v, want %+v", i, got[i], w)
+		}
+	}
+}
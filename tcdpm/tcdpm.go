@@ -2,6 +2,7 @@
 package tcdpm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +21,8 @@ func GetVoltageCurrent(pdo pdmsg.PDO, rdo pdmsg.RequestDO) (uint16, uint16) {
 		return pdmsg.FixedSupplyPDO(pdo).Voltage(), rdo.FixedMaxOperatingCurrent()
 	case pdmsg.PDOTypePPS:
 		return rdo.PPSOutputVoltage(), rdo.PPSOutputCurrent()
+	case pdmsg.PDOTypeEPRAVS:
+		return rdo.AVSOutputVoltage(), rdo.AVSOutputCurrent()
 	default:
 		return 0, 0
 	}
@@ -37,6 +40,7 @@ type PolicyManager struct {
 	policy Policy
 	pe     *tcpe.PolicyEngine
 	pr     PowerReadyFunc
+	fault  func(tcpe.Event)
 
 	last struct {
 		pdo        pdmsg.PDO
@@ -45,9 +49,29 @@ type PolicyManager struct {
 	}
 
 	negotiated struct {
-		pdo pdmsg.PDO
-		rdo pdmsg.RequestDO
+		pdo           pdmsg.PDO
+		rdo           pdmsg.RequestDO
+		unconstrained bool
 	}
+
+	detail PowerDetail // guarded by mu
+	ready  bool        // guarded by mu
+}
+
+// PowerDetail describes the negotiated power.
+type PowerDetail struct {
+	PDO     pdmsg.PDO
+	RDO     pdmsg.RequestDO
+	Voltage uint16 // mV, as returned by GetVoltageCurrent
+	Current uint16 // mA, as returned by GetVoltageCurrent
+
+	// UnconstrainedPower is true if the source reports having an external power
+	// source sufficient to power the sink at full load, e.g. a wall adapter as
+	// opposed to a power bank.
+	UnconstrainedPower bool
+
+	// PPS is true if the negotiated profile is a programmable power supply.
+	PPS bool
 }
 
 // NewPolicyManager creates a new PolicyManager which will use the given
@@ -66,7 +90,11 @@ func NewPolicyManager(pe *tcpe.PolicyEngine, pr PowerReadyFunc) *PolicyManager {
 }
 
 // SetPolicy sets the power management policy. If policy validation fails,
-// non-nil error is returned.
+// non-nil error is returned. If forceRenegotiate is true, the source
+// capabilities in effect are immediately re-evaluated with the new policy and
+// the resulting request is negotiated with the source without a reset, if it
+// differs from the one in effect. Otherwise, the new policy takes effect the
+// next time the source sends its capabilities.
 // SetPolicy can be called concurrently from multiple goroutines.
 func (pm *PolicyManager) SetPolicy(p Policy, forceRenegotiate bool) error {
 	if err := p.Validate(); err != nil {
@@ -76,32 +104,89 @@ func (pm *PolicyManager) SetPolicy(p Policy, forceRenegotiate bool) error {
 	defer pm.mu.Unlock()
 	pm.policy = p
 	if forceRenegotiate {
-		pm.pe.Reset()
+		pm.pe.Renegotiate()
 	}
 	return nil
 }
 
+// SetFaultFunc sets the function called with the fault events of the policy
+// engine (i.e. EventFault, EventOverCurrent, EventOverVoltage and
+// EventOverTemperature), so the application can react to them e.g. by
+// disconnecting the load. f is called from the policy engine goroutine and
+// must return quickly.
+// SetFaultFunc can be called concurrently from multiple goroutines.
+func (pm *PolicyManager) SetFaultFunc(f func(tcpe.Event)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.fault = f
+}
+
+// PowerDetail returns the detail of the negotiated power. ok is false if power
+// is not ready.
+// PowerDetail can be called concurrently from multiple goroutines.
+func (pm *PolicyManager) PowerDetail() (d PowerDetail, ok bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.detail, pm.ready
+}
+
 // HandleEvent handles an event from the policy engine.
 func (pm *PolicyManager) HandleEvent(e tcpe.Event) {
 	switch e {
 	case tcpe.EventPowerReady:
+		// The contract in effect may have been requested with RequestProfile
+		// rather than evaluated by the policy. There is none with non-PD
+		// sources, for which the evaluation stands.
+
+		if pdo, rdo, ok := pm.pe.Contract(); ok {
+			pm.negotiated.pdo, pm.negotiated.rdo = pdo, rdo
+		}
 		if !pm.last.powerReady || pm.last.pdo != pm.negotiated.pdo || pm.last.rdo != pm.negotiated.rdo {
 			pm.pr(true, pm.negotiated.pdo, pm.negotiated.rdo)
 		}
 		pm.last.powerReady = true
 		pm.last.pdo = pm.negotiated.pdo
 		pm.last.rdo = pm.negotiated.rdo
+		d := PowerDetail{
+			PDO:                pm.negotiated.pdo,
+			RDO:                pm.negotiated.rdo,
+			UnconstrainedPower: pm.negotiated.unconstrained,
+			PPS:                pm.negotiated.pdo.Type() == pdmsg.PDOTypePPS,
+		}
+		d.Voltage, d.Current = GetVoltageCurrent(d.PDO, d.RDO)
+		pm.mu.Lock()
+		pm.detail, pm.ready = d, true
+		pm.mu.Unlock()
 	case tcpe.EventPowerNotReady:
 		if pm.last.powerReady {
 			pm.pr(false, 0, 0)
 		}
 		pm.last.powerReady = false
+		pm.mu.Lock()
+		pm.detail, pm.ready = PowerDetail{}, false
+		pm.mu.Unlock()
 	case tcpe.EventRejected:
+		// The source keeps the contract in effect, if any, when rejecting a new
+		// request, so only a rejected first request calls for a reset.
+
+		if _, _, ok := pm.pe.Contract(); ok {
+			break
+		}
 		if pm.last.powerReady {
 			pm.pr(false, pm.last.pdo, pm.last.rdo)
 		}
 		pm.last.powerReady = false
+		pm.mu.Lock()
+		pm.detail, pm.ready = PowerDetail{}, false
+		pm.mu.Unlock()
 		pm.pe.Reset()
+	case tcpe.EventFault, tcpe.EventOverCurrent, tcpe.EventOverVoltage, tcpe.EventOverTemperature:
+		pm.mu.Lock()
+		f := pm.fault
+		pm.mu.Unlock()
+		if f != nil {
+			f(e)
+		}
 	}
 }
 
@@ -118,6 +203,8 @@ func (pm *PolicyManager) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO
 	}
 
 	pm.negotiated.pdo = 0
+	pm.negotiated.unconstrained = len(pdos) > 0 && pdos[0].Type() == pdmsg.PDOTypeFixedSupply &&
+		pdmsg.FixedSupplyPDO(pdos[0]).IsUnconstrainedPower()
 	pos := pm.negotiated.rdo.SelectedObjectPosition()
 	if pos > 0 && pos <= uint8(len(pdos)) {
 		pm.negotiated.pdo = pdos[pos-1]
@@ -125,6 +212,90 @@ func (pm *PolicyManager) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO
 	return pm.negotiated.rdo
 }
 
+// Errors returned by RunUntilPower.
+var (
+	ErrNoMatchingProfile = errors.New("tcdpm: no source profile satisfies the policy")
+	ErrNegotiationFailed = errors.New("tcdpm: negotiation with the source failed")
+)
+
+// RunUntilPower negotiates power with policy p and blocks until power is
+// ready, returning its detail. It suits tools and tests for which handling
+// events asynchronously is overkill.
+//
+// RunUntilPower takes over pe: it sets its capability evaluator and event
+// handler, and calls Run which must not already be running. Once power is
+// ready, Run keeps going in the background to maintain the contract until ctx
+// is done. Otherwise, Run is stopped before returning with an error, which is
+// ErrNoMatchingProfile if the source capabilities do not satisfy p,
+// ErrNegotiationFailed if the source does not respond or keeps rejecting
+// requests (see tcpe.EventNegotiationFailed and tcpe.EventNegotiationTimeout),
+// or the error of ctx.
+func RunUntilPower(ctx context.Context, pe *tcpe.PolicyEngine, p Policy) (PowerDetail, error) {
+	if err := p.Validate(); err != nil {
+		return PowerDetail{}, err
+	}
+	result := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	pm := NewPolicyManager(pe, func(bool, pdmsg.PDO, pdmsg.RequestDO) {})
+	_ = pm.SetPolicy(untilPowerPolicy{p, done}, false)
+	pe.SetEventHandler(tcpe.EventHandlerFunc(func(e tcpe.Event) {
+		pm.HandleEvent(e)
+		switch e {
+		case tcpe.EventPowerReady:
+			done(nil)
+		case tcpe.EventNegotiationFailed, tcpe.EventNegotiationTimeout:
+			done(ErrNegotiationFailed)
+		}
+	}))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		pe.Run(runCtx)
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		if d, ok := pm.PowerDetail(); ok {
+			go func() {
+				<-stopped
+				cancel()
+			}()
+			return d, nil
+		}
+		err = ErrNegotiationFailed
+	}
+	cancel()
+	<-stopped
+	return PowerDetail{}, err
+}
+
+// untilPowerPolicy wraps the policy of RunUntilPower to report when no source
+// profile satisfies it.
+type untilPowerPolicy struct {
+	Policy
+	done func(error)
+}
+
+func (u untilPowerPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	rdo := u.Policy.EvaluateCapabilities(pdos)
+	if rdo.SelectedObjectPosition() == 0 {
+		u.done(ErrNoMatchingProfile)
+	}
+	return rdo
+}
+
 // Policy is the interface which simply embeds CapabilityEvaluator.
 type Policy interface {
 	// Validate returns an error if the policy parameters are invalid.
@@ -143,7 +314,8 @@ type Policy interface {
 //   - Charging Li-ion batteries
 //
 // Constant current capability is only available in PD power sources that
-// support Programmable Power Supply (PPS) standard.
+// support Programmable Power Supply (PPS) standard, or with AllowEPR set,
+// Adjustable Voltage Supply (AVS) in Extended Power Range (EPR) mode.
 //
 // WARNING: Most PD power sources are not compliant with PPS standard and do not
 // implement constant current capability. There is no way to identify such
@@ -173,14 +345,37 @@ type CCPolicy struct {
 	// policy, it's possible to prefer lower voltage profiles than the default
 	// higher voltage profiles.
 	PreferLowerVoltage bool
+
+	// By default, if no profile can supply MinCurrent, no profile is requested.
+	// If this is set to true, the profile within the voltage range with the
+	// highest current is requested instead, with the capability mismatch flag
+	// set to let the source know that more current is needed. In such case, the
+	// sink must cope with less current than MinCurrent.
+	SignalMismatch bool
+
+	// If set, voltages up to 48000mV are accepted and EPR AVS profiles are
+	// considered when MaxVoltage is above 20000mV. This requires EPR mode to be
+	// enabled on the policy engine (see tcpe.PolicyEngine.SetEPRSinkPDP).
+	AllowEPR bool
 }
 
+// maxPositions is the maximum number of profiles in source capabilities which
+// is 7 SPR profiles followed by 4 EPR profiles in EPR mode.
+const maxPositions = 11
+
 var (
 	errCCBadCurrent          = errors.New("tcdpm: current must be >= 1000mA & <= 5000mA")
 	errBadVoltage            = errors.New("tcdpm: voltage must be >= 3300mV & <= 21000 mV")
+	errBadEPRVoltage         = errors.New("tcdpm: voltage must be >= 3300mV & <= 48000 mV")
 	errCVBadCurrent          = errors.New("tcdpm: current must be >= 0mA & <= 5000mA")
+	errCVBadCurrentMargin    = errors.New("tcdpm: current + current margin must be <= 6350mA")
 	errMaxCurrentLessThanMin = errors.New("tcdpm: max current must be >= min current")
 	errMaxVoltageLessThanMin = errors.New("tcdpm: max voltage must be >= min voltage")
+	errCPBadPower            = errors.New("tcdpm: power must be > 0mW & <= max voltage × 5A")
+	errBadPower              = errors.New("tcdpm: power must be > 0mW")
+	errBadPosition           = errors.New("tcdpm: position must be >= 1 & <= 11")
+	errEmptyChain            = errors.New("tcdpm: chain must have at least one policy")
+	errNilPolicy             = errors.New("tcdpm: policy must not be nil")
 )
 
 // Validate returns an error if the policy parameters are invalid.
@@ -188,8 +383,8 @@ func (c CCPolicy) Validate() error {
 	if c.MinCurrent < 1000 || c.MaxCurrent < 1000 || c.MinCurrent > 5000 || c.MaxCurrent > 5000 {
 		return errCCBadCurrent
 	}
-	if c.MinVoltage < 3300 || c.MaxVoltage < 3300 || c.MinVoltage > 21000 || c.MaxVoltage > 21000 {
-		return errBadVoltage
+	if err := validateVoltage(c.MinVoltage, c.MaxVoltage, c.AllowEPR); err != nil {
+		return err
 	}
 	if c.MinCurrent > c.MaxCurrent {
 		return errMaxCurrentLessThanMin
@@ -204,40 +399,44 @@ func (c CCPolicy) Validate() error {
 // and returns a RequestDO that can be used to negotiate with the power
 // source.
 func (c CCPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
-	var bestVoltage uint16
+	var bestVoltage, bestCurrent uint16
 	if c.PreferLowerVoltage {
 		bestVoltage = ^uint16(0)
 	}
 	rdo := pdmsg.EmptyRequestDO
+	mismatchRDO := pdmsg.EmptyRequestDO
+	var mismatchCurrent uint16
 	for i, p := range pdos {
-		if p.Type() != pdmsg.PDOTypePPS {
+		minV, maxV, ok := programmableRange(p, c.MinVoltage, c.MaxVoltage, c.AllowEPR)
+		if !ok || minV > maxV {
 			continue
 		}
-		pps := pdmsg.PPSPDO(p)
-		minV, maxV := c.MinVoltage, c.MaxVoltage
-		if minV < pps.MinVoltage() {
-			minV = pps.MinVoltage()
+		v := maxV
+		if c.PreferLowerVoltage {
+			v = minV
 		}
-		if maxV > pps.MaxVoltage() {
-			maxV = pps.MaxVoltage()
+		pCur := programmableCurrent(p, v)
+		if pCur < c.MinCurrent && pCur > mismatchCurrent {
+			mismatchRDO = pdmsg.EmptyRequestDO
+			mismatchRDO.SetSelectedObjectPosition(uint8(i) + 1)
+			setProgrammable(&mismatchRDO, p, v, pCur)
+			mismatchRDO.SetCapabilityMismatch(true)
+			mismatchCurrent = pCur
 		}
-		if minV <= maxV && pps.MaxCurrent() >= c.MinCurrent {
-			cur := pps.MaxCurrent()
-			if pps.MaxCurrent() > c.MaxCurrent {
-				cur = c.MaxCurrent
-			}
-			if c.PreferLowerVoltage && minV < bestVoltage {
-				rdo.SetSelectedObjectPosition(uint8(i) + 1)
-				rdo.SetPPSOutputVoltage(minV)
-				rdo.SetPPSOutputCurrent(cur)
-				bestVoltage = minV
-			} else if !c.PreferLowerVoltage && maxV > bestVoltage {
-				rdo.SetSelectedObjectPosition(uint8(i) + 1)
-				rdo.SetPPSOutputVoltage(maxV)
-				rdo.SetPPSOutputCurrent(cur)
-				bestVoltage = maxV
-			}
+		cur := pCur
+		if cur > c.MaxCurrent {
+			cur = c.MaxCurrent / ppsCurrentStep * ppsCurrentStep
 		}
+		if cur >= c.MinCurrent && preferred(c.PreferLowerVoltage, v, pCur, bestVoltage, bestCurrent) {
+			rdo = pdmsg.EmptyRequestDO
+			rdo.SetSelectedObjectPosition(uint8(i) + 1)
+			setProgrammable(&rdo, p, v, cur)
+			bestVoltage = v
+			bestCurrent = pCur
+		}
+	}
+	if rdo == pdmsg.EmptyRequestDO && c.SignalMismatch {
+		return mismatchRDO
 	}
 	return rdo
 }
@@ -246,10 +445,11 @@ func (c CCPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 // to maintain the negotiated voltage and to be capable of supplying at least
 // the negotiated current.
 //
-// CVPolicy takes advantage of both fixed and programmable PD profiles. In case
-// of programmable, 150mA margin is added to the Current defined by the policy
-// to ensure the power supply does not limit current close to the operating
-// current.
+// CVPolicy takes advantage of fixed, variable and programmable PD profiles. In
+// case of programmable, CurrentMargin is added to the Current defined by the
+// policy to ensure the power supply does not limit current close to the
+// operating current. Variable supply profiles are only considered if their
+// entire voltage range is within the voltage range of the policy.
 type CVPolicy struct {
 
 	// Minimum accepted voltage in millivolts.
@@ -262,26 +462,65 @@ type CVPolicy struct {
 	// negotiated voltage.
 	Current uint16
 
+	// Margin in milliamps added to Current for programmable profiles, both
+	// when checking the maximum current of the profile and as the requested
+	// current limit, which is rounded up to the 50mA resolution of requests.
+	// If zero, 150mA is used.
+	CurrentMargin uint16
+
 	// If a source provides multiple profile within the voltage range of a
 	// policy, it's possible to prefer lower voltage profiles than the default
 	// higher voltage profiles.
 	PreferLowerVoltage bool
 
 	// By default, CVPolicy prefers fixed PD profiles unless none can satisfy the
-	// requirements in which case PPS profiles are considered. If this is set to
-	// true, CVPolicy will prefer PPS profiles over fixed ones.
+	// requirements in which case variable supply profiles followed by PPS
+	// profiles are considered. If this is set to true, CVPolicy will prefer PPS
+	// profiles over the others.
 	PreferPPS bool
+
+	// If this is set to true, CVPolicy will prefer variable supply profiles
+	// over fixed ones. PreferPPS takes precedence over this if both are set.
+	PreferVariable bool
+
+	// If set, voltages up to 48000mV are accepted and EPR AVS profiles are
+	// considered, same as PPS profiles, when MaxVoltage is above 20000mV. This
+	// requires EPR mode to be enabled on the policy engine (see
+	// tcpe.PolicyEngine.SetEPRSinkPDP).
+	AllowEPR bool
+
+	// Minimum overload capability the source must have, e.g. to cover the
+	// inrush current of pulsed loads. If set to other than
+	// pdmsg.PeakCurrentNone, only fixed supply profiles with at least the given
+	// peak current are considered since other profiles have no overload
+	// capability.
+	MinPeakCurrent pdmsg.PeakCurrent
 }
 
 const cvCurrentMargin = 150 // mA
 
+// maxProgrammableCurrent is the maximum current that can be requested from
+// programmable profiles, limited by the size of the current field of requests.
+const maxProgrammableCurrent = 127 * ppsCurrentStep // mA
+
+// currentMargin returns the current margin of the policy in milliamps.
+func (c CVPolicy) currentMargin() uint16 {
+	if c.CurrentMargin == 0 {
+		return cvCurrentMargin
+	}
+	return c.CurrentMargin
+}
+
 // Validate returns an error if the policy parameters are invalid.
 func (c CVPolicy) Validate() error {
 	if c.Current > 5000 {
 		return errCVBadCurrent
 	}
-	if c.MinVoltage < 3300 || c.MaxVoltage < 3300 || c.MinVoltage > 21000 || c.MaxVoltage > 21000 {
-		return errBadVoltage
+	if uint32(c.Current)+uint32(c.currentMargin()) > maxProgrammableCurrent {
+		return errCVBadCurrentMargin
+	}
+	if err := validateVoltage(c.MinVoltage, c.MaxVoltage, c.AllowEPR); err != nil {
+		return err
 	}
 	if c.MinVoltage > c.MaxVoltage {
 		return errMaxVoltageLessThanMin
@@ -293,62 +532,185 @@ func (c CVPolicy) Validate() error {
 // and returns a RequestDO that can be used to negotiate with the power
 // source.
 func (c *CVPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
-	ppsMaxCurrent := c.Current + cvCurrentMargin
+	ppsMaxCurrent := roundUp(c.Current+c.currentMargin(), ppsCurrentStep)
 
-	var bestFixedVoltage, bestPPSVoltage uint16
+	var bestFixedVoltage, bestVarVoltage, bestPPSVoltage uint16
+	var bestFixedCurrent, bestVarCurrent, bestPPSCurrent uint16
 	if c.PreferLowerVoltage {
 		bestFixedVoltage = ^uint16(0)
+		bestVarVoltage = ^uint16(0)
 		bestPPSVoltage = ^uint16(0)
 	}
 	bestFixedRDO := pdmsg.EmptyRequestDO
+	bestVarRDO := pdmsg.EmptyRequestDO
 	bestPPSRDO := pdmsg.EmptyRequestDO
 	for i, p := range pdos {
 		switch p.Type() {
 		case pdmsg.PDOTypeFixedSupply:
 			fs := pdmsg.FixedSupplyPDO(p)
 			v := fs.Voltage()
-			if v >= c.MinVoltage && v <= c.MaxVoltage && fs.MaxCurrent() >= c.Current {
-				if (c.PreferLowerVoltage && v < bestFixedVoltage) || (!c.PreferLowerVoltage && v > bestFixedVoltage) {
+			if v >= c.MinVoltage && v <= c.MaxVoltage && fs.MaxCurrent() >= c.Current && fs.PeakCurrent() >= c.MinPeakCurrent {
+				if preferred(c.PreferLowerVoltage, v, fs.MaxCurrent(), bestFixedVoltage, bestFixedCurrent) {
 					bestFixedRDO.SetSelectedObjectPosition(uint8(i) + 1)
 					bestFixedRDO.SetFixedMaxOperatingCurrent(c.Current)
 					bestFixedRDO.SetFixedOperatingCurrent(c.Current)
 					bestFixedVoltage = v
+					bestFixedCurrent = fs.MaxCurrent()
 				}
 			}
-		case pdmsg.PDOTypePPS:
-			pps := pdmsg.PPSPDO(p)
-			minV, maxV := c.MinVoltage, c.MaxVoltage
-			if minV < pps.MinVoltage() {
-				minV = pps.MinVoltage()
+		case pdmsg.PDOTypeVariableSupply:
+			if c.MinPeakCurrent != pdmsg.PeakCurrentNone {
+				continue
 			}
-			if maxV > pps.MaxVoltage() {
-				maxV = pps.MaxVoltage()
+			vs := pdmsg.VariableSupplyPDO(p)
+			minV, maxV := vs.MinVoltage(), vs.MaxVoltage()
+			v := maxV
+			if c.PreferLowerVoltage {
+				v = minV
 			}
-			if minV <= maxV && ppsMaxCurrent <= pps.MaxCurrent() {
-				if c.PreferLowerVoltage && minV < bestPPSVoltage {
-					bestPPSRDO.SetSelectedObjectPosition(uint8(i) + 1)
-					bestPPSRDO.SetPPSOutputVoltage(minV)
-					bestPPSRDO.SetPPSOutputCurrent(c.Current)
-					bestPPSVoltage = minV
-				} else if !c.PreferLowerVoltage && maxV > bestPPSVoltage {
+			if minV >= c.MinVoltage && maxV <= c.MaxVoltage && vs.MaxCurrent() >= c.Current {
+				if preferred(c.PreferLowerVoltage, v, vs.MaxCurrent(), bestVarVoltage, bestVarCurrent) {
+					bestVarRDO.SetSelectedObjectPosition(uint8(i) + 1)
+					bestVarRDO.SetFixedMaxOperatingCurrent(c.Current)
+					bestVarRDO.SetFixedOperatingCurrent(c.Current)
+					bestVarVoltage = v
+					bestVarCurrent = vs.MaxCurrent()
+				}
+			}
+		case pdmsg.PDOTypePPS, pdmsg.PDOTypeEPRAVS:
+			if c.MinPeakCurrent != pdmsg.PeakCurrentNone {
+				continue
+			}
+			minV, maxV, ok := programmableRange(p, c.MinVoltage, c.MaxVoltage, c.AllowEPR)
+			v := maxV
+			if c.PreferLowerVoltage {
+				v = minV
+			}
+			if ok && minV <= maxV {
+				pCur := programmableCurrent(p, v)
+				if ppsMaxCurrent <= pCur && preferred(c.PreferLowerVoltage, v, pCur, bestPPSVoltage, bestPPSCurrent) {
+					bestPPSRDO = pdmsg.EmptyRequestDO
 					bestPPSRDO.SetSelectedObjectPosition(uint8(i) + 1)
-					bestPPSRDO.SetPPSOutputVoltage(maxV)
-					bestPPSRDO.SetPPSOutputCurrent(c.Current)
-					bestPPSVoltage = maxV
+					setProgrammable(&bestPPSRDO, p, v, ppsMaxCurrent)
+					bestPPSVoltage = v
+					bestPPSCurrent = pCur
 				}
 			}
 		}
 	}
-	if bestFixedRDO == pdmsg.EmptyRequestDO {
-		return bestPPSRDO
+	order := [3]pdmsg.RequestDO{bestFixedRDO, bestVarRDO, bestPPSRDO}
+	if c.PreferPPS {
+		order = [3]pdmsg.RequestDO{bestPPSRDO, bestFixedRDO, bestVarRDO}
+		if c.PreferVariable {
+			order[1], order[2] = order[2], order[1]
+		}
+	} else if c.PreferVariable {
+		order = [3]pdmsg.RequestDO{bestVarRDO, bestFixedRDO, bestPPSRDO}
 	}
-	if bestPPSRDO == pdmsg.EmptyRequestDO {
-		return bestFixedRDO
+	for _, rdo := range order {
+		if rdo != pdmsg.EmptyRequestDO {
+			return rdo
+		}
 	}
-	if c.PreferPPS {
-		return bestPPSRDO
+	return pdmsg.EmptyRequestDO
+}
+
+// Resolution of the output voltage and current of PPS and AVS requests.
+const (
+	ppsVoltageStep = 20  // mV
+	avsVoltageStep = 100 // mV
+	ppsCurrentStep = 50  // mA, same for AVS
+)
+
+// sprMaxVoltage is the maximum voltage of Standard Power Range profiles, above
+// which EPR AVS profiles are considered by the policies that allow EPR.
+const sprMaxVoltage = 20000 // mV
+
+// validateVoltage returns an error if the voltage range is outside the range
+// accepted by the policies.
+func validateVoltage(minV, maxV uint16, epr bool) error {
+	if epr {
+		if minV < 3300 || maxV < 3300 || minV > 48000 || maxV > 48000 {
+			return errBadEPRVoltage
+		}
+		return nil
 	}
-	return bestFixedRDO
+	if minV < 3300 || maxV < 3300 || minV > 21000 || maxV > 21000 {
+		return errBadVoltage
+	}
+	return nil
+}
+
+// programmableRange returns the voltage range of a PPS, or if epr is true and
+// maxV is above sprMaxVoltage, an EPR AVS profile p, limited to minV and maxV
+// and narrowed to the resolution of requests. ok is false for other profiles.
+func programmableRange(p pdmsg.PDO, minV, maxV uint16, epr bool) (uint16, uint16, bool) {
+	var pMin, pMax, step uint16
+	switch p.Type() {
+	case pdmsg.PDOTypePPS:
+		pMin, pMax, step = pdmsg.PPSPDO(p).MinVoltage(), pdmsg.PPSPDO(p).MaxVoltage(), ppsVoltageStep
+	case pdmsg.PDOTypeEPRAVS:
+		if !epr || maxV <= sprMaxVoltage {
+			return 0, 0, false
+		}
+		pMin, pMax, step = pdmsg.EPRAVSPDO(p).MinVoltage(), pdmsg.EPRAVSPDO(p).MaxVoltage(), avsVoltageStep
+	default:
+		return 0, 0, false
+	}
+	if minV < pMin {
+		minV = pMin
+	}
+	if maxV > pMax {
+		maxV = pMax
+	}
+	return roundUp(minV, step), maxV / step * step, true
+}
+
+// programmableCurrent returns the maximum current in milliamps of a PPS or EPR
+// AVS profile p at voltage v in millivolts.
+func programmableCurrent(p pdmsg.PDO, v uint16) uint16 {
+	if p.Type() == pdmsg.PDOTypePPS {
+		return pdmsg.PPSPDO(p).MaxCurrent()
+	}
+	c := pdmsg.EPRAVSPDO(p).MaxPower() * 1000 / uint32(v)
+	if c > 5000 {
+		c = 5000
+	}
+	return uint16(c) / ppsCurrentStep * ppsCurrentStep
+}
+
+// setProgrammable sets the output voltage and current of rdo requesting a PPS
+// or EPR AVS profile p.
+func setProgrammable(rdo *pdmsg.RequestDO, p pdmsg.PDO, v, cur uint16) {
+	if p.Type() == pdmsg.PDOTypePPS {
+		rdo.SetPPSOutputVoltage(v)
+		rdo.SetPPSOutputCurrent(cur)
+	} else {
+		rdo.SetAVSOutputVoltage(v)
+		rdo.SetAVSOutputCurrent(cur)
+	}
+}
+
+// ppsVoltageRange narrows the voltage range to the resolution of PPS requests
+// so that any voltage in the returned range can be requested exactly.
+func ppsVoltageRange(minV, maxV uint16) (uint16, uint16) {
+	return roundUp(minV, ppsVoltageStep), maxV / ppsVoltageStep * ppsVoltageStep
+}
+
+// roundUp rounds v up to the nearest multiple of step.
+func roundUp(v, step uint16) uint16 {
+	return (v + step - 1) / step * step
+}
+
+// preferred returns true if a profile offering voltage v and maximum current cur
+// is preferred over the best profile found so far, offering bestV and bestCur.
+// Lower or higher voltages are preferred based on lower. On equal voltages,
+// the profile with higher current is preferred.
+func preferred(lower bool, v, cur, bestV, bestCur uint16) bool {
+	if v == bestV {
+		return cur > bestCur
+	}
+	return (v < bestV) == lower
 }
 
 // CPPolicy defines a constant power policy where the power source is expected
@@ -378,11 +740,26 @@ type CPPolicy struct {
 	PreferPPS bool
 }
 
+// Validate returns an error if the policy parameters are invalid.
+func (c CPPolicy) Validate() error {
+	if c.MinVoltage < 3300 || c.MaxVoltage < 3300 || c.MinVoltage > 21000 || c.MaxVoltage > 21000 {
+		return errBadVoltage
+	}
+	if c.MinVoltage > c.MaxVoltage {
+		return errMaxVoltageLessThanMin
+	}
+	if c.Power == 0 || uint32(c.Power)*1000 > uint32(c.MaxVoltage)*5000 {
+		return errCPBadPower
+	}
+	return nil
+}
+
 // EvaluateCapabilities evaluates the provided power profiles against the policy
 // and returns a RequestDO that can be used to negotiate with the power
 // source.
 func (c *CPPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 	var bestFixedVoltage, bestPPSVoltage uint16
+	var bestFixedCurrent, bestPPSCurrent uint16
 	if c.PreferLowerVoltage {
 		bestFixedVoltage = ^uint16(0)
 		bestPPSVoltage = ^uint16(0)
@@ -394,13 +771,17 @@ func (c *CPPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 		case pdmsg.PDOTypeFixedSupply:
 			fs := pdmsg.FixedSupplyPDO(p)
 			v := fs.Voltage()
-			maxCur := c.Power / v
+			if v == 0 {
+				continue // malformed
+			}
+			maxCur := powerCurrent(c.Power, v)
 			if v >= c.MinVoltage && v <= c.MaxVoltage && fs.MaxCurrent() >= maxCur {
-				if (c.PreferLowerVoltage && v < bestFixedVoltage) || (!c.PreferLowerVoltage && v > bestFixedVoltage) {
+				if preferred(c.PreferLowerVoltage, v, fs.MaxCurrent(), bestFixedVoltage, bestFixedCurrent) {
 					bestFixedRDO.SetSelectedObjectPosition(uint8(i) + 1)
 					bestFixedRDO.SetFixedMaxOperatingCurrent(maxCur)
 					bestFixedRDO.SetFixedOperatingCurrent(maxCur)
 					bestFixedVoltage = v
+					bestFixedCurrent = fs.MaxCurrent()
 				}
 			}
 		case pdmsg.PDOTypePPS:
@@ -412,22 +793,30 @@ func (c *CPPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 			if maxV > pps.MaxVoltage() {
 				maxV = pps.MaxVoltage()
 			}
-			if minV <= maxV {
-				maxC := c.Power/maxV + cvCurrentMargin
-				minPV := c.Power / (pps.MaxCurrent() - cvCurrentMargin)
-				if minPV < minV {
-					minPV = minV
+			minV, maxV = ppsVoltageRange(minV, maxV)
+			if minV <= maxV && maxV > 0 && pps.MaxCurrent() > cvCurrentMargin {
+				maxC := roundUp(powerCurrent(c.Power, maxV)+cvCurrentMargin, ppsCurrentStep)
+				// Lowest voltage at which the power can be supplied within the
+				// current limit of the profile.
+				avail := uint32(pps.MaxCurrent() - cvCurrentMargin)
+				minPV := minV
+				if v := (uint32(c.Power)*1000 + avail - 1) / avail; v > uint32(maxV) {
+					minPV = ^uint16(0)
+				} else if v > uint32(minPV) {
+					minPV = roundUp(uint16(v), ppsVoltageStep)
 				}
-				if c.PreferLowerVoltage && minPV < bestPPSVoltage && minPV <= maxV {
+				if c.PreferLowerVoltage && minPV <= maxV && preferred(true, minPV, pps.MaxCurrent(), bestPPSVoltage, bestPPSCurrent) {
 					bestPPSRDO.SetSelectedObjectPosition(uint8(i) + 1)
 					bestPPSRDO.SetPPSOutputVoltage(minPV)
-					bestPPSRDO.SetPPSOutputCurrent(c.Power / minPV)
+					bestPPSRDO.SetPPSOutputCurrent(roundUp(powerCurrent(c.Power, minPV), ppsCurrentStep))
 					bestPPSVoltage = minPV
-				} else if !c.PreferLowerVoltage && maxV > bestPPSVoltage && maxC <= pps.MaxCurrent() {
+					bestPPSCurrent = pps.MaxCurrent()
+				} else if !c.PreferLowerVoltage && maxC <= pps.MaxCurrent() && preferred(false, maxV, pps.MaxCurrent(), bestPPSVoltage, bestPPSCurrent) {
 					bestPPSRDO.SetSelectedObjectPosition(uint8(i) + 1)
 					bestPPSRDO.SetPPSOutputVoltage(maxV)
 					bestPPSRDO.SetPPSOutputCurrent(maxC)
 					bestPPSVoltage = maxV
+					bestPPSCurrent = pps.MaxCurrent()
 				}
 			}
 		}
@@ -444,6 +833,356 @@ func (c *CPPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 	return bestFixedRDO
 }
 
+// powerCurrent returns the current in milliamps, rounded up, needed to deliver
+// power p in milliwatts at voltage v in millivolts. v must not be zero.
+func powerCurrent(p, v uint16) uint16 {
+	return uint16((uint32(p)*1000 + uint32(v) - 1) / uint32(v))
+}
+
+// MaxPowerPolicy defines a policy that selects the profile which yields the
+// highest power among all fixed and programmable profiles offered by the power
+// source. It's useful for applications that simply want to draw as much power
+// as possible, e.g. charging as fast as possible.
+//
+// For programmable profiles, the maximum voltage (limited by MaxVoltage) and
+// the maximum current of the profile are requested.
+type MaxPowerPolicy struct {
+
+	// Maximum accepted voltage in millivolts. Profiles above this voltage are
+	// ignored and programmable profiles are limited to this voltage. Zero
+	// means no limit.
+	MaxVoltage uint16
+}
+
+// Validate returns an error if the policy parameters are invalid.
+func (c MaxPowerPolicy) Validate() error {
+	if c.MaxVoltage != 0 && (c.MaxVoltage < 3300 || c.MaxVoltage > 21000) {
+		return errBadVoltage
+	}
+	return nil
+}
+
+// EvaluateCapabilities evaluates the provided power profiles against the policy
+// and returns a RequestDO that can be used to negotiate with the power
+// source.
+func (c MaxPowerPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	maxV := c.MaxVoltage
+	if maxV == 0 {
+		maxV = ^uint16(0)
+	}
+	var bestPower uint32
+	rdo := pdmsg.EmptyRequestDO
+	for i, p := range pdos {
+		switch p.Type() {
+		case pdmsg.PDOTypeFixedSupply:
+			fs := pdmsg.FixedSupplyPDO(p)
+			v, cur := fs.Voltage(), fs.MaxCurrent()
+			if v <= maxV && uint32(v)*uint32(cur) > bestPower {
+				rdo = pdmsg.EmptyRequestDO
+				rdo.SetSelectedObjectPosition(uint8(i) + 1)
+				rdo.SetFixedMaxOperatingCurrent(cur)
+				rdo.SetFixedOperatingCurrent(cur)
+				bestPower = uint32(v) * uint32(cur)
+			}
+		case pdmsg.PDOTypePPS:
+			pps := pdmsg.PPSPDO(p)
+			v, cur := pps.MaxVoltage(), pps.MaxCurrent()
+			if v > maxV {
+				v = maxV / ppsVoltageStep * ppsVoltageStep
+			}
+			if v >= pps.MinVoltage() && uint32(v)*uint32(cur) > bestPower {
+				rdo = pdmsg.EmptyRequestDO
+				rdo.SetSelectedObjectPosition(uint8(i) + 1)
+				rdo.SetPPSOutputVoltage(v)
+				rdo.SetPPSOutputCurrent(cur)
+				bestPower = uint32(v) * uint32(cur)
+			}
+		}
+	}
+	return rdo
+}
+
+// BatteryPolicy defines a policy that requests power from a battery supply
+// profile. Battery supplies output an unregulated voltage that may vary
+// anywhere within the range advertised by the source. As such, only the
+// profiles whose entire voltage range is within the voltage range of the
+// policy are considered.
+type BatteryPolicy struct {
+
+	// Minimum accepted voltage in millivolts.
+	MinVoltage uint16
+
+	// Maximum accepted voltage in millivolts.
+	MaxVoltage uint16
+
+	// Power in milliwatts that the source must be able to supply.
+	Power uint16
+}
+
+// Validate returns an error if the policy parameters are invalid.
+func (c BatteryPolicy) Validate() error {
+	if c.MinVoltage < 3300 || c.MaxVoltage < 3300 || c.MinVoltage > 21000 || c.MaxVoltage > 21000 {
+		return errBadVoltage
+	}
+	if c.MinVoltage > c.MaxVoltage {
+		return errMaxVoltageLessThanMin
+	}
+	if c.Power == 0 {
+		return errBadPower
+	}
+	return nil
+}
+
+// EvaluateCapabilities evaluates the provided power profiles against the policy
+// and returns a RequestDO that can be used to negotiate with the power
+// source. Among the matching profiles, the one with the highest maximum power
+// is selected.
+func (c BatteryPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	var bestPower uint32
+	rdo := pdmsg.EmptyRequestDO
+	for i, p := range pdos {
+		if p.Type() != pdmsg.PDOTypeBattery {
+			continue
+		}
+		b := pdmsg.BatteryPDO(p)
+		if b.MinVoltage() >= c.MinVoltage && b.MaxVoltage() <= c.MaxVoltage &&
+			b.MaxPower() >= uint32(c.Power) && b.MaxPower() > bestPower {
+			rdo.SetSelectedObjectPosition(uint8(i) + 1)
+			rdo.SetBatteryOperatingPower(uint32(c.Power))
+			rdo.SetBatteryMaxOperatingPower(uint32(c.Power))
+			bestPower = b.MaxPower()
+		}
+	}
+	return rdo
+}
+
+// IndexPolicy defines a policy that requests the profile at a specific
+// position regardless of its contents. It's mostly used for bring-up and
+// testing the behavior of power sources. Fixed, variable and programmable
+// profiles are supported, as well as EPR AVS profiles in EPR mode. Positions 8
+// to 11 select EPR profiles, which are only offered in EPR mode (see
+// tcpe.PolicyEngine.SetEPRSinkPDP).
+//
+// The requested values are sent as is and are not checked against the
+// capabilities of the profile.
+type IndexPolicy struct {
+
+	// Position of the requested profile in the list of source capabilities,
+	// starting at 1.
+	Position uint8
+
+	// Voltage in millivolts to request from programmable and adjustable
+	// profiles. It is ignored for other profile types.
+	Voltage uint16
+
+	// Current in milliamps to request.
+	Current uint16
+}
+
+// Validate returns an error if the policy parameters are invalid.
+func (c IndexPolicy) Validate() error {
+	if c.Position < 1 || c.Position > maxPositions {
+		return errBadPosition
+	}
+	return nil
+}
+
+// EvaluateCapabilities returns a RequestDO for the profile at the policy
+// position or pdmsg.EmptyRequestDO if no such profile exists or its type is not
+// supported.
+func (c IndexPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	rdo := pdmsg.EmptyRequestDO
+	if c.Position < 1 || int(c.Position) > len(pdos) {
+		return rdo
+	}
+	switch pdos[c.Position-1].Type() {
+	case pdmsg.PDOTypeFixedSupply, pdmsg.PDOTypeVariableSupply:
+		rdo.SetSelectedObjectPosition(c.Position)
+		rdo.SetFixedMaxOperatingCurrent(c.Current)
+		rdo.SetFixedOperatingCurrent(c.Current)
+	case pdmsg.PDOTypePPS:
+		rdo.SetSelectedObjectPosition(c.Position)
+		rdo.SetPPSOutputVoltage(c.Voltage)
+		rdo.SetPPSOutputCurrent(c.Current)
+	case pdmsg.PDOTypeEPRAVS:
+		rdo.SetSelectedObjectPosition(c.Position)
+		rdo.SetAVSOutputVoltage(c.Voltage)
+		rdo.SetAVSOutputCurrent(c.Current)
+	}
+	return rdo
+}
+
+// StepPolicy defines a constant voltage policy for programmable (PPS) profiles
+// that ramps the output voltage gradually towards the target voltage instead
+// of jumping to it. Each evaluation moves the requested voltage one step closer
+// to the target, starting from 5V. This is useful for sinks that are sensitive
+// to large voltage steps, e.g. due to inrush current. Voltages are requested in
+// multiples of 20mV, the resolution of PPS requests.
+//
+// To progress the ramp, call tcpe.PolicyEngine.Renegotiate periodically until
+// Done returns true. If Engine is set, each step starts from the voltage of the
+// contract in effect, so the ramp only progresses once the source has applied
+// the previous step. Otherwise, the policy steps from the voltage it last
+// requested, and Reset must be called whenever power is lost or a request
+// fails so that the ramp starts over from 5V.
+//
+// StepPolicy must not be copied after first use.
+type StepPolicy struct {
+
+	// Target voltage in millivolts, rounded down to a multiple of 20mV.
+	Voltage uint16
+
+	// Current in milliamps that the source must be able to supply, rounded up
+	// to a multiple of 50mA.
+	Current uint16
+
+	// Voltage step in millivolts, rounded up to a multiple of 20mV. Zero means
+	// 100mV.
+	Step uint16
+
+	// Policy engine whose contract in effect the ramp steps from. If nil, the
+	// ramp steps from the last requested voltage.
+	Engine *tcpe.PolicyEngine
+
+	mu   sync.Mutex
+	last uint16 // last requested voltage, 0 if none
+}
+
+const defaultVoltageStep = 100 // mV
+
+// Validate returns an error if the policy parameters are invalid.
+func (c *StepPolicy) Validate() error {
+	if c.Current > 5000 {
+		return errCVBadCurrent
+	}
+	if c.Voltage < 3300 || c.Voltage > 21000 {
+		return errBadVoltage
+	}
+	return nil
+}
+
+// Reset restarts the ramp from 5V on the next evaluation if Engine is not
+// set.
+func (c *StepPolicy) Reset() {
+	c.mu.Lock()
+	c.last = 0
+	c.mu.Unlock()
+}
+
+// Done returns true if the target voltage has been reached, i.e. it's the
+// voltage of the contract in effect if Engine is set, or the last requested
+// voltage otherwise.
+func (c *StepPolicy) Done() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current() == c.target()
+}
+
+// target returns the target voltage rounded to the PPS resolution.
+func (c *StepPolicy) target() uint16 {
+	return c.Voltage / ppsVoltageStep * ppsVoltageStep
+}
+
+// current returns the voltage the next step starts from, 0 if unknown.
+func (c *StepPolicy) current() uint16 {
+	if c.Engine == nil {
+		return c.last
+	}
+	pdo, rdo, ok := c.Engine.Contract()
+	if !ok {
+		return 0
+	}
+	v, _ := GetVoltageCurrent(pdo, rdo)
+	return v
+}
+
+// EvaluateCapabilities evaluates the provided power profiles against the policy
+// and returns a RequestDO that can be used to negotiate with the power
+// source.
+func (c *StepPolicy) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	step := roundUp(c.Step, ppsVoltageStep)
+	if step == 0 {
+		step = defaultVoltageStep
+	}
+	target := c.target()
+	cur := roundUp(c.Current, ppsCurrentStep)
+	for i, p := range pdos {
+		if p.Type() != pdmsg.PDOTypePPS {
+			continue
+		}
+		pps := pdmsg.PPSPDO(p)
+		if target < pps.MinVoltage() || target > pps.MaxVoltage() || pps.MaxCurrent() < cur {
+			continue
+		}
+		v := c.current() / ppsVoltageStep * ppsVoltageStep
+		if v == 0 {
+			v = 5000
+		}
+		if v < pps.MinVoltage() {
+			v = pps.MinVoltage()
+		} else if v > pps.MaxVoltage() {
+			v = pps.MaxVoltage()
+		}
+		if v < target {
+			if target-v > step {
+				v += step
+			} else {
+				v = target
+			}
+		} else if v > target {
+			if v-target > step {
+				v -= step
+			} else {
+				v = target
+			}
+		}
+		c.last = v
+		rdo := pdmsg.EmptyRequestDO
+		rdo.SetSelectedObjectPosition(uint8(i) + 1)
+		rdo.SetPPSOutputVoltage(v)
+		rdo.SetPPSOutputCurrent(cur)
+		return rdo
+	}
+	return pdmsg.EmptyRequestDO
+}
+
+// Chain is a policy that evaluates its member policies in order and responds
+// with the first request that selects a power profile. It allows for graceful
+// degradation, e.g. preferring a constant current PPS profile and falling back
+// to a fixed voltage profile if the power source does not support PPS.
+type Chain []Policy
+
+// Validate returns an error if the chain is empty or any of its member policies
+// is invalid.
+func (c Chain) Validate() error {
+	if len(c) == 0 {
+		return errEmptyChain
+	}
+	for _, p := range c {
+		if p == nil {
+			return errNilPolicy
+		}
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EvaluateCapabilities passes the provided power profiles to each member policy
+// in order and returns the first RequestDO that selects a profile. If no member
+// policy selects a profile, pdmsg.EmptyRequestDO is returned.
+func (c Chain) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	for _, p := range c {
+		if rdo := p.EvaluateCapabilities(pdos); rdo.SelectedObjectPosition() > 0 {
+			return rdo
+		}
+	}
+	return pdmsg.EmptyRequestDO
+}
+
 // Logger is a passthrough policy that writes a textual description of source
 // capabilities to a given io.Writer. It's mostly used for debugging purposes.
 type Logger struct {
@@ -485,7 +1224,9 @@ func (l *Logger) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 			fs := pdmsg.FixedSupplyPDO(p)
 			fmt.Fprintf(l.w, "Fixed %.1fV @ max. %.1fA", float32(fs.Voltage())/1000, float32(fs.MaxCurrent())/1000)
 		case pdmsg.PDOTypeVariableSupply:
-			fmt.Fprint(l.w, "Variable (not supported)")
+			vs := pdmsg.VariableSupplyPDO(p)
+			minV, maxV, maxC := float32(vs.MinVoltage())/1000, float32(vs.MaxVoltage())/1000, float32(vs.MaxCurrent())/1000
+			fmt.Fprintf(l.w, "Variable %.1f-%.1fV @ max. %.1fA", minV, maxV, maxC)
 		case pdmsg.PDOTypePPS:
 			pps := pdmsg.PPSPDO(p)
 			var powerLimited string
@@ -495,9 +1236,13 @@ func (l *Logger) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 			minV, maxV, maxC := float32(pps.MinVoltage())/1000, float32(pps.MaxVoltage())/1000, float32(pps.MaxCurrent())/1000
 			fmt.Fprintf(l.w, "Programmable %.1f-%.1fV @ max. %.1fA%s", minV, maxV, maxC, powerLimited)
 		case pdmsg.PDOTypeBattery:
-			fmt.Fprint(l.w, "Battery (not supported)")
+			b := pdmsg.BatteryPDO(p)
+			minV, maxV, maxP := float32(b.MinVoltage())/1000, float32(b.MaxVoltage())/1000, float32(b.MaxPower())/1000
+			fmt.Fprintf(l.w, "Battery %.1f-%.1fV @ max. %.1fW", minV, maxV, maxP)
 		case pdmsg.PDOTypeEPRAVS:
-			fmt.Fprint(l.w, "EPRAVS (not supported)")
+			avs := pdmsg.EPRAVSPDO(p)
+			minV, maxV, maxP := float32(avs.MinVoltage())/1000, float32(avs.MaxVoltage())/1000, float32(avs.MaxPower())/1000
+			fmt.Fprintf(l.w, "EPR Adjustable %.1f-%.1fV @ max. %.0fW", minV, maxV, maxP)
 		default:
 			fmt.Fprint(l.w, "INVALID!")
 		}
@@ -508,3 +1253,236 @@ func (l *Logger) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
 	}
 	return pdmsg.EmptyRequestDO
 }
+
+// Profile is the decoded form of a power data object.
+type Profile struct {
+	Type         pdmsg.PDOType
+	MinVoltage   uint16 // mV, same as MaxVoltage for fixed supplies
+	MaxVoltage   uint16 // mV
+	MaxCurrent   uint16 // mA, 0 for battery and EPR AVS supplies
+	MaxPower     uint32 // mW, 0 for fixed, variable and PPS supplies
+	PowerLimited bool   // PPS only
+}
+
+// DecodeProfile decodes the power data object p. Unknown types are decoded
+// with only the Type field set.
+func DecodeProfile(p pdmsg.PDO) Profile {
+	r := Profile{Type: p.Type()}
+	switch r.Type {
+	case pdmsg.PDOTypeFixedSupply:
+		fs := pdmsg.FixedSupplyPDO(p)
+		r.MinVoltage, r.MaxVoltage, r.MaxCurrent = fs.Voltage(), fs.Voltage(), fs.MaxCurrent()
+	case pdmsg.PDOTypeVariableSupply:
+		vs := pdmsg.VariableSupplyPDO(p)
+		r.MinVoltage, r.MaxVoltage, r.MaxCurrent = vs.MinVoltage(), vs.MaxVoltage(), vs.MaxCurrent()
+	case pdmsg.PDOTypePPS:
+		pps := pdmsg.PPSPDO(p)
+		r.MinVoltage, r.MaxVoltage, r.MaxCurrent = pps.MinVoltage(), pps.MaxVoltage(), pps.MaxCurrent()
+		r.PowerLimited = pps.IsPowerLimited()
+	case pdmsg.PDOTypeBattery:
+		b := pdmsg.BatteryPDO(p)
+		r.MinVoltage, r.MaxVoltage, r.MaxPower = b.MinVoltage(), b.MaxVoltage(), b.MaxPower()
+	case pdmsg.PDOTypeEPRAVS:
+		avs := pdmsg.EPRAVSPDO(p)
+		r.MinVoltage, r.MaxVoltage, r.MaxPower = avs.MinVoltage(), avs.MaxVoltage(), avs.MaxPower()
+	}
+	return r
+}
+
+// CallbackLogger is a passthrough policy that calls a function with the decoded
+// source capabilities. It's useful for displaying the capabilities without
+// assuming a textual output, e.g. on a small display.
+type CallbackLogger struct {
+	f    func(Capabilities)
+	pe   *tcpe.PolicyEngine
+	base Policy
+	buf  [maxPositions]Profile
+}
+
+// Capabilities is the decoded source capabilities passed to the callback of
+// CallbackLogger.
+type Capabilities struct {
+	Revision pdmsg.Revision // negotiated with the source
+	Profiles []Profile
+}
+
+// NewCallbackLogger creates a new callback logger which will call f with the
+// decoded capabilities and optionally passes through the evaluate calls. pe is
+// the policy engine evaluating capabilities with the logger, which reports the
+// negotiated revision. If pe is nil, the revision is reported as
+// pdmsg.Revision10. If no base is provided, this policy will respond with
+// pdmsg.EmptyRequestDO when EvaluateCapabilities is called by the policy
+// engine. The profiles slice passed to f must not be stored past the call.
+func NewCallbackLogger(f func(Capabilities), pe *tcpe.PolicyEngine, base Policy) *CallbackLogger {
+	return &CallbackLogger{
+		f:    f,
+		pe:   pe,
+		base: base,
+	}
+}
+
+// Validate returns nil if the policy is valid.
+func (l *CallbackLogger) Validate() error {
+	if l.base != nil {
+		return l.base.Validate()
+	}
+	return nil
+}
+
+// EvaluateCapabilities calls the callback with the decoded capabilities and
+// passes them down to the underlying DPM and returns its response.
+func (l *CallbackLogger) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	n := len(pdos)
+	if n > len(l.buf) {
+		n = len(l.buf)
+	}
+	for i, p := range pdos[:n] {
+		l.buf[i] = DecodeProfile(p)
+	}
+	l.f(Capabilities{Revision: negotiatedRevision(l.pe), Profiles: l.buf[:n]})
+	if l.base != nil {
+		return l.base.EvaluateCapabilities(pdos)
+	}
+	return pdmsg.EmptyRequestDO
+}
+
+// negotiatedRevision returns the revision negotiated by pe, or Revision10 if pe
+// is nil.
+func negotiatedRevision(pe *tcpe.PolicyEngine) pdmsg.Revision {
+	if pe == nil {
+		return pdmsg.Revision10
+	}
+	return pe.NegotiatedRevision()
+}
+
+// JSONLogger is a passthrough policy that writes a JSON description of source
+// capabilities and the resulting request to a given io.Writer. Each set of
+// capabilities is written as a single JSON object followed by a new line, which
+// makes the output suitable for consumption by log pipelines. Below is an
+// example of the output (wrapped for readability):
+//
+//	{"revision":"3.0","profiles":[{"type":"fixed","min_voltage":5000,"max_voltage":5000,"max_current":3000},
+//	{"type":"pps","min_voltage":3300,"max_voltage":11000,"max_current":3000,"power_limited":false}],
+//	"position":2,"request":537152572}
+//
+// Revision is the PD specification revision negotiated with the source.
+// Voltages are in millivolts, currents in milliamps and powers in milliwatts.
+// Position and request are those of the RequestDO returned by the base policy.
+type JSONLogger struct {
+	w    io.Writer
+	pe   *tcpe.PolicyEngine
+	base Policy
+}
+
+// NewJSONLogger creates a new JSON logger which will write to the given writer
+// and optionally passes through the evaluate calls. pe is the policy engine
+// evaluating capabilities with the logger, which reports the negotiated
+// revision. If pe is nil, the revision is reported as 1.0. If no base is
+// provided, this policy will respond with
+// pdmsg.EmptyRequestDO when EvaluateCapabilities is called by the policy
+// engine.
+func NewJSONLogger(w io.Writer, pe *tcpe.PolicyEngine, base Policy) *JSONLogger {
+	return &JSONLogger{
+		w:    w,
+		pe:   pe,
+		base: base,
+	}
+}
+
+// Validate returns nil if the policy is valid.
+func (l *JSONLogger) Validate() error {
+	if l.base != nil {
+		return l.base.Validate()
+	}
+	return nil
+}
+
+// EvaluateCapabilities writes out the JSON description of the provided power
+// data objects and the response of the underlying DPM, and returns the
+// response.
+func (l *JSONLogger) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	// Revisions are encoded as the major version minus one
+	fmt.Fprintf(l.w, `{"revision":"%d.0","profiles":[`, negotiatedRevision(l.pe)+1)
+	for i, p := range pdos {
+		if i > 0 {
+			fmt.Fprint(l.w, ",")
+		}
+		switch p.Type() {
+		case pdmsg.PDOTypeFixedSupply:
+			fs := pdmsg.FixedSupplyPDO(p)
+			fmt.Fprintf(l.w, `{"type":"fixed","min_voltage":%d,"max_voltage":%d,"max_current":%d}`, fs.Voltage(), fs.Voltage(), fs.MaxCurrent())
+		case pdmsg.PDOTypePPS:
+			pps := pdmsg.PPSPDO(p)
+			fmt.Fprintf(l.w, `{"type":"pps","min_voltage":%d,"max_voltage":%d,"max_current":%d,"power_limited":%t}`, pps.MinVoltage(), pps.MaxVoltage(), pps.MaxCurrent(), pps.IsPowerLimited())
+		case pdmsg.PDOTypeBattery:
+			b := pdmsg.BatteryPDO(p)
+			fmt.Fprintf(l.w, `{"type":"battery","min_voltage":%d,"max_voltage":%d,"max_power":%d}`, b.MinVoltage(), b.MaxVoltage(), b.MaxPower())
+		case pdmsg.PDOTypeVariableSupply:
+			vs := pdmsg.VariableSupplyPDO(p)
+			fmt.Fprintf(l.w, `{"type":"variable","min_voltage":%d,"max_voltage":%d,"max_current":%d}`, vs.MinVoltage(), vs.MaxVoltage(), vs.MaxCurrent())
+		case pdmsg.PDOTypeEPRAVS:
+			avs := pdmsg.EPRAVSPDO(p)
+			fmt.Fprintf(l.w, `{"type":"epr_avs","min_voltage":%d,"max_voltage":%d,"max_power":%d}`, avs.MinVoltage(), avs.MaxVoltage(), avs.MaxPower())
+		default:
+			fmt.Fprintf(l.w, `{"type":"invalid","raw":%d}`, uint32(p))
+		}
+	}
+	rdo := pdmsg.EmptyRequestDO
+	if l.base != nil {
+		rdo = l.base.EvaluateCapabilities(pdos)
+	}
+	fmt.Fprintf(l.w, `],"position":%d,"request":%d}`+"\n", rdo.SelectedObjectPosition(), uint32(rdo))
+	return rdo
+}
+
+// Recording is a passthrough policy that records the last request returned by
+// the base policy along with the profile it selects. It allows applications to
+// display the negotiated profile and detect its changes without subscribing to
+// the policy engine events.
+type Recording struct {
+	base Policy
+
+	mu   sync.Mutex
+	pdo  pdmsg.PDO
+	rdo  pdmsg.RequestDO
+	some bool // true if a profile has been selected
+}
+
+// NewRecording creates a new recording policy which passes through the
+// evaluate calls to base.
+func NewRecording(base Policy) *Recording {
+	return &Recording{base: base}
+}
+
+// Validate returns an error if the base policy is nil or invalid.
+func (r *Recording) Validate() error {
+	if r.base == nil {
+		return errNilPolicy
+	}
+	return r.base.Validate()
+}
+
+// EvaluateCapabilities passes the provided power profiles to the base policy,
+// records its response and the selected profile, and returns the response.
+func (r *Recording) EvaluateCapabilities(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	rdo := r.base.EvaluateCapabilities(pdos)
+	var pdo pdmsg.PDO
+	pos := rdo.SelectedObjectPosition()
+	if pos > 0 && pos <= uint8(len(pdos)) {
+		pdo = pdos[pos-1]
+	}
+	r.mu.Lock()
+	r.pdo, r.rdo, r.some = pdo, rdo, pdo != 0
+	r.mu.Unlock()
+	return rdo
+}
+
+// Last returns the profile selected and the request returned by the base
+// policy in the last evaluation. ok is false if no profile was selected.
+// Note that the request may yet be rejected by the power source.
+// Last may be called concurrently from multiple goroutines.
+func (r *Recording) Last() (pdo pdmsg.PDO, rdo pdmsg.RequestDO, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pdo, r.rdo, r.some
+}
@@ -0,0 +1,535 @@
+package tcdpm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver/loopback"
+	"github.com/oxplot/go-typec/tcpcdriver/mock"
+	"github.com/oxplot/go-typec/tcpe"
+)
+
+// fixedPDO returns a fixed supply PDO offering voltage v in mV and current c
+// in mA.
+func fixedPDO(v, c uint16) pdmsg.PDO {
+	p := pdmsg.NewFixedSupplyPDO()
+	p.SetVoltage(v)
+	p.SetMaxCurrent(c)
+	return pdmsg.PDO(p)
+}
+
+// ppsPDO returns a PPS PDO offering voltages from minV to maxV in mV and
+// current c in mA.
+func ppsPDO(minV, maxV, c uint16) pdmsg.PDO {
+	p := pdmsg.NewPPSPDO()
+	p.SetMinVoltage(minV)
+	p.SetMaxVoltage(maxV)
+	p.SetMaxCurrent(c)
+	return pdmsg.PDO(p)
+}
+
+func TestJSONLogger(t *testing.T) {
+	pdos := []pdmsg.PDO{fixedPDO(5000, 3000), ppsPDO(3300, 11000, 3000)}
+
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf, tcpe.New(nil), MaxPowerPolicy{})
+	rdo := l.EvaluateCapabilities(pdos)
+
+	type profile struct {
+		Type         string `json:"type"`
+		MinVoltage   uint16 `json:"min_voltage"`
+		MaxVoltage   uint16 `json:"max_voltage"`
+		MaxCurrent   uint16 `json:"max_current"`
+		PowerLimited bool   `json:"power_limited"`
+	}
+	var got struct {
+		Revision string    `json:"revision"`
+		Profiles []profile `json:"profiles"`
+		Position uint8     `json:"position"`
+		Request  uint32    `json:"request"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+
+	// No source capabilities have been received by the policy engine
+
+	if got.Revision != "1.0" {
+		t.Errorf("got revision %q, want 1.0", got.Revision)
+	}
+	want := []profile{
+		{"fixed", 5000, 5000, 3000, false},
+		{"pps", 3300, 11000, 3000, false},
+	}
+	if !reflect.DeepEqual(got.Profiles, want) {
+		t.Errorf("got profiles %+v, want %+v", got.Profiles, want)
+	}
+	if got.Position != rdo.SelectedObjectPosition() || got.Request != uint32(rdo) {
+		t.Errorf("got position %d and request %#x, want %d and %#x", got.Position, got.Request, rdo.SelectedObjectPosition(), uint32(rdo))
+	}
+	if rdo.SelectedObjectPosition() != 2 {
+		t.Errorf("got position %d from base policy, want 2", rdo.SelectedObjectPosition())
+	}
+}
+
+func TestCallbackLogger(t *testing.T) {
+	pdos := []pdmsg.PDO{fixedPDO(5000, 3000), ppsPDO(3300, 11000, 3000)}
+	var got Capabilities
+	l := NewCallbackLogger(func(c Capabilities) {
+		got = c
+		got.Profiles = append([]Profile(nil), c.Profiles...)
+	}, tcpe.New(nil), MaxPowerPolicy{})
+	if rdo := l.EvaluateCapabilities(pdos); rdo.SelectedObjectPosition() != 2 {
+		t.Errorf("got position %d from base policy, want 2", rdo.SelectedObjectPosition())
+	}
+	want := Capabilities{
+		Revision: pdmsg.Revision10, // no source capabilities received yet
+		Profiles: []Profile{
+			{Type: pdmsg.PDOTypeFixedSupply, MinVoltage: 5000, MaxVoltage: 5000, MaxCurrent: 3000},
+			{Type: pdmsg.PDOTypePPS, MinVoltage: 3300, MaxVoltage: 11000, MaxCurrent: 3000},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLoggersWithoutPolicyEngine(t *testing.T) {
+	pdos := []pdmsg.PDO{fixedPDO(5000, 3000)}
+	var buf bytes.Buffer
+	NewJSONLogger(&buf, nil, nil).EvaluateCapabilities(pdos)
+	if !bytes.HasPrefix(buf.Bytes(), []byte(`{"revision":"1.0",`)) {
+		t.Errorf("got %q, want revision 1.0", buf.String())
+	}
+	var got pdmsg.Revision = 0xff
+	NewCallbackLogger(func(c Capabilities) { got = c.Revision }, nil, nil).EvaluateCapabilities(pdos)
+	if got != pdmsg.Revision10 {
+		t.Errorf("got revision %d, want %d", got, pdmsg.Revision10)
+	}
+}
+
+func TestStepPolicy(t *testing.T) {
+	pdos := []pdmsg.PDO{fixedPDO(5000, 3000), ppsPDO(3300, 11000, 3000)}
+
+	// Target and step are rounded to the 20mV resolution of PPS requests and
+	// current to the 50mA resolution.
+
+	p := &StepPolicy{Voltage: 5219, Current: 1001, Step: 90}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint16{5100, 5200} {
+		if p.Done() {
+			t.Fatalf("got done before requesting %dmV", want)
+		}
+		rdo := p.EvaluateCapabilities(pdos)
+		if rdo.SelectedObjectPosition() != 2 || rdo.PPSOutputVoltage() != want || rdo.PPSOutputCurrent() != 1050 {
+			t.Fatalf("got position %d at %dmV %dmA, want 2 at %dmV 1050mA",
+				rdo.SelectedObjectPosition(), rdo.PPSOutputVoltage(), rdo.PPSOutputCurrent(), want)
+		}
+	}
+	if !p.Done() {
+		t.Error("got not done at target voltage")
+	}
+	p.Reset()
+	if v := p.EvaluateCapabilities(pdos).PPSOutputVoltage(); v != 5100 {
+		t.Errorf("got %dmV after reset, want 5100mV", v)
+	}
+}
+
+// avsPDO returns an EPR AVS PDO offering voltages from minV to maxV in mV and
+// power p in mW.
+func avsPDO(minV, maxV uint16, p uint32) pdmsg.PDO {
+	o := pdmsg.NewEPRAVSPDO()
+	o.SetMinVoltage(minV)
+	o.SetMaxVoltage(maxV)
+	o.SetMaxPower(p)
+	return pdmsg.PDO(o)
+}
+
+func TestProgrammableRange(t *testing.T) {
+	for _, c := range []struct {
+		pdo        pdmsg.PDO
+		minV, maxV uint16
+		epr        bool
+		wantMin    uint16
+		wantMax    uint16
+		wantOK     bool
+	}{
+		{ppsPDO(3300, 11000, 3000), 3300, 11000, false, 3300, 11000, true},
+		{ppsPDO(3300, 11000, 3000), 3301, 10999, false, 3320, 10980, true},
+		{ppsPDO(3300, 11000, 3000), 3319, 10981, false, 3320, 10980, true},
+		{ppsPDO(3300, 11000, 3000), 3320, 10980, false, 3320, 10980, true},
+		{ppsPDO(3300, 11000, 3000), 3000, 12000, false, 3300, 11000, true},
+		{ppsPDO(3300, 5900, 3000), 5901, 21000, false, 5920, 5900, true}, // empty range
+		{avsPDO(15000, 48000, 140000), 15001, 47999, true, 15100, 47900, true},
+		{avsPDO(15000, 48000, 140000), 15100, 47900, true, 15100, 47900, true},
+		{avsPDO(15000, 48000, 140000), 15000, 20000, true, 0, 0, false}, // SPR voltages only
+		{avsPDO(15000, 48000, 140000), 15000, 48000, false, 0, 0, false},
+		{fixedPDO(5000, 3000), 3300, 21000, true, 0, 0, false},
+	} {
+		minV, maxV, ok := programmableRange(c.pdo, c.minV, c.maxV, c.epr)
+		if minV != c.wantMin || maxV != c.wantMax || ok != c.wantOK {
+			t.Errorf("%#08x %d-%dmV epr %t: got %d-%dmV %t, want %d-%dmV %t",
+				uint32(c.pdo), c.minV, c.maxV, c.epr, minV, maxV, ok, c.wantMin, c.wantMax, c.wantOK)
+		}
+	}
+}
+
+// checkProgrammableRequest checks that rdo requests programmable profile p
+// at a voltage within minV and maxV and the resolution of requests, and at a
+// current of at least minC and no more than the profile offers.
+func checkProgrammableRequest(t *testing.T, name string, rdo pdmsg.RequestDO, p pdmsg.PDO, minV, maxV, minC uint16) {
+	t.Helper()
+	var v, c, pMin, pMax, vStep uint16
+	if p.Type() == pdmsg.PDOTypePPS {
+		v, c, vStep = rdo.PPSOutputVoltage(), rdo.PPSOutputCurrent(), ppsVoltageStep
+		pMin, pMax = pdmsg.PPSPDO(p).MinVoltage(), pdmsg.PPSPDO(p).MaxVoltage()
+	} else {
+		v, c, vStep = rdo.AVSOutputVoltage(), rdo.AVSOutputCurrent(), avsVoltageStep
+		pMin, pMax = pdmsg.EPRAVSPDO(p).MinVoltage(), pdmsg.EPRAVSPDO(p).MaxVoltage()
+	}
+	if v < minV || v > maxV || v < pMin || v > pMax || v%vStep != 0 {
+		t.Errorf("%s: got voltage %dmV outside %d-%dmV, %d-%dmV or %dmV steps", name, v, minV, maxV, pMin, pMax, vStep)
+	}
+	if c < minC || c > programmableCurrent(p, v) || c%ppsCurrentStep != 0 {
+		t.Errorf("%s: got current %dmA outside %d-%dmA or %dmA steps", name, c, minC, programmableCurrent(p, v), ppsCurrentStep)
+	}
+}
+
+func TestCCPolicyProgrammableRounding(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy CCPolicy
+		pdo    pdmsg.PDO
+		want   bool // whether a request is expected
+	}{
+		{"PPS exact", CCPolicy{MinVoltage: 3300, MaxVoltage: 5900, MinCurrent: 1000, MaxCurrent: 3000}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS voltage between steps", CCPolicy{MinVoltage: 3301, MaxVoltage: 5919, MinCurrent: 1000, MaxCurrent: 3000}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS lower voltage between steps", CCPolicy{MinVoltage: 3301, MaxVoltage: 5919, MinCurrent: 1000, MaxCurrent: 3000, PreferLowerVoltage: true}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS max current between steps", CCPolicy{MinVoltage: 3300, MaxVoltage: 5900, MinCurrent: 1000, MaxCurrent: 2999}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS min current rounds below", CCPolicy{MinVoltage: 3300, MaxVoltage: 5900, MinCurrent: 2999, MaxCurrent: 2999}, ppsPDO(3300, 11000, 3000), false},
+		{"PPS no step within range", CCPolicy{MinVoltage: 5901, MaxVoltage: 5919, MinCurrent: 1000, MaxCurrent: 3000}, ppsPDO(3300, 11000, 3000), false},
+		{"AVS voltage between steps", CCPolicy{MinVoltage: 20001, MaxVoltage: 28099, MinCurrent: 1000, MaxCurrent: 5000, AllowEPR: true}, avsPDO(15000, 48000, 140000), true},
+		{"AVS no step within range", CCPolicy{MinVoltage: 28001, MaxVoltage: 28099, MinCurrent: 1000, MaxCurrent: 5000, AllowEPR: true}, avsPDO(15000, 48000, 140000), false},
+	} {
+		if err := c.policy.Validate(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		rdo := c.policy.EvaluateCapabilities([]pdmsg.PDO{c.pdo})
+		if got := rdo != pdmsg.EmptyRequestDO; got != c.want {
+			t.Errorf("%s: got request %t, want %t", c.name, got, c.want)
+			continue
+		}
+		if c.want {
+			checkProgrammableRequest(t, c.name, rdo, c.pdo, c.policy.MinVoltage, c.policy.MaxVoltage, c.policy.MinCurrent)
+		}
+	}
+}
+
+func TestCVPolicyProgrammableRounding(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy CVPolicy
+		pdo    pdmsg.PDO
+		want   bool // whether a request is expected
+	}{
+		{"PPS exact", CVPolicy{MinVoltage: 3300, MaxVoltage: 5900, Current: 2850}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS voltage between steps", CVPolicy{MinVoltage: 3301, MaxVoltage: 5919, Current: 1000}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS current rounds up to max", CVPolicy{MinVoltage: 3300, MaxVoltage: 5900, Current: 2801}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS current rounds up above max", CVPolicy{MinVoltage: 3300, MaxVoltage: 5900, Current: 2851}, ppsPDO(3300, 11000, 3000), false},
+		{"PPS custom margin", CVPolicy{MinVoltage: 3300, MaxVoltage: 5900, Current: 2999, CurrentMargin: 1}, ppsPDO(3300, 11000, 3000), true},
+		{"PPS no step within range", CVPolicy{MinVoltage: 5901, MaxVoltage: 5919, Current: 1000}, ppsPDO(3300, 11000, 3000), false},
+		{"AVS voltage between steps", CVPolicy{MinVoltage: 20001, MaxVoltage: 28099, Current: 3000, AllowEPR: true}, avsPDO(15000, 48000, 140000), true},
+		{"AVS lower voltage between steps", CVPolicy{MinVoltage: 20001, MaxVoltage: 28099, Current: 3000, AllowEPR: true, PreferLowerVoltage: true}, avsPDO(15000, 48000, 140000), true},
+	} {
+		if err := c.policy.Validate(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		rdo := c.policy.EvaluateCapabilities([]pdmsg.PDO{c.pdo})
+		if got := rdo != pdmsg.EmptyRequestDO; got != c.want {
+			t.Errorf("%s: got request %t, want %t", c.name, got, c.want)
+			continue
+		}
+		if c.want {
+			checkProgrammableRequest(t, c.name, rdo, c.pdo, c.policy.MinVoltage, c.policy.MaxVoltage, c.policy.Current)
+		}
+	}
+}
+
+func TestCPPolicySkipsMalformedProfiles(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		policy  CPPolicy
+		pdos    []pdmsg.PDO
+		wantPos uint8
+	}{
+		{
+			name:    "0V fixed",
+			policy:  CPPolicy{MinVoltage: 3300, MaxVoltage: 21000, Power: 10000},
+			pdos:    []pdmsg.PDO{fixedPDO(0, 3000), fixedPDO(5000, 3000)},
+			wantPos: 2,
+		},
+		{
+			name:    "only 0V fixed",
+			policy:  CPPolicy{MinVoltage: 3300, MaxVoltage: 21000, Power: 10000},
+			pdos:    []pdmsg.PDO{fixedPDO(0, 3000)},
+			wantPos: 0,
+		},
+		{
+			name:    "0V PPS",
+			policy:  CPPolicy{MinVoltage: 3300, MaxVoltage: 21000, Power: 10000, PreferPPS: true},
+			pdos:    []pdmsg.PDO{fixedPDO(5000, 3000), ppsPDO(0, 0, 3000)},
+			wantPos: 1,
+		},
+		{
+			name:    "PPS current at margin",
+			policy:  CPPolicy{MinVoltage: 3300, MaxVoltage: 21000, Power: 100, PreferPPS: true},
+			pdos:    []pdmsg.PDO{fixedPDO(5000, 3000), ppsPDO(3300, 11000, cvCurrentMargin)},
+			wantPos: 1,
+		},
+		{
+			name:    "PPS current below margin, lower voltage",
+			policy:  CPPolicy{MinVoltage: 3300, MaxVoltage: 21000, Power: 100, PreferPPS: true, PreferLowerVoltage: true},
+			pdos:    []pdmsg.PDO{fixedPDO(5000, 3000), ppsPDO(3300, 11000, cvCurrentMargin-ppsCurrentStep)},
+			wantPos: 1,
+		},
+		{
+			name:    "PPS current above margin",
+			policy:  CPPolicy{MinVoltage: 3300, MaxVoltage: 21000, Power: 100, PreferPPS: true},
+			pdos:    []pdmsg.PDO{fixedPDO(5000, 3000), ppsPDO(3300, 11000, cvCurrentMargin+ppsCurrentStep)},
+			wantPos: 2,
+		},
+	} {
+		if err := c.policy.Validate(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if pos := c.policy.EvaluateCapabilities(c.pdos).SelectedObjectPosition(); pos != c.wantPos {
+			t.Errorf("%s: got position %d, want %d", c.name, pos, c.wantPos)
+		}
+	}
+}
+
+func TestPolicyManagerRejectKeepsContract(t *testing.T) {
+	p := loopback.New(fixedPDO(5000, 3000), fixedPDO(9000, 3000))
+	pe := tcpe.New(p)
+	var mu sync.Mutex
+	var powerReady []bool
+	pm := NewPolicyManager(pe, func(ready bool, _ pdmsg.PDO, _ pdmsg.RequestDO) {
+		mu.Lock()
+		powerReady = append(powerReady, ready)
+		mu.Unlock()
+	})
+	rejected := make(chan struct{}, 1)
+	pe.SetEventHandler(tcpe.EventHandlerFunc(func(e tcpe.Event) {
+		pm.HandleEvent(e)
+		if e == tcpe.EventRejected {
+			select {
+			case rejected <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	if err := pm.SetPolicy(&CVPolicy{MinVoltage: 9000, MaxVoltage: 9000, Current: 1000}, false); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pe.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	waitPower := func(what string) PowerDetail {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+			if d, ok := pm.PowerDetail(); ok {
+				return d
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitPower("power")
+
+	p.SetResponse(loopback.ResponseReject)
+	if err := pm.SetPolicy(&CVPolicy{MinVoltage: 5000, MaxVoltage: 5000, Current: 1000}, true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rejected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for rejection")
+	}
+	time.Sleep(20 * time.Millisecond) // let any reset take place
+	if d := waitPower("power after rejection"); d.Voltage != 9000 {
+		t.Errorf("got %dmV after rejection, want 9000mV", d.Voltage)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(powerReady) != 1 || !powerReady[0] {
+		t.Errorf("got power ready calls %v, want [true]", powerReady)
+	}
+}
+
+func TestPolicyManagerRequestProfile(t *testing.T) {
+	p := loopback.New(fixedPDO(5000, 3000), fixedPDO(9000, 3000))
+	pe := tcpe.New(p)
+	var mu sync.Mutex
+	var voltages []uint16
+	pm := NewPolicyManager(pe, func(ready bool, pdo pdmsg.PDO, rdo pdmsg.RequestDO) {
+		v, _ := GetVoltageCurrent(pdo, rdo)
+		mu.Lock()
+		voltages = append(voltages, v)
+		mu.Unlock()
+	})
+	if err := pm.SetPolicy(&CVPolicy{MinVoltage: 5000, MaxVoltage: 5000, Current: 1000}, false); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pe.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	waitVoltage := func(v uint16) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+			if d, ok := pm.PowerDetail(); ok && d.Voltage == v {
+				return
+			}
+			if time.Now().After(deadline) {
+				d, _ := pm.PowerDetail()
+				t.Fatalf("got %dmV, want %dmV", d.Voltage, v)
+			}
+		}
+	}
+	waitVoltage(5000)
+
+	// A profile requested directly, bypassing the policy, is reported once
+	// accepted.
+
+	rdo := pdmsg.EmptyRequestDO
+	rdo.SetSelectedObjectPosition(2)
+	rdo.SetFixedOperatingCurrent(1000)
+	rdo.SetFixedMaxOperatingCurrent(1000)
+	if err := pe.RequestProfile(rdo); err != nil {
+		t.Fatal(err)
+	}
+	waitVoltage(9000)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(voltages) != 2 || voltages[0] != 5000 || voltages[1] != 9000 {
+		t.Errorf("got power ready at %v mV, want [5000 9000]", voltages)
+	}
+}
+
+func TestRunUntilPowerNeverAccepted(t *testing.T) {
+	pc := mock.New()
+	var nextID uint8
+	message := func(typ pdmsg.Type) pdmsg.Message {
+		var m pdmsg.Message
+		m.SetPowerRole(pdmsg.PowerRoleSource)
+		m.SetDataRole(pdmsg.DataRoleDFP)
+		m.SetRevision(pdmsg.Revision30)
+		m.SetType(typ)
+		m.SetID(nextID)
+		nextID = (nextID + 1) % 8
+		return m
+	}
+
+	// The source rejects every request and drops VBUS on each hard reset
+
+	pc.SetTxHandler(func(m pdmsg.Message) error {
+		if m.IsData() && m.Type() == pdmsg.TypeRequest {
+			pc.QueueRx(message(pdmsg.TypeReject))
+		}
+		return nil
+	})
+	pe := tcpe.New(pc, tcpe.WithStateObserver(func(from, to string) {
+		switch to {
+		case "sink-hard-reset":
+			pc.QueueEvent(typec.EventDetached)
+		case "sink-discovery":
+			nextID = 0
+			m := message(pdmsg.TypeSourceCap)
+			m.SetDataObjectCount(2)
+			m.Data[0], m.Data[1] = uint32(fixedPDO(5000, 3000)), uint32(fixedPDO(9000, 3000))
+			pc.QueueEvent(typec.EventAttached)
+			pc.QueueRx(m)
+		}
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := RunUntilPower(ctx, pe, &CVPolicy{MinVoltage: 9000, MaxVoltage: 9000, Current: 1000})
+	if err != ErrNegotiationFailed {
+		t.Fatalf("got error %v, want %v", err, ErrNegotiationFailed)
+	}
+	if n := pc.Resets(); n < 3 {
+		t.Errorf("got %d hard resets, want at least 3", n)
+	}
+}
+
+// fuzzPDOs returns up to maxPositions PDOs decoded from b, 4 bytes each.
+func fuzzPDOs(b []byte) []pdmsg.PDO {
+	var pdos []pdmsg.PDO
+	for len(b) >= 4 && len(pdos) < maxPositions {
+		pdos = append(pdos, pdmsg.PDO(uint32(b[0])|uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24))
+		b = b[4:]
+	}
+	return pdos
+}
+
+func FuzzEvaluateCapabilities(f *testing.F) {
+	var seed []byte
+	for _, p := range []pdmsg.PDO{
+		fixedPDO(5000, 3000), fixedPDO(9000, 3000), fixedPDO(0, 3000),
+		ppsPDO(3300, 11000, 3000), ppsPDO(3300, 21000, 100), ppsPDO(0, 0, 5000),
+	} {
+		seed = append(seed, byte(p), byte(p>>8), byte(p>>16), byte(p>>24))
+	}
+	f.Add(seed, uint16(5000), uint16(12000), uint16(1000), uint16(3000), uint8(0))
+	f.Add(seed, uint16(3300), uint16(21000), uint16(0), uint16(5000), uint8(0xff))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, uint16(0), uint16(0), uint16(0), uint16(0), uint8(1))
+	f.Fuzz(func(t *testing.T, b []byte, v1, v2, c1, c2 uint16, flags uint8) {
+		pdos := fuzzPDOs(b)
+		flag := func(i uint) bool { return flags&(1<<i) != 0 }
+		policies := []Policy{
+			CCPolicy{MinVoltage: v1, MaxVoltage: v2, MinCurrent: c1, MaxCurrent: c2,
+				PreferLowerVoltage: flag(0), SignalMismatch: flag(1), AllowEPR: flag(2)},
+			&CVPolicy{MinVoltage: v1, MaxVoltage: v2, Current: c1, CurrentMargin: c2,
+				PreferLowerVoltage: flag(0), PreferPPS: flag(1), PreferVariable: flag(3), AllowEPR: flag(2),
+				MinPeakCurrent: pdmsg.PeakCurrent(flags >> 6)},
+			&CPPolicy{MinVoltage: v1, MaxVoltage: v2, Power: c1, PreferLowerVoltage: flag(0), PreferPPS: flag(1)},
+			MaxPowerPolicy{MaxVoltage: v2},
+			BatteryPolicy{MinVoltage: v1, MaxVoltage: v2, Power: c1},
+			IndexPolicy{Position: uint8(flags), Voltage: v1, Current: c1},
+			&StepPolicy{Voltage: v1, Current: c1, Step: c2},
+		}
+		for _, p := range policies {
+			if p.Validate() != nil {
+				continue
+			}
+			rdo := p.EvaluateCapabilities(pdos)
+			if pos := rdo.SelectedObjectPosition(); rdo != pdmsg.EmptyRequestDO && (pos < 1 || int(pos) > len(pdos)) {
+				t.Fatalf("%T %+v: got position %d for %d PDOs", p, p, pos, len(pdos))
+			}
+		}
+	})
+}
@@ -0,0 +1,247 @@
+// Package ap33772 implements type-C port controller driver for AP33772 sink
+// controller from Diodes Incorporated (formerly Injoinic).
+//
+// AP33772 runs its own protocol layer and only exposes the source PDOs and a
+// request data object register over I2C. This driver synthesizes the messages
+// the policy engine expects from the source based on the controller status:
+//
+//   - Source capabilities message is synthesized from the source PDOs on
+//     attach, whenever the controller reports new PDOs and in response to
+//     Get_Source_Cap.
+//   - Request messages are written to the request register and are
+//     immediately followed by a synthesized Accept message. PS_RDY is
+//     synthesized once the controller reports a successful negotiation. If the
+//     source rejects the request, no response is synthesized and the policy
+//     engine times out.
+//
+// As such, the following limitations apply:
+//
+//   - Control messages other than Get_Source_Cap and data messages other than
+//     requests cannot be sent and fail with typec.ErrTxFailed.
+//   - Since AP33772 is typically powered from VBUS, detach is never reported.
+//   - SendReset requests a hard reset by writing an empty request.
+package ap33772
+
+import (
+	"sync"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver"
+)
+
+// Address is the I2C address of AP33772.
+const Address = 0x51
+
+// AP33772 represents a type-C port controller for AP33772 IC. All its methods
+// may be called concurrently from multiple goroutines.
+type AP33772 struct {
+	regs tcpcdriver.Regs
+
+	mu       sync.Mutex // guards access to the hardware and buffers
+	attached bool
+	nextID   uint8 // message ID of the next synthesized message
+
+	// We use go channel here as a fixed size queue and drop messages when
+	// queue is full.
+	msgs chan pdmsg.Message
+
+	// Buffers defined once here to avoid heap allocations.
+	pdob [pdmsg.MaxDataObjects * 4]byte
+}
+
+const msgQueueSize = 10
+
+// New creates a new controller and allocates all necessary memory for all
+// future operations.
+func New(port tcpcdriver.I2C) *AP33772 {
+	return &AP33772{
+		regs: tcpcdriver.Regs{I2C: port, Addr: Address},
+		msgs: make(chan pdmsg.Message, msgQueueSize),
+	}
+}
+
+// Init initializes the controller.
+func (a *AP33772) Init() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.attached = false
+
+	// Flush the receive queue
+
+FlushReceiveQueue:
+	for {
+		select {
+		case <-a.msgs:
+		default:
+			break FlushReceiveQueue
+		}
+	}
+
+	// Enable the interrupts we handle
+
+	return a.regs.WriteReg(regMask, regStatusReady|regStatusSuccess|regStatusNewPDO|regStatusOVP|regStatusOCP|regStatusOTP)
+}
+
+// Tx transmits a message. Request messages are written to the request register
+// of the controller and Get_Source_Cap is answered from the source PDOs known
+// to the controller. All other messages fail with typec.ErrTxFailed.
+func (a *AP33772) Tx(m pdmsg.Message) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if m.SOP != pdmsg.SOPPort {
+		return typec.ErrTxFailed
+	}
+	if !m.IsData() {
+		if m.Type() != pdmsg.TypeGetSourceCap {
+			return typec.ErrTxFailed
+		}
+		return a.rxSourceCap()
+	}
+	if m.IsExtended() || m.Type() != pdmsg.TypeRequest || pdmsg.RequestDO(m.Data[0]).SelectedObjectPosition() == 0 {
+		return typec.ErrTxFailed
+	}
+	if err := a.regs.WriteRegs(regRDO, le32(a.pdob[:4], m.Data[0])); err != nil {
+		return err
+	}
+	a.queue(a.message(pdmsg.TypeAccept))
+	return nil
+}
+
+func le32(b []byte, v uint32) []byte {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+	return b
+}
+
+// message returns a message of type t from the source with the next message
+// ID.
+func (a *AP33772) message(t pdmsg.Type) pdmsg.Message {
+	var m pdmsg.Message
+	m.SetPowerRole(pdmsg.PowerRoleSource)
+	m.SetDataRole(pdmsg.DataRoleDFP)
+	m.SetRevision(pdmsg.Revision30)
+	m.SetType(t)
+	m.SetID(a.nextID)
+	a.nextID = (a.nextID + 1) % 8
+	return m
+}
+
+// queue queues a synthesized message without blocking (ie drop if queue is
+// full which should be rare).
+func (a *AP33772) queue(m pdmsg.Message) {
+	select {
+	case a.msgs <- m:
+	default:
+	}
+}
+
+// rxSourceCap reads the source PDOs from the controller and queues them as a
+// source capabilities message. Nothing is queued if the controller has no
+// PDOs.
+func (a *AP33772) rxSourceCap() error {
+	n, err := a.regs.ReadReg(regPDONum)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	if n > pdmsg.MaxDataObjects {
+		n = pdmsg.MaxDataObjects
+	}
+	if err := a.regs.ReadRegs(regSrcPDO, a.pdob[:n*4]); err != nil {
+		return err
+	}
+	m := a.message(pdmsg.TypeSourceCap)
+	m.SetDataObjectCount(n)
+	for i := uint8(0); i < n; i++ {
+		o := i * 4
+		m.Data[i] = uint32(a.pdob[o]) | uint32(a.pdob[o+1])<<8 | uint32(a.pdob[o+2])<<16 | uint32(a.pdob[o+3])<<24
+	}
+	a.queue(m)
+	return nil
+}
+
+// Rx returns a received message.
+func (a *AP33772) Rx() (pdmsg.Message, error) {
+	select {
+	case n := <-a.msgs:
+		return n, nil
+	default:
+		return pdmsg.Message{}, typec.ErrRxEmpty
+	}
+}
+
+// SendReset requests the controller to send a hard reset by writing an empty
+// request data object.
+func (a *AP33772) SendReset() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.regs.WriteRegs(regRDO, le32(a.pdob[:4], 0))
+}
+
+// Alert processes all pending interrupts and returns any event generated as a
+// result.
+func (a *AP33772) Alert() (e typec.Event, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Reading the status register clears it
+
+	var st uint8
+	if st, err = a.regs.ReadReg(regStatus); err != nil {
+		return
+	}
+
+	if st&(regStatusOVP|regStatusOCP|regStatusOTP) != 0 {
+		e.Add(typec.EventFault)
+	}
+
+	// Attach is detected by the controller having source PDOs, which also
+	// covers the negotiation completed before the first call to Alert.
+
+	if !a.attached {
+		var n uint8
+		if n, err = a.regs.ReadReg(regPDONum); err != nil || n == 0 {
+			return
+		}
+		a.attached = true
+		e.Add(typec.EventAttached)
+		st |= regStatusNewPDO
+	}
+
+	if st&regStatusNewPDO != 0 {
+		if err = a.rxSourceCap(); err != nil {
+			return
+		}
+	}
+	if st&regStatusSuccess != 0 {
+		a.queue(a.message(pdmsg.TypePSReady))
+	}
+	if len(a.msgs) > 0 {
+		e.Add(typec.EventRx)
+	}
+	return
+}
+
+const (
+	regSrcPDO = 0x00
+	regPDONum = 0x1C
+
+	regStatus        = 0x1D
+	regStatusReady   = 1 << 0
+	regStatusSuccess = 1 << 1
+	regStatusNewPDO  = 1 << 2
+	regStatusOVP     = 1 << 4
+	regStatusOCP     = 1 << 5
+	regStatusOTP     = 1 << 6
+
+	regMask = 0x1E
+
+	regRDO = 0x30
+)
@@ -0,0 +1,274 @@
+// Package ch224 implements type-C port controller driver for CH224Q and CH224A
+// power delivery triggers from WCH.
+//
+// CH224K and CH224D are configured by pins and resistors only and have no I2C
+// interface, and as such are not supported.
+//
+// CH224 runs its own protocol layer and only exposes the source capabilities
+// and a voltage selection over I2C. This driver synthesizes the messages the
+// policy engine expects from the source based on the controller status:
+//
+//   - Source capabilities message is synthesized from the capabilities
+//     received by the controller on attach and in response to Get_Source_Cap.
+//   - Request messages for fixed supply and PPS PDOs select the requested
+//     voltage and are immediately followed by synthesized Accept and PS_RDY
+//     messages, since the controller does not report the outcome of the
+//     negotiation.
+//
+// As such, the following limitations apply:
+//
+//   - Control messages other than Get_Source_Cap and data messages other than
+//     requests cannot be sent and fail with typec.ErrTxFailed.
+//   - Only fixed supply PDOs of 5V, 9V, 12V, 15V, 20V and 28V can be requested.
+//   - Requested current is ignored as the controller always requests the
+//     maximum current of the selected PDO.
+//   - Detach is never reported since CH224 is powered from VBUS.
+//   - SendReset selects 5V instead of sending hard reset signal.
+package ch224
+
+import (
+	"sync"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver"
+)
+
+// I2C addresses CH224 may respond at, depending on its configuration.
+const (
+	AddressLow  = 0x22
+	AddressHigh = 0x23
+)
+
+// CH224 represents a type-C port controller for CH224 IC. All its methods may
+// be called concurrently from multiple goroutines.
+type CH224 struct {
+	regs tcpcdriver.Regs
+
+	mu       sync.Mutex // guards access to the hardware and buffers
+	attached bool
+	nextID   uint8 // message ID of the next synthesized message
+
+	// Last synthesized source capabilities message, used to translate
+	// requests to voltage selections.
+	sourceCapMsg pdmsg.Message
+
+	// We use go channel here as a fixed size queue and drop messages when
+	// queue is full.
+	msgs chan pdmsg.Message
+
+	// Buffers defined once here to avoid heap allocations.
+	rxb [pdmsg.MaxMessageBytes]byte
+}
+
+const msgQueueSize = 10
+
+// New creates a new controller at the given I2C address.
+func New(port tcpcdriver.I2C, addr uint16) *CH224 {
+	return &CH224{
+		regs: tcpcdriver.Regs{I2C: port, Addr: addr},
+		msgs: make(chan pdmsg.Message, msgQueueSize),
+	}
+}
+
+// Init initializes the driver state. CH224 itself needs no initialization.
+func (c *CH224) Init() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.attached = false
+	c.sourceCapMsg = pdmsg.Message{}
+
+	// Flush the receive queue
+
+FlushReceiveQueue:
+	for {
+		select {
+		case <-c.msgs:
+		default:
+			break FlushReceiveQueue
+		}
+	}
+	return nil
+}
+
+// Tx transmits a message. Request messages for fixed supply and PPS PDOs
+// select the corresponding voltage and Get_Source_Cap is answered from the
+// capabilities received by the controller. All other messages fail with
+// typec.ErrTxFailed.
+func (c *CH224) Tx(m pdmsg.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m.SOP != pdmsg.SOPPort {
+		return typec.ErrTxFailed
+	}
+	if !m.IsData() {
+		if m.Type() != pdmsg.TypeGetSourceCap {
+			return typec.ErrTxFailed
+		}
+		return c.rxSourceCap()
+	}
+	if m.IsExtended() || m.Type() != pdmsg.TypeRequest {
+		return typec.ErrTxFailed
+	}
+
+	// Find the requested PDO
+
+	rdo := pdmsg.RequestDO(m.Data[0])
+	pos := rdo.SelectedObjectPosition()
+	if pos == 0 || pos > c.sourceCapMsg.DataObjectCount() {
+		return typec.ErrTxFailed
+	}
+	pdo := pdmsg.PDO(c.sourceCapMsg.Data[pos-1])
+
+	switch pdo.Type() {
+	case pdmsg.PDOTypeFixedSupply:
+		sel, ok := fixedVoltageSelect(pdmsg.FixedSupplyPDO(pdo).Voltage())
+		if !ok {
+			return typec.ErrTxFailed
+		}
+		if err := c.regs.WriteReg(regVoltageCtrl, sel); err != nil {
+			return err
+		}
+	case pdmsg.PDOTypePPS:
+		if err := c.regs.WriteReg(regPPSVoltage, uint8(rdo.PPSOutputVoltage()/100)); err != nil {
+			return err
+		}
+		if err := c.regs.WriteReg(regVoltageCtrl, voltageSelectPPS); err != nil {
+			return err
+		}
+	default:
+		return typec.ErrTxFailed
+	}
+
+	c.queue(c.message(pdmsg.TypeAccept))
+	c.queue(c.message(pdmsg.TypePSReady))
+	return nil
+}
+
+// fixedVoltageSelect returns the voltage selection for fixed supply voltage v
+// in mV.
+func fixedVoltageSelect(v uint16) (uint8, bool) {
+	switch v {
+	case 5000:
+		return 0, true
+	case 9000:
+		return 1, true
+	case 12000:
+		return 2, true
+	case 15000:
+		return 3, true
+	case 20000:
+		return 4, true
+	case 28000:
+		return 5, true
+	}
+	return 0, false
+}
+
+// message returns a message of type t from the source with the next message
+// ID.
+func (c *CH224) message(t pdmsg.Type) pdmsg.Message {
+	var m pdmsg.Message
+	m.SetPowerRole(pdmsg.PowerRoleSource)
+	m.SetDataRole(pdmsg.DataRoleDFP)
+	m.SetRevision(pdmsg.Revision30)
+	m.SetType(t)
+	m.SetID(c.nextID)
+	c.nextID = (c.nextID + 1) % 8
+	return m
+}
+
+// queue queues a synthesized message without blocking (ie drop if queue is
+// full which should be rare).
+func (c *CH224) queue(m pdmsg.Message) {
+	select {
+	case c.msgs <- m:
+	default:
+	}
+}
+
+// rxSourceCap reads the source capabilities received by the controller and
+// queues them as a source capabilities message. Nothing is queued if the
+// controller has not received any capabilities.
+func (c *CH224) rxSourceCap() error {
+	if err := c.regs.ReadRegs(regSrcCap, c.rxb[:2]); err != nil {
+		return err
+	}
+	var h pdmsg.Message
+	h.Header = uint16(c.rxb[1])<<8 | uint16(c.rxb[0])
+	n := h.DataObjectCount()
+	if n == 0 {
+		return nil
+	}
+	if err := c.regs.ReadRegs(regSrcCap+2, c.rxb[:n*4]); err != nil {
+		return err
+	}
+	m := c.message(pdmsg.TypeSourceCap)
+	m.SetDataObjectCount(n)
+	for i := uint8(0); i < n; i++ {
+		o := i * 4
+		m.Data[i] = uint32(c.rxb[o]) | uint32(c.rxb[o+1])<<8 | uint32(c.rxb[o+2])<<16 | uint32(c.rxb[o+3])<<24
+	}
+	c.sourceCapMsg = m
+	c.queue(m)
+	return nil
+}
+
+// Rx returns a received message.
+func (c *CH224) Rx() (pdmsg.Message, error) {
+	select {
+	case n := <-c.msgs:
+		return n, nil
+	default:
+		return pdmsg.Message{}, typec.ErrRxEmpty
+	}
+}
+
+// SendReset selects 5V which returns the source to its default voltage.
+// CH224 does not allow sending hard reset signal.
+func (c *CH224) SendReset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.regs.WriteReg(regVoltageCtrl, 0)
+}
+
+// Alert checks the controller status and returns any event generated as a
+// result.
+func (c *CH224) Alert() (e typec.Event, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Attach is detected by the controller reporting a PD contract
+
+	if !c.attached {
+		var st uint8
+		if st, err = c.regs.ReadReg(regStatus); err != nil || st&regStatusPD == 0 {
+			return
+		}
+		c.attached = true
+		e.Add(typec.EventAttached)
+		if err = c.rxSourceCap(); err != nil {
+			return
+		}
+	}
+
+	if len(c.msgs) > 0 {
+		e.Add(typec.EventRx)
+	}
+	return
+}
+
+const voltageSelectPPS = 6
+
+const (
+	regStatus   = 0x09
+	regStatusPD = 1 << 3
+
+	regVoltageCtrl = 0x0A
+
+	regPPSVoltage = 0x53
+
+	regSrcCap = 0x60
+)
@@ -1,9 +1,17 @@
 // Package fusb302 implements type-C port controller driver for FUSB302 from
 // ONSemi.
+//
+// Fast role swap signal is not detected, and typec.EventFRSwap is never
+// reported, since FUSB302 has no detector for it and the CC low pulse it
+// consists of is too short to be told apart from a detach by polling the CC
+// level over I2C.
 package fusb302
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/oxplot/go-typec"
@@ -11,96 +19,228 @@ import (
 	"github.com/oxplot/go-typec/tcpcdriver"
 )
 
-// MPN represents the manufacturer part number
+// MPN represents the manufacturer part number.
+//
+// All variants share the same register map and behave the same as far as this
+// driver is concerned, so the same register sequences are used for all of
+// them. They differ in package and I2C address, the latter being the only
+// thing the MPN determines.
 type MPN uint8
 
-// I2CAddress returns the I2C address of the FUSB302.
+// I2CAddress returns the 7-bit I2C address of the FUSB302 as listed in the
+// ordering information of its datasheet, or 0 for unknown MPNs. Use
+// WithAddress if the address differs, e.g. when remapped by a multiplexer.
 func (m MPN) I2CAddress() uint8 {
-	return uint8(m)
+	switch m {
+	case FUSB302BUCX, FUSB302BMPX, FUSB302VMPX:
+		return 0x22
+	case FUSB302B01MPX:
+		return 0x23
+	case FUSB302B10MPX:
+		return 0x24
+	case FUSB302B11MPX:
+		return 0x25
+	}
+	return 0
 }
 
 // Manufacturer part numbers
 const (
-	FUSB302BUCX   MPN = 0b100010
-	FUSB302BMPX   MPN = 0b100010
-	FUSB302VMPX   MPN = 0b100010
-	FUSB302B01MPX MPN = 0b100011
-	FUSB302B10MPX MPN = 0b100100
-	FUSB302B11MPX MPN = 0b100101
+	FUSB302BUCX   MPN = iota + 1 // I2C address 0x22
+	FUSB302BMPX                  // I2C address 0x22
+	FUSB302VMPX                  // I2C address 0x22
+	FUSB302B01MPX                // I2C address 0x23
+	FUSB302B10MPX                // I2C address 0x24
+	FUSB302B11MPX                // I2C address 0x25
+)
+
+// CC represents one of the two configuration channel lines.
+type CC uint8
+
+// CC lines
+const (
+	CCNone CC = 0 // CC line not yet determined
+	CC1    CC = 1
+	CC2    CC = 2
 )
 
-// FUSB302 represents a type-C port controller for FUSB302 IC.
+// FUSB302 represents a type-C port controller for FUSB302 IC. All its methods
+// may be called concurrently from multiple goroutines.
 type FUSB302 struct {
-	port tcpcdriver.I2C
-	addr uint16
+	regs tcpcdriver.Regs
+
+	mu sync.Mutex // guards access to the hardware and buffers
 
 	intA uint8 // cache
+	intT uint8 // cache
+	cc   CC    // CC line detected in last toggle
+
+	events typec.Event // events detected by Init, reported on the next alert
+
+	ints Interrupt // interrupts asserting INT_N
+
+	txRetries uint8
+	txTimeout time.Duration
+	cableMsgs bool // receive SOP' and SOP'' messages
+
+	// VBUS debouncing state. vbusOK is the last reported VBUS state and
+	// vbusSince is when the pending change of VBUS state was first seen.
+	vbusDebounce time.Duration
+	vbusOK       bool
+	vbusPending  bool
+	vbusSince    time.Time
 
 	// We use go channel here as a fixed size queue and drop messages when
 	// queue is full. This is not the optimal behavior but it's simple and given
 	// large enough a queue, unlikely to ever be a problem.
-	msgs chan pdmsg.Message
+	msgs    chan pdmsg.Message
+	dropped uint32 // number of messages dropped due to full queue
+
+	// Buffers for constructing tx packets, reading rx messages and reading
+	// status registers, defined once here instead to avoid heap allocations in
+	// each method used.
+	txBuf  [pdmsg.MaxMessageBytes + 9]byte
+	rxBuf  [pdmsg.MaxMessageBytes + 4]byte // 4 extra for CRC
+	status [7]byte
+}
 
-	// Buffer used for tx and rx, defined once here instead to avoid heap
-	// allocations in each method used.
-	buf [pdmsg.MaxMessageBytes + 10]byte
+const (
+	msgQueueSize     = 10
+	defaultTxRetries = 3
+	defaultTxTimeout = 10 * time.Millisecond
+)
+
+// Option configures the controller at creation time.
+type Option func(*FUSB302)
+
+// WithAddress overrides the I2C address implied by the MPN. This is useful when
+// the address is remapped, e.g. by an I2C multiplexer.
+func WithAddress(addr uint16) Option {
+	return func(f *FUSB302) {
+		f.regs.Addr = addr
+	}
+}
+
+// WithQueueSize sets the number of received messages that can be queued before
+// new messages are dropped. The default is 10. Sizes below 1 are raised to 1,
+// since no message could be received otherwise.
+func WithQueueSize(n int) Option {
+	return func(f *FUSB302) {
+		if n < 1 {
+			n = 1
+		}
+		f.msgs = make(chan pdmsg.Message, n)
+	}
 }
 
-const msgQueueSize = 10
+// WithTxRetries sets the number of times the controller automatically retries
+// transmission of a message when no GoodCRC is received. n is capped at 3,
+// which is also the default.
+func WithTxRetries(n uint8) Option {
+	return func(f *FUSB302) {
+		if n > regControl3NRetriesMask {
+			n = regControl3NRetriesMask
+		}
+		f.txRetries = n
+	}
+}
+
+// WithTxTimeout sets the maximum time Tx waits for a message to be
+// acknowledged, including all retries. The default is 10ms.
+func WithTxTimeout(d time.Duration) Option {
+	return func(f *FUSB302) {
+		f.txTimeout = d
+	}
+}
+
+// WithCableMessages enables reception of messages from the cable plugs (i.e.
+// SOP prime and SOP double prime messages), which are otherwise neither
+// acknowledged nor returned by Rx. The SOP field of received messages tells
+// them apart from port partner messages. As the controller automatically
+// responds to all received messages with GoodCRC, this should only be enabled
+// when the application is the VCONN source and needs to communicate with the
+// cable.
+func WithCableMessages() Option {
+	return func(f *FUSB302) {
+		f.cableMsgs = true
+	}
+}
+
+// WithVBusDebounce sets the time VBUS must remain stable before a change in its
+// presence is reported as attach or detach. This avoids power cycling caused by
+// VBUS chattering on marginal connectors. Since the changes are only checked
+// on calls to Alert, the actual delay may be longer depending on how often
+// Alert is called. The default is 0 which disables debouncing.
+func WithVBusDebounce(d time.Duration) Option {
+	return func(f *FUSB302) {
+		f.vbusDebounce = d
+	}
+}
 
 // New creates a new controller and allocates all necessary memory for all future operations.
 //
 // I2C port must have <=1Mhz frequency.
-func New(port tcpcdriver.I2C, mpn MPN) *FUSB302 {
-	return &FUSB302{
-		port: port,
-		addr: uint16(mpn.I2CAddress()),
-		msgs: make(chan pdmsg.Message, msgQueueSize),
+func New(port tcpcdriver.I2C, mpn MPN, opts ...Option) *FUSB302 {
+	f := &FUSB302{
+		regs:      tcpcdriver.Regs{I2C: port, Addr: uint16(mpn.I2CAddress())},
+		txRetries: defaultTxRetries,
+		txTimeout: defaultTxTimeout,
+	}
+	for _, o := range opts {
+		o(f)
+	}
+	if f.msgs == nil {
+		f.msgs = make(chan pdmsg.Message, msgQueueSize)
 	}
+	return f
 }
 
-func (f *FUSB302) write(r uint8, d byte) error {
-	f.buf[0] = r
-	f.buf[1] = d
-	return f.port.Tx(f.addr, f.buf[:2], nil)
+// DeviceID represents the content of the device ID register.
+type DeviceID uint8
+
+// Version returns the version ID of the device.
+func (d DeviceID) Version() uint8 {
+	return uint8(d>>4) & 0b1111
 }
 
-func (f *FUSB302) read(r uint8) (byte, error) {
-	f.buf[0] = r
-	err := f.port.Tx(f.addr, f.buf[:1], f.buf[1:2])
-	return f.buf[1], err
+// Product returns the product ID of the device.
+func (d DeviceID) Product() uint8 {
+	return uint8(d>>2) & 0b11
 }
 
-func (f *FUSB302) writeMany(r uint8, d []byte) error {
-	f.buf[0] = r
-	copy(f.buf[1:], d)
-	return f.port.Tx(f.addr, f.buf[:len(d)+1], nil)
+// Revision returns the revision ID of the device.
+func (d DeviceID) Revision() uint8 {
+	return uint8(d) & 0b11
 }
 
-func (f *FUSB302) readMany(r uint8, d []byte) error {
-	f.buf[0] = r
-	err := f.port.Tx(f.addr, f.buf[:1], f.buf[1:len(d)+1])
-	if err == nil {
-		copy(d, f.buf[1:len(d)+1])
-	}
-	return err
+// DeviceID reads the device ID register. It does not require the controller to
+// be initialized and as such can be used to verify the presence of the chip.
+func (f *FUSB302) DeviceID() (DeviceID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, err := f.regs.ReadReg(regDeviceID)
+	return DeviceID(id), err
 }
 
 // Init initializes the controller.
 func (f *FUSB302) Init() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
 	// Reset the chip and registers to default
 
-	if err := f.write(regReset, regResetSWReset); err != nil {
+	if err := f.regs.WriteReg(regReset, regResetSWReset); err != nil {
 		return err
 	}
 
 	// Flush the rx buffer
 
-	if err := f.write(regControl1, 0b100); err != nil {
+	if err := f.regs.WriteReg(regControl1, f.control1()|regControl1RxFlush); err != nil {
 		return err
 	}
 
+	f.cc = CCNone
+
 	// Flush the receive queue
 
 FlushReceiveQueue:
@@ -112,56 +252,133 @@ FlushReceiveQueue:
 		}
 	}
 
+	// Restore interrupt mask lost by the reset
+
+	if err := f.setInterruptMask(f.ints); err != nil {
+		return err
+	}
+
 	// Turn on all power
 
-	if err := f.write(regPower, regPowerPwrAll); err != nil {
+	if err := f.regs.WriteReg(regPower, regPowerPwrAll); err != nil {
 		return err
 	}
 
+	// VBUS that is already present (e.g. on a dead battery boot) generates no
+	// interrupt, so report it as attach on the next alert. The current
+	// advertised by the source is reported along with it, as the toggle that
+	// otherwise reports it may be yet to complete. CC lines are measured before
+	// toggling takes over the switches.
+
+	status0, err := f.regs.ReadReg(regStatus0)
+	if err != nil {
+		return err
+	}
+	f.intT = 0
+	f.events = typec.EventNone
+	if status0&regStatus0VBusOK != 0 {
+		f.intT = regInterruptVBusOK
+		if f.events, err = f.hostCurrent(); err != nil {
+			return err
+		}
+	}
+	f.vbusOK = false
+	f.vbusPending = false
+
 	// Turn on auto detect CC in sink mode
 
-	if err := f.write(regControl2, 0b00000101); err != nil {
+	if err := f.regs.WriteReg(regControl2, regControl2SnkToggle); err != nil {
 		return err
 	}
 
 	// Turn on auto retry
 
-	if err := f.write(regControl3, 0b111); err != nil {
+	if err := f.regs.WriteReg(regControl3, f.txRetries<<regControl3NRetriesPos|regControl3AutoRetry); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// hostCurrent measures both CC lines and returns the EventPower* event for the
+// highest current advertised by the source, or EventNone if there is no Rp on
+// either line. The switches are left with only the pull-downs enabled.
+func (f *FUSB302) hostCurrent() (typec.Event, error) {
+	var lvl uint8
+	for _, meas := range [2]uint8{regSwitches0MeasCC1, regSwitches0MeasCC2} {
+		if err := f.regs.WriteReg(regSwitches0, meas|regSwitches0CC1PdEn|regSwitches0CC2PdEn); err != nil {
+			return typec.EventNone, err
+		}
+		time.Sleep(measureSettleTime)
+		st, err := f.regs.ReadReg(regStatus0)
+		if err != nil {
+			return typec.EventNone, err
+		}
+		if l := st & regStatus0BCLevelMask; l > lvl {
+			lvl = l
+		}
+	}
+	if err := f.regs.WriteReg(regSwitches0, regSwitches0CC1PdEn|regSwitches0CC2PdEn); err != nil {
+		return typec.EventNone, err
+	}
+	switch lvl {
+	case 1:
+		return typec.EventPower0A5, nil
+	case 2:
+		return typec.EventPower1A5, nil
+	case 3:
+		return typec.EventPower3A0, nil
+	}
+	return typec.EventNone, nil
+}
+
 // Tx transmits a message.
 func (f *FUSB302) Tx(m pdmsg.Message) error {
+	return f.TxContext(context.Background(), m)
+}
+
+// TxContext transmits a message and returns ctx.Err() as soon as ctx is done
+// while waiting for the message to be acknowledged.
+func (f *FUSB302) TxContext(ctx context.Context, m pdmsg.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
 	// Flush TX FIFO
 
-	if err := f.write(regControl0, 0b01100100); err != nil {
+	if err := f.regs.WriteReg(regControl0, f.control0()|regControl0TxFlush); err != nil {
 		return err
 	}
 
 	// Construct and send the message
 
-	buf := make([]byte, 9+pdmsg.MaxMessageBytes)
-	copy(buf, []byte{fifoTokenSync1, fifoTokenSync1, fifoTokenSync1, fifoTokenSync2})
+	buf := f.txBuf[:]
+	switch m.SOP {
+	case pdmsg.SOPPort:
+		copy(buf, []byte{fifoTokenSync1, fifoTokenSync1, fifoTokenSync1, fifoTokenSync2})
+	case pdmsg.SOPPrime:
+		copy(buf, []byte{fifoTokenSync1, fifoTokenSync1, fifoTokenSync3, fifoTokenSync3})
+	case pdmsg.SOPDoublePrime:
+		copy(buf, []byte{fifoTokenSync1, fifoTokenSync3, fifoTokenSync1, fifoTokenSync3})
+	default:
+		return typec.ErrTxFailed
+	}
 	mlen := m.ToBytes(buf[5:])
 	buf[4] = fifoTokenPackSym | mlen
 	copy(buf[5+mlen:], []byte{fifoTokenJamCRC, fifoTokenEOP, fifoTokenTxOff, fifoTokenTxOn})
 	plen := 9 + mlen
 
-	if err := f.writeMany(regFIFOs, buf[:plen]); err != nil {
+	if err := f.regs.WriteRegs(regFIFOs, buf[:plen]); err != nil {
 		return err
 	}
 
 	// Wait until either:
 	// - GoodCRC is received: tx successful
 	// - Auto Retry failed: tx failed
-	// - ~10 millisecond has passed: tx failed
+	// - Tx timeout has passed: tx failed
 
-	for i := 0; i < 10; i++ {
-		r, err := f.read(regInterruptA)
+	var txErr TxError
+	for t := time.Duration(0); t < f.txTimeout; t += time.Millisecond {
+		r, err := f.regs.ReadReg(regInterruptA)
 		f.intA |= r
 		if err != nil {
 			return err
@@ -169,15 +386,74 @@ func (f *FUSB302) Tx(m pdmsg.Message) error {
 		if r&regInterruptATxSuccess != 0 { // received GoodCRC
 			return nil
 		}
+
+		// Any packet with a valid CRC received while waiting is not the
+		// expected GoodCRC, otherwise TxSuccess would have been set.
+
+		intT, err := f.regs.ReadReg(regInterrupt)
+		f.intT |= intT
+		if err != nil {
+			return err
+		}
+		if intT&regInterruptCRCChk != 0 {
+			txErr.RxWhileWaiting = true
+		}
+
 		if r&regInterruptARetryFail != 0 {
-			return typec.ErrTxFailed
+			txErr.MaxRetries = f.txRetries
+			return txErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 		time.Sleep(time.Millisecond)
 	}
 
+	txErr.Timeout = true
+	return txErr
+}
+
+// TxError is returned by Tx when transmission of a message fails after all
+// auto-retries or times out. It wraps typec.ErrTxFailed so that errors.Is can
+// be used to test for it.
+type TxError struct {
+	// MaxRetries is the number of auto-retries configured with WithTxRetries.
+	// The controller does not report the number of retries it made, but all of
+	// them took place unless Timeout is true, in which case MaxRetries is
+	// zero.
+	MaxRetries uint8
+
+	// Timeout is true if the controller did not report the outcome of the
+	// transmission before the Tx timeout.
+	Timeout bool
+
+	// RxWhileWaiting is true if a packet with a valid CRC other than the
+	// expected GoodCRC (e.g. GoodCRC with a mismatched message ID) was received
+	// while waiting for the acknowledgement. This indicates the port partner is
+	// alive but failed to properly acknowledge the message.
+	RxWhileWaiting bool
+}
+
+func (e TxError) Error() string {
+	if e.Timeout {
+		return fmt.Sprintf("%s: timed out (rx while waiting: %t)", typec.ErrTxFailed, e.RxWhileWaiting)
+	}
+	return fmt.Sprintf("%s: %d retries (rx while waiting: %t)", typec.ErrTxFailed, e.MaxRetries, e.RxWhileWaiting)
+}
+
+// Unwrap returns typec.ErrTxFailed.
+func (e TxError) Unwrap() error {
 	return typec.ErrTxFailed
 }
 
+// DroppedMessages returns the number of received messages dropped so far due
+// to the receive queue being full.
+func (f *FUSB302) DroppedMessages() uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dropped
+}
+
 // Rx returns a received message.
 func (f *FUSB302) Rx() (pdmsg.Message, error) {
 	select {
@@ -194,7 +470,7 @@ func (f *FUSB302) rx(m *pdmsg.Message) error {
 
 	// Is there a message waiting to be read?
 
-	reg, err = f.read(regStatus1)
+	reg, err = f.regs.ReadReg(regStatus1)
 	if err != nil {
 		return err
 	}
@@ -204,17 +480,27 @@ func (f *FUSB302) rx(m *pdmsg.Message) error {
 
 	// Read the header
 
-	buf := make([]byte, pdmsg.MaxMessageBytes+4) // 4 extra for CRC at the end which we will discard
-	if err = f.readMany(regFIFOs, buf[:3]); err != nil {
+	buf := f.rxBuf[:] // 4 extra for CRC at the end which we will discard
+	if err = f.regs.ReadRegs(regFIFOs, buf[:3]); err != nil {
 		return err
 	}
 	m.Header = uint16(buf[2])<<8 | uint16(buf[1])
 	l := m.DataObjectCount()
+	switch buf[0] & fifoRxTokenMask {
+	case fifoRxTokenSOP:
+		m.SOP = pdmsg.SOPPort
+	case fifoRxTokenSOPPrime:
+		m.SOP = pdmsg.SOPPrime
+	case fifoRxTokenSOPDoublePrime:
+		m.SOP = pdmsg.SOPDoublePrime
+	default:
+		err = errRxUnknownSOP // read the rest of the message and report
+	}
 
 	// Read data objects
 
 	if l > 0 {
-		if err = f.readMany(regFIFOs, buf[:l*4+4]); err != nil {
+		if err := f.regs.ReadRegs(regFIFOs, buf[:l*4+4]); err != nil {
 			return err
 		}
 		for i := uint8(0); i < l; i++ {
@@ -225,24 +511,31 @@ func (f *FUSB302) rx(m *pdmsg.Message) error {
 
 		// Discard the CRC
 
-		if err = f.readMany(regFIFOs, buf[:4]); err != nil {
+		if err := f.regs.ReadRegs(regFIFOs, buf[:4]); err != nil {
 			return err
 		}
 	}
-	return nil
+	return err
 }
 
+// errRxUnknownSOP is returned by rx when a message with an SOP type other than
+// SOP, SOP prime and SOP double prime (i.e. debug SOPs) is received.
+var errRxUnknownSOP = errors.New("unknown sop")
+
 // SendReset send a hard reset message to the port partner.
 func (f *FUSB302) SendReset() error {
-	r, err := f.read(regControl3)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r, err := f.regs.ReadReg(regControl3)
 	if err != nil {
 		return err
 	}
-	if err := f.write(regControl3, r|regControl3SendHardReset); err != nil {
+	if err := f.regs.WriteReg(regControl3, r|regControl3SendHardReset); err != nil {
 		return err
 	}
 	for i := 0; i < 5; i++ {
-		intA, err := f.read(regInterruptA)
+		intA, err := f.regs.ReadReg(regInterruptA)
 		if err != nil {
 			return err
 		}
@@ -255,21 +548,100 @@ func (f *FUSB302) SendReset() error {
 	return typec.ErrTxFailed
 }
 
+// Sleep powers down all but the blocks needed for detecting attachment of a
+// port partner, in order to reduce power consumption while detached. Full power
+// is automatically restored by Alert once attachment is detected.
+//
+// Sleep must only be called while detached, e.g. right after Init.
+func (f *FUSB302) Sleep() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.regs.WriteReg(regPower, regPowerPwrWake); err != nil {
+		return err
+	}
+	return f.regs.WriteReg(regControl2, regControl2SnkToggle)
+}
+
+// StartBIST starts continuous transmission of BIST Carrier Mode 2 pattern. It
+// implements typec.BISTTransmitter.
+func (f *FUSB302) StartBIST() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.regs.WriteReg(regControl1, f.control1()|regControl1BISTMode2); err != nil {
+		return err
+	}
+	return f.regs.WriteReg(regControl0, f.control0()|regControl0TxStart)
+}
+
+// StopBIST stops transmission of BIST Carrier Mode 2 pattern. It implements
+// typec.BISTTransmitter.
+func (f *FUSB302) StopBIST() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.regs.WriteReg(regControl1, f.control1()); err != nil {
+		return err
+	}
+	return f.regs.WriteReg(regControl0, f.control0()|regControl0TxFlush)
+}
+
+// SetDataRole sets the data role in the header of GoodCRC messages sent by the
+// controller, which is reset to UFP by Init.
+func (f *FUSB302) SetDataRole(r pdmsg.DataRole) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sw1, err := f.regs.ReadReg(regSwitches1)
+	if err != nil {
+		return err
+	}
+	sw1 &^= regSwitches1DataRole
+	if r == pdmsg.DataRoleDFP {
+		sw1 |= regSwitches1DataRole
+	}
+	return f.regs.WriteReg(regSwitches1, sw1)
+}
+
 // ErrInvalidCCState is returned when the CC state is invalid.
 var ErrInvalidCCState = errors.New("invalid cc state")
 
 // Alert processes all pending interrupts and returns any event generated as a
-// result.
+// result. In the common case of no pending interrupts, Alert reads only the
+// interrupt and status registers in a single 5 byte transfer. Status registers
+// of the toggle and reset detection are read only when their interrupts are
+// pending.
 func (f *FUSB302) Alert() (e typec.Event, err error) {
-	regs := make([]byte, 7)
-	if err = f.readMany(regStatus0A, regs); err != nil {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	regs := f.status[2:]
+	if err = f.regs.ReadRegs(regInterruptA, regs); err != nil {
 		return
 	}
-	status0A, status1A, intA, _, status0, status1, intT := regs[0], regs[1], regs[2], regs[3], regs[4], regs[5], regs[6]
+	intA, _, status0, status1, intT := regs[0], regs[1], regs[2], regs[3], regs[4]
 	intA |= f.intA
 	f.intA = 0
+	intT |= f.intT
+	f.intT = 0
+	e, f.events = f.events, typec.EventNone
+
+	// Nothing happened
+
+	if intA == 0 && intT == 0 && !f.vbusPending {
+		return
+	}
 
-	_, _, _ = intT, status0, status1
+	var status0A, status1A uint8
+	if intA&(regInterruptASoftReset|regInterruptAHardReset|regInterruptATogDone) != 0 {
+		if err = f.regs.ReadRegs(regStatus0A, f.status[:2]); err != nil {
+			return
+		}
+		status0A, status1A = f.status[0], f.status[1]
+	}
+
+	// Report over-current and over-temperature faults
+
+	if intA&regInterruptAOCPTemp != 0 && status1&(regStatus1OverTemp|regStatus1OCP) != 0 {
+		e.Add(typec.EventFault)
+	}
 
 	// Report soft and hard resets
 
@@ -284,6 +656,12 @@ func (f *FUSB302) Alert() (e typec.Event, err error) {
 
 	if intA&regInterruptATogDone != 0 {
 
+		// Restore full power in case we were sleeping
+
+		if err = f.regs.WriteReg(regPower, regPowerPwrAll); err != nil {
+			return
+		}
+
 		// Determine host current capabilities at 5V
 
 		switch status0 & 0b11 {
@@ -297,7 +675,7 @@ func (f *FUSB302) Alert() (e typec.Event, err error) {
 
 		// Turn off auto detect function
 
-		if err = f.write(regControl2, 0); err != nil {
+		if err = f.regs.WriteReg(regControl2, 0); err != nil {
 			return
 		}
 
@@ -309,16 +687,18 @@ func (f *FUSB302) Alert() (e typec.Event, err error) {
 		if (status1A>>regStatus1ATogSSPos)&(regStatus1ATogSSMask) == regStatus1ATogSSSnk1 {
 			pol = regSwitches1TxCC1En
 			meas = regSwitches0MeasCC1
+			f.cc = CC1
 		} else if (status1A>>regStatus1ATogSSPos)&(regStatus1ATogSSMask) == regStatus1ATogSSSnk2 {
 			pol = regSwitches1TxCC2En
 			meas = regSwitches0MeasCC2
+			f.cc = CC2
 		} else {
 			return e, ErrInvalidCCState
 		}
-		if err = f.write(regSwitches1, regSwitches1SpecRev1|regSwitches1AutoGCRC|pol); err != nil {
+		if err = f.regs.WriteReg(regSwitches1, regSwitches1SpecRev1|regSwitches1AutoGCRC|pol); err != nil {
 			return
 		}
-		if err = f.write(regSwitches0, meas|regSwitches0CC1PdEn|regSwitches0CC2PdEn); err != nil {
+		if err = f.regs.WriteReg(regSwitches0, meas|regSwitches0CC1PdEn|regSwitches0CC2PdEn); err != nil {
 			return
 		}
 
@@ -326,8 +706,11 @@ func (f *FUSB302) Alert() (e typec.Event, err error) {
 
 	// VBUS detection
 
-	if intT&regInterruptVBusOK != 0 {
+	if f.vbusDebounce > 0 {
+		e.Add(f.debounceVBus(status0&regStatus0VBusOK != 0, intT&regInterruptVBusOK != 0))
+	} else if intT&regInterruptVBusOK != 0 {
 		if status0&regStatus0VBusOK == 0 {
+			f.cc = CCNone
 			e.Add(typec.EventDetached)
 		} else {
 			e.Add(typec.EventAttached)
@@ -341,6 +724,10 @@ func (f *FUSB302) Alert() (e typec.Event, err error) {
 		for {
 			var msg pdmsg.Message
 			if err = f.rx(&msg); err != nil {
+				if err == errRxUnknownSOP {
+					err = nil
+					continue
+				}
 				if err == typec.ErrRxEmpty {
 					err = nil
 					break
@@ -350,10 +737,16 @@ func (f *FUSB302) Alert() (e typec.Event, err error) {
 			if !msg.IsData() && msg.Type() == pdmsg.TypeGoodCRC {
 				continue
 			}
+			// Only port partner messages are delivered unless cable messages
+			// are enabled.
+			if msg.SOP != pdmsg.SOPPort && !f.cableMsgs {
+				continue
+			}
 			// Queue message without blocking (ie drop if queue is full which should be rare).
 			select {
 			case f.msgs <- msg:
 			default:
+				f.dropped++
 			}
 		}
 		e.Add(typec.EventRx)
@@ -362,8 +755,314 @@ func (f *FUSB302) Alert() (e typec.Event, err error) {
 	return
 }
 
+// debounceVBus returns attach or detach event once VBUS has remained in state
+// ok for the debounce time. changed is true if VBUS state has changed since
+// the last call, which restarts the debounce time.
+func (f *FUSB302) debounceVBus(ok bool, changed bool) typec.Event {
+	if ok == f.vbusOK {
+		f.vbusPending = false
+		return typec.EventNone
+	}
+	if !f.vbusPending || changed {
+		f.vbusPending = true
+		f.vbusSince = time.Now()
+		return typec.EventNone
+	}
+	if time.Since(f.vbusSince) < f.vbusDebounce {
+		return typec.EventNone
+	}
+	f.vbusPending = false
+	f.vbusOK = ok
+	if !ok {
+		f.cc = CCNone
+		return typec.EventDetached
+	}
+	return typec.EventAttached
+}
+
+// MeasureVBus returns the approximate voltage of VBUS in millivolts. The
+// measurement is done by searching for the threshold of the internal comparator
+// and as such, the resolution is limited to 420mV. The returned voltage is the
+// lower bound of the 420mV window VBUS voltage falls in, i.e. actual voltage is
+// up to 420mV higher than the returned value.
+func (f *FUSB302) MeasureVBus() (uint16, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.measure(regMeasureVBus, mdacVBusStep)
+}
+
+// Interrupt is a set of FUSB302 interrupts that can assert the INT_N pin.
+type Interrupt uint32
+
+// Interrupts
 const (
+	InterruptBCLevel    Interrupt = 1 << 0
+	InterruptCollision  Interrupt = 1 << 1
+	InterruptWake       Interrupt = 1 << 2
+	InterruptAlert      Interrupt = 1 << 3
+	InterruptCRCCheck   Interrupt = 1 << 4
+	InterruptCompChange Interrupt = 1 << 5
+	InterruptActivity   Interrupt = 1 << 6
+	InterruptVBusOK     Interrupt = 1 << 7
+	InterruptHardReset  Interrupt = 1 << 8
+	InterruptSoftReset  Interrupt = 1 << 9
+	InterruptTxSent     Interrupt = 1 << 10
+	InterruptHardSent   Interrupt = 1 << 11
+	InterruptRetryFail  Interrupt = 1 << 12
+	InterruptSoftFail   Interrupt = 1 << 13
+	InterruptTogDone    Interrupt = 1 << 14
+	InterruptOCPTemp    Interrupt = 1 << 15
+	InterruptGCRCSent   Interrupt = 1 << 16
+
+	// InterruptsAlert is the set of interrupts processed by Alert.
+	InterruptsAlert = InterruptCRCCheck | InterruptVBusOK | InterruptHardReset |
+		InterruptSoftReset | InterruptTogDone | InterruptOCPTemp
+)
+
+// SetInterruptMask sets the interrupts that assert the active low INT_N pin.
+// All other interrupts are masked. Passing 0 masks all interrupts, which is the
+// default.
+//
+// With INT_N wired to a GPIO of the µController, Alert only needs to be called
+// when INT_N is low, instead of continuously polling. InterruptsAlert is the
+// set of interrupts needed for the normal operation of a sink.
+//
+// The mask is retained across calls to Init.
+func (f *FUSB302) SetInterruptMask(i Interrupt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.setInterruptMask(i); err != nil {
+		return err
+	}
+	f.ints = i
+	return nil
+}
+
+func (f *FUSB302) setInterruptMask(i Interrupt) error {
+	// Mask registers mask the interrupt when their bit is set.
+	if err := f.regs.WriteReg(regMask, ^uint8(i)); err != nil {
+		return err
+	}
+	if err := f.regs.WriteReg(regMaskA, ^uint8(i>>8)); err != nil {
+		return err
+	}
+	if err := f.regs.WriteReg(regMaskB, ^uint8(i>>16)&regMaskBGCRCSent); err != nil {
+		return err
+	}
+	ctrl0 := uint8(regControl0HostCurDefault)
+	if i == 0 {
+		ctrl0 |= regControl0IntMask
+	}
+	return f.regs.WriteReg(regControl0, ctrl0)
+}
+
+// control0 returns the value of control0 register with the global interrupt
+// mask set according to enabled interrupts.
+func (f *FUSB302) control0() uint8 {
+	if f.ints == 0 {
+		return regControl0HostCurDefault | regControl0IntMask
+	}
+	return regControl0HostCurDefault
+}
+
+// control1 returns the value of control1 register with reception of cable
+// messages set as configured.
+func (f *FUSB302) control1() uint8 {
+	if f.cableMsgs {
+		return regControl1EnSOP1 | regControl1EnSOP2
+	}
+	return 0
+}
+
+// CCOrientation returns the CC line the port partner was detected on in the
+// last toggle, which determines the orientation of the plug. CCNone is
+// returned if no port partner is attached.
+func (f *FUSB302) CCOrientation() CC {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cc
+}
+
+// ErrNoCC is returned when the CC line to measure is not yet determined.
+var ErrNoCC = errors.New("cc line not determined")
+
+// MeasureCC returns the approximate voltage in millivolts on the active CC line
+// along with which of the two lines it is. The active line is the one detected
+// when the port partner was attached. The resolution of the measurement is
+// limited to 42mV and the returned voltage is the lower bound of the 42mV
+// window CC voltage falls in. ErrNoCC is returned if no port partner has been
+// detected yet.
+func (f *FUSB302) MeasureCC() (uint16, CC, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cc == CCNone {
+		return 0, CCNone, ErrNoCC
+	}
+	v, err := f.measure(0, mdacCCStep)
+	return v, f.cc, err
+}
+
+// Termination represents the termination detected on a CC line.
+type Termination uint8
+
+// Terminations that can be detected on a CC line.
+const (
+	TerminationOpen      Termination = iota // nothing connected
+	TerminationRd                           // pull-down presented by a sink (or Ra by a cable or accessory)
+	TerminationRpDefault                    // pull-up presented by a source with default USB power
+	TerminationRp1A5                        // pull-up presented by a source with 1.5A at 5V
+	TerminationRp3A0                        // pull-up presented by a source with 3A at 5V
+)
+
+// DetectTermination returns the termination detected on each CC line, which is
+// useful for debugging boards that fail to attach, e.g. due to miswired CC
+// lines. Pull-ups (Rp) of sources are detected against the internal pull-downs
+// and pull-downs (Rd) of sinks are detected against the internal pull-up
+// current source.
+//
+// Detection interferes with attach detection and must only be called while
+// detached, e.g. right after Init. Attach detection is resumed afterwards.
+func (f *FUSB302) DetectTermination() (cc1, cc2 Termination, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var sw0, meas uint8
+	if sw0, err = f.regs.ReadReg(regSwitches0); err != nil {
+		return
+	}
+	if meas, err = f.regs.ReadReg(regMeasure); err != nil {
+		return
+	}
+
+	// Restore switches and measurement and resume toggling on every exit path
+	// so a failed detection doesn't leave attach detection disabled. The first
+	// error is reported.
+
+	defer func() {
+		for _, r := range [...]struct{ reg, val uint8 }{
+			{regSwitches0, sw0},
+			{regMeasure, meas},
+			{regControl2, regControl2SnkToggle},
+		} {
+			if werr := f.regs.WriteReg(r.reg, r.val); werr != nil && err == nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			cc1, cc2 = TerminationOpen, TerminationOpen
+		}
+	}()
+
+	// Stop toggling which otherwise controls the CC switches
+
+	if err = f.regs.WriteReg(regControl2, 0); err != nil {
+		return
+	}
+
+	var t [2]Termination
+	for i, sw := range [2]uint8{regSwitches0MeasCC1, regSwitches0MeasCC2} {
+		if t[i], err = f.detectTermination(sw, regSwitches0CC1PuEn<<i); err != nil {
+			return
+		}
+	}
+	return t[0], t[1], nil
+}
+
+// detectTermination returns the termination of the CC line measured with
+// measure switch meas, and pulled up with pull-up switch pu.
+func (f *FUSB302) detectTermination(meas, pu uint8) (Termination, error) {
+
+	// Rp against our Rd, as BC_LVL reports the advertised current of sources
+
+	if err := f.regs.WriteReg(regSwitches0, meas|regSwitches0CC1PdEn|regSwitches0CC2PdEn); err != nil {
+		return TerminationOpen, err
+	}
+	time.Sleep(measureSettleTime)
+	st, err := f.regs.ReadReg(regStatus0)
+	if err != nil {
+		return TerminationOpen, err
+	}
+	switch st & regStatus0BCLevelMask {
+	case 1:
+		return TerminationRpDefault, nil
+	case 2:
+		return TerminationRp1A5, nil
+	case 3:
+		return TerminationRp3A0, nil
+	}
+
+	// Rd against our pull-up current source. Open line is pulled up close to
+	// VDD while Rd keeps it well below the threshold.
+
+	if err := f.regs.WriteReg(regSwitches0, meas|pu); err != nil {
+		return TerminationOpen, err
+	}
+	if err := f.regs.WriteReg(regMeasure, rdThreshold/mdacCCStep-1); err != nil {
+		return TerminationOpen, err
+	}
+	time.Sleep(measureSettleTime)
+	if st, err = f.regs.ReadReg(regStatus0); err != nil {
+		return TerminationOpen, err
+	}
+	if st&regStatus0Comp != 0 {
+		return TerminationOpen, nil
+	}
+	return TerminationRd, nil
+}
+
+// rdThreshold is the CC voltage in millivolts below which the line is
+// considered terminated with Rd when pulled up with the default current
+// source.
+const rdThreshold = 1596
+
+// measure performs a binary search over the MDAC thresholds of the comparator
+// and returns the lower bound of the measured voltage in millivolts. meas is
+// the value of MEAS_VBUS bit of the measure register and step is the voltage
+// of each MDAC step in millivolts.
+func (f *FUSB302) measure(meas uint8, step uint16) (uint16, error) {
+	orig, err := f.regs.ReadReg(regMeasure)
+	if err != nil {
+		return 0, err
+	}
+
+	// Find the number of MDAC thresholds (n * step) the voltage is above.
+
+	lo, hi := uint8(0), uint8(regMeasureMDACMask+1)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if err = f.regs.WriteReg(regMeasure, meas|(mid-1)); err != nil {
+			return 0, err
+		}
+		time.Sleep(measureSettleTime)
+		var st uint8
+		if st, err = f.regs.ReadReg(regStatus0); err != nil {
+			return 0, err
+		}
+		if st&regStatus0Comp != 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	if err = f.regs.WriteReg(regMeasure, orig); err != nil {
+		return 0, err
+	}
+	return uint16(lo) * step, nil
+}
+
+const (
+	mdacVBusStep      = 420 // mV
+	mdacCCStep        = 42  // mV
+	measureSettleTime = 250 * time.Microsecond
+)
+
+const (
+	regDeviceID = 0x01
+
 	regSwitches0        = 0x02
+	regSwitches0CC2PuEn = 1 << 7
+	regSwitches0CC1PuEn = 1 << 6
 	regSwitches0MeasCC2 = 1 << 3
 	regSwitches0MeasCC1 = 1 << 2
 	regSwitches0CC2PdEn = 1 << 1
@@ -371,6 +1070,7 @@ const (
 
 	regSwitches1         = 0x03
 	regSwitches1SpecRev1 = 1 << 6
+	regSwitches1DataRole = 1 << 4
 	regSwitches1AutoGCRC = 1 << 2
 	regSwitches1TxCC2En  = 1 << 1
 	regSwitches1TxCC1En  = 1 << 0
@@ -379,17 +1079,36 @@ const (
 	regMeasureMDACMask = 0x3F
 	regMeasureVBus     = 1 << 6
 
-	regControl0 = 0x06
-	regControl1 = 0x07
-	regControl2 = 0x08
+	regControl0               = 0x06
+	regControl0TxFlush        = 1 << 6
+	regControl0IntMask        = 1 << 5
+	regControl0HostCurDefault = 0b01 << 2
+	regControl0TxStart        = 1 << 0
+
+	regControl1          = 0x07
+	regControl1BISTMode2 = 1 << 4
+	regControl1RxFlush   = 1 << 2
+	regControl1EnSOP2    = 1 << 1
+	regControl1EnSOP1    = 1 << 0
+	regControl2          = 0x08
+	regControl2SnkToggle = 0b00000101
 
 	regControl3              = 0x09
 	regControl3SendHardReset = 1 << 6
+	regControl3NRetriesPos   = 1
+	regControl3NRetriesMask  = 0b11
+	regControl3AutoRetry     = 1 << 0
 
 	regMask = 0x0A
 
-	regPower       = 0x0B
-	regPowerPwrAll = 0xF
+	regMaskA = 0x0E
+
+	regMaskB         = 0x0F
+	regMaskBGCRCSent = 1 << 0
+
+	regPower        = 0x0B
+	regPowerPwrAll  = 0xF
+	regPowerPwrWake = 1 << 0
 
 	regReset        = 0x0C
 	regResetSWReset = 1 << 0
@@ -406,6 +1125,7 @@ const (
 	regStatus1ATogSSMask = 0x7
 
 	regInterruptA          = 0x3E
+	regInterruptAOCPTemp   = 1 << 7
 	regInterruptATogDone   = 1 << 6
 	regInterruptARetryFail = 1 << 4
 	regInterruptAHardSent  = 1 << 3
@@ -415,9 +1135,14 @@ const (
 
 	regStatus0       = 0x40
 	regStatus0VBusOK = 1 << 7
+	regStatus0Comp   = 1 << 5
+
+	regStatus0BCLevelMask = 0b11
 
-	regStatus1        = 0x41
-	regStatus1RxEmpty = 1 << 5
+	regStatus1         = 0x41
+	regStatus1RxEmpty  = 1 << 5
+	regStatus1OverTemp = 1 << 1
+	regStatus1OCP      = 1 << 0
 
 	regInterrupt       = 0x42
 	regInterruptVBusOK = 1 << 7
@@ -428,8 +1153,14 @@ const (
 	fifoTokenTxOn    = 0xA1
 	fifoTokenSync1   = 0x12
 	fifoTokenSync2   = 0x13
+	fifoTokenSync3   = 0x1B
 	fifoTokenPackSym = 0x80
 	fifoTokenJamCRC  = 0xFF
 	fifoTokenEOP     = 0x14
 	fifoTokenTxOff   = 0xFE
+
+	fifoRxTokenMask           = 0b111 << 5
+	fifoRxTokenSOP            = 0b111 << 5
+	fifoRxTokenSOPPrime       = 0b110 << 5
+	fifoRxTokenSOPDoublePrime = 0b101 << 5
 )
@@ -0,0 +1,282 @@
+package fusb302
+
+import (
+	"testing"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+)
+
+// fakeI2C simulates the registers and FIFOs of a FUSB302 without allocating
+// so that allocations of the driver can be measured. Interrupt registers are
+// cleared on read, reading the FIFO pops the received bytes and writing the
+// FIFO is acknowledged with TxSuccess.
+type fakeI2C struct {
+	regs   [256]byte
+	rxFIFO [256]byte
+	rxHead int
+	rxTail int
+	txDone bool // true if a message was written to the FIFO
+
+	transfers int // number of I2C transfers so far
+	read      int // number of bytes read so far
+}
+
+func (d *fakeI2C) Tx(addr uint16, w, r []byte) error {
+	d.transfers++
+	d.read += len(r)
+	reg := w[0]
+	if len(w) > 1 {
+		if reg == regFIFOs {
+			d.txDone = true
+		} else {
+			copy(d.regs[reg:], w[1:])
+		}
+	}
+	for i := range r {
+		if reg == regFIFOs {
+			if d.rxHead < d.rxTail {
+				r[i] = d.rxFIFO[d.rxHead]
+				d.rxHead++
+			}
+			continue
+		}
+		a := reg + uint8(i)
+		switch a {
+		case regStatus1:
+			d.regs[a] &^= regStatus1RxEmpty
+			if d.rxHead == d.rxTail {
+				d.regs[a] |= regStatus1RxEmpty
+			}
+		case regInterruptA:
+			if d.txDone {
+				d.regs[a] |= regInterruptATxSuccess
+				d.txDone = false
+			}
+		}
+		r[i] = d.regs[a]
+		switch a {
+		case regInterruptA, regInterruptA + 1, regInterrupt:
+			d.regs[a] = 0
+		}
+	}
+	return nil
+}
+
+// receive queues m in the receive FIFO and raises the CRC check interrupt.
+func (d *fakeI2C) receive(m pdmsg.Message) {
+	if d.rxHead == d.rxTail {
+		d.rxHead, d.rxTail = 0, 0
+	}
+	d.rxFIFO[d.rxTail] = 0xe0 // SOP token
+	n := int(m.ToBytes(d.rxFIFO[d.rxTail+1:]))
+	d.rxTail += 1 + n + 4 // CRC
+	d.regs[regInterrupt] |= regInterruptCRCChk
+}
+
+// newTestController returns an initialized controller on a fake I2C bus.
+func newTestController(tb testing.TB, opts ...Option) (*FUSB302, *fakeI2C) {
+	tb.Helper()
+	d := &fakeI2C{}
+	f := New(d, FUSB302BMPX, opts...)
+	if err := f.Init(); err != nil {
+		tb.Fatal(err)
+	}
+	return f, d
+}
+
+// testMessage returns a source capabilities message with two PDOs.
+func testMessage() pdmsg.Message {
+	var m pdmsg.Message
+	m.SetType(pdmsg.TypeSourceCap)
+	m.SetDataObjectCount(2)
+	m.Data[0], m.Data[1] = 0x0801912c, 0x0002d12c
+	return m
+}
+
+func TestAlertRxTxAllocs(t *testing.T) {
+	f, d := newTestController(t)
+	want := testMessage()
+	var rxErr, txErr error
+	var got pdmsg.Message
+	allocs := testing.AllocsPerRun(100, func() {
+		d.receive(want)
+		if _, err := f.Alert(); err != nil {
+			rxErr = err
+		}
+		if got, rxErr = f.Rx(); rxErr != nil {
+			return
+		}
+		txErr = f.Tx(want)
+	})
+	if rxErr != nil || txErr != nil {
+		t.Fatalf("rx error: %v, tx error: %v", rxErr, txErr)
+	}
+	if got != want {
+		t.Fatalf("got message %+v, want %+v", got, want)
+	}
+	if allocs != 0 {
+		t.Errorf("got %.1f allocations per Alert/Rx/Tx cycle, want 0", allocs)
+	}
+}
+
+func TestQueueSize(t *testing.T) {
+	for _, c := range []struct {
+		size, want int
+	}{
+		{-1, 1},
+		{0, 1},
+		{3, 3},
+	} {
+		f, d := newTestController(t, WithQueueSize(c.size))
+		const n = 5
+		for i := 0; i < n; i++ {
+			m := testMessage()
+			m.SetID(uint8(i))
+			d.receive(m)
+		}
+		if _, err := f.Alert(); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.DroppedMessages(); got != n-uint32(c.want) {
+			t.Errorf("size %d: got %d dropped messages, want %d", c.size, got, n-c.want)
+		}
+		for i := 0; i < c.want; i++ {
+			m, err := f.Rx()
+			if err != nil {
+				t.Fatalf("size %d: Rx() %d: %v", c.size, i, err)
+			}
+			if m.ID() != uint8(i) {
+				t.Errorf("size %d: got ID %d, want %d", c.size, m.ID(), i)
+			}
+		}
+		if _, err := f.Rx(); err != typec.ErrRxEmpty {
+			t.Errorf("size %d: got Rx() error %v on empty queue, want %v", c.size, err, typec.ErrRxEmpty)
+		}
+	}
+}
+
+func TestAlertIdleTransfers(t *testing.T) {
+	f, d := newTestController(t)
+	if _, err := f.Alert(); err != nil {
+		t.Fatal(err)
+	}
+	d.transfers, d.read = 0, 0
+	e, err := f.Alert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e != typec.EventNone {
+		t.Errorf("got event %s, want none", e)
+	}
+	if d.transfers != 1 {
+		t.Errorf("got %d I2C transfers with no pending interrupts, want 1", d.transfers)
+	}
+	if d.read != 5 {
+		t.Errorf("got %d bytes read with no pending interrupts, want 5", d.read)
+	}
+}
+
+func TestInitWithVBus(t *testing.T) {
+	for _, c := range []struct {
+		bcLevel uint8
+		want    typec.Event
+	}{
+		{0, typec.EventAttached},
+		{1, typec.EventAttached | typec.EventPower0A5},
+		{2, typec.EventAttached | typec.EventPower1A5},
+		{3, typec.EventAttached | typec.EventPower3A0},
+	} {
+		d := &fakeI2C{}
+		d.regs[regStatus0] = regStatus0VBusOK | c.bcLevel
+		f := New(d, FUSB302BMPX)
+		if err := f.Init(); err != nil {
+			t.Fatal(err)
+		}
+		e, err := f.Alert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e != c.want {
+			t.Errorf("BC_LVL %d: got events %#x, want %#x", c.bcLevel, uint16(e), uint16(c.want))
+		}
+		if e, _ := f.Alert(); e != typec.EventNone {
+			t.Errorf("BC_LVL %d: got events %#x on second alert, want none", c.bcLevel, uint16(e))
+		}
+	}
+}
+
+func TestSetDataRole(t *testing.T) {
+	f, d := newTestController(t)
+	d.regs[regSwitches1] = regSwitches1SpecRev1 | regSwitches1AutoGCRC | regSwitches1TxCC1En
+	for _, c := range []struct {
+		role pdmsg.DataRole
+		want uint8
+	}{
+		{pdmsg.DataRoleDFP, regSwitches1SpecRev1 | regSwitches1DataRole | regSwitches1AutoGCRC | regSwitches1TxCC1En},
+		{pdmsg.DataRoleUFP, regSwitches1SpecRev1 | regSwitches1AutoGCRC | regSwitches1TxCC1En},
+	} {
+		if err := f.SetDataRole(c.role); err != nil {
+			t.Fatal(err)
+		}
+		if got := d.regs[regSwitches1]; got != c.want {
+			t.Errorf("data role %d: got Switches1 %08b, want %08b", c.role, got, c.want)
+		}
+	}
+}
+
+func BenchmarkAlertIdle(b *testing.B) {
+	f, d := newTestController(b)
+	d.transfers = 0
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Alert(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(d.transfers)/float64(b.N), "transfers/op")
+}
+
+func BenchmarkAlertRx(b *testing.B) {
+	f, d := newTestController(b)
+	m := testMessage()
+	d.transfers = 0
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.receive(m)
+		if _, err := f.Alert(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := f.Rx(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(d.transfers)/float64(b.N), "transfers/op")
+}
+
+func TestMPNI2CAddress(t *testing.T) {
+	for _, c := range []struct {
+		mpn  MPN
+		addr uint8
+	}{
+		{FUSB302BUCX, 0x22},
+		{FUSB302BMPX, 0x22},
+		{FUSB302VMPX, 0x22},
+		{FUSB302B01MPX, 0x23},
+		{FUSB302B10MPX, 0x24},
+		{FUSB302B11MPX, 0x25},
+		{0, 0},
+		{FUSB302B11MPX + 1, 0},
+		{0xff, 0},
+	} {
+		if got := c.mpn.I2CAddress(); got != c.addr {
+			t.Errorf("MPN %d: got address %#02x, want %#02x", c.mpn, got, c.addr)
+		}
+		if got := New(nil, c.mpn).regs.Addr; got != uint16(c.addr) {
+			t.Errorf("MPN %d: got controller address %#02x, want %#02x", c.mpn, got, c.addr)
+		}
+	}
+	if got := New(nil, FUSB302B01MPX, WithAddress(0x70)).regs.Addr; got != 0x70 {
+		t.Errorf("got overridden address %#02x, want 0x70", got)
+	}
+}
@@ -0,0 +1,293 @@
+// Package husb238 implements type-C port controller driver for HUSB238 power
+// delivery trigger from Hynetek.
+//
+// HUSB238 runs its own protocol layer and only supports fixed supply PDOs
+// which are selected by voltage over I2C. This driver synthesizes the messages
+// the policy engine expects from the source based on the controller status:
+//
+//   - Source capabilities message is synthesized from the fixed PDOs detected
+//     by the controller on attach and in response to Get_Source_Cap.
+//   - Request messages for fixed supply PDOs select the requested voltage and
+//     are immediately followed by a synthesized Accept message. PS_RDY is
+//     synthesized once the controller reports a successful negotiation of
+//     the requested voltage. If the source rejects the request, no response
+//     is synthesized and the policy engine times out.
+//
+// As such, the following limitations apply:
+//
+//   - Control messages other than Get_Source_Cap and data messages other than
+//     requests for fixed supply PDOs cannot be sent and fail with
+//     typec.ErrTxFailed.
+//   - Requested current is ignored as the controller always requests the
+//     maximum current of the selected PDO.
+package husb238
+
+import (
+	"sync"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver"
+)
+
+// Address is the I2C address of HUSB238.
+const Address = 0x08
+
+// HUSB238 represents a type-C port controller for HUSB238 IC. All its methods
+// may be called concurrently from multiple goroutines.
+type HUSB238 struct {
+	regs tcpcdriver.Regs
+
+	mu       sync.Mutex // guards access to the hardware and buffers
+	attached bool
+	nextID   uint8 // message ID of the next synthesized message
+	pending  uint8 // voltage selection of the request in progress, 0 if none
+
+	// Voltage selection of each PDO in the last synthesized source
+	// capabilities message.
+	pdoSel [len(pdoVoltages)]uint8
+
+	// We use go channel here as a fixed size queue and drop messages when
+	// queue is full.
+	msgs chan pdmsg.Message
+
+	// Buffers defined once here to avoid heap allocations.
+	status [regStatusCount]byte
+}
+
+const msgQueueSize = 10
+
+// New creates a new controller and allocates all necessary memory for all
+// future operations.
+func New(port tcpcdriver.I2C) *HUSB238 {
+	return &HUSB238{
+		regs: tcpcdriver.Regs{I2C: port, Addr: Address},
+		msgs: make(chan pdmsg.Message, msgQueueSize),
+	}
+}
+
+// Init initializes the driver state. HUSB238 itself needs no initialization.
+func (h *HUSB238) Init() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.attached = false
+	h.pending = 0
+
+	// Flush the receive queue
+
+FlushReceiveQueue:
+	for {
+		select {
+		case <-h.msgs:
+		default:
+			break FlushReceiveQueue
+		}
+	}
+	return nil
+}
+
+// Tx transmits a message. Request messages for fixed supply PDOs select the
+// corresponding voltage and Get_Source_Cap is answered from the PDOs detected
+// by the controller. All other messages fail with typec.ErrTxFailed.
+func (h *HUSB238) Tx(m pdmsg.Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if m.SOP != pdmsg.SOPPort {
+		return typec.ErrTxFailed
+	}
+	if !m.IsData() {
+		if m.Type() != pdmsg.TypeGetSourceCap {
+			return typec.ErrTxFailed
+		}
+		return h.rxSourceCap()
+	}
+	if m.IsExtended() || m.Type() != pdmsg.TypeRequest {
+		return typec.ErrTxFailed
+	}
+	pos := pdmsg.RequestDO(m.Data[0]).SelectedObjectPosition()
+	if pos == 0 || int(pos) > len(h.pdoSel) || h.pdoSel[pos-1] == 0 {
+		return typec.ErrTxFailed
+	}
+	sel := h.pdoSel[pos-1]
+	if err := h.regs.WriteReg(regSrcPDO, pdoSelectCodes[sel-1]<<regSrcPDOSelectPos); err != nil {
+		return err
+	}
+	if err := h.regs.WriteReg(regGoCommand, goCommandRequest); err != nil {
+		return err
+	}
+	h.pending = sel
+	h.queue(h.message(pdmsg.TypeAccept))
+	return nil
+}
+
+// message returns a message of type t from the source with the next message
+// ID.
+func (h *HUSB238) message(t pdmsg.Type) pdmsg.Message {
+	var m pdmsg.Message
+	m.SetPowerRole(pdmsg.PowerRoleSource)
+	m.SetDataRole(pdmsg.DataRoleDFP)
+	m.SetRevision(pdmsg.Revision30)
+	m.SetType(t)
+	m.SetID(h.nextID)
+	h.nextID = (h.nextID + 1) % 8
+	return m
+}
+
+// queue queues a synthesized message without blocking (ie drop if queue is
+// full which should be rare).
+func (h *HUSB238) queue(m pdmsg.Message) {
+	select {
+	case h.msgs <- m:
+	default:
+	}
+}
+
+// rxSourceCap reads the PDOs detected by the controller and queues them as a
+// source capabilities message. Nothing is queued if no PDO is detected.
+func (h *HUSB238) rxSourceCap() error {
+	if err := h.regs.ReadRegs(regStatus0, h.status[:]); err != nil {
+		return err
+	}
+	m := h.message(pdmsg.TypeSourceCap)
+	var n uint8
+	for i, v := range pdoVoltages {
+		h.pdoSel[i] = 0
+		b := h.status[regSrcPDO5V+uint8(i)-regStatus0]
+		if b&regSrcPDODetected == 0 {
+			continue
+		}
+		p := pdmsg.NewFixedSupplyPDO()
+		p.SetVoltage(v)
+		p.SetMaxCurrent(pdoCurrents[b&regSrcPDOCurrentMask])
+		m.Data[n] = uint32(p)
+		h.pdoSel[n] = uint8(i) + 1
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	m.SetDataObjectCount(n)
+	h.queue(m)
+	return nil
+}
+
+// Rx returns a received message.
+func (h *HUSB238) Rx() (pdmsg.Message, error) {
+	select {
+	case n := <-h.msgs:
+		return n, nil
+	default:
+		return pdmsg.Message{}, typec.ErrRxEmpty
+	}
+}
+
+// SendReset sends hard reset signal.
+func (h *HUSB238) SendReset() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = 0
+	return h.regs.WriteReg(regGoCommand, goCommandHardReset)
+}
+
+// Alert checks the controller status and returns any event generated as a
+// result.
+func (h *HUSB238) Alert() (e typec.Event, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err = h.regs.ReadRegs(regStatus0, h.status[:2]); err != nil {
+		return
+	}
+	st0 := h.status[0]
+	st1 := h.status[1]
+
+	// Attach and detach
+
+	attached := st1&regStatus1Attach != 0
+	if attached != h.attached {
+		h.attached = attached
+		if !attached {
+			h.pending = 0
+			e.Add(typec.EventDetached)
+			return
+		}
+		e.Add(typec.EventAttached)
+
+		// Determine host current capabilities at 5V
+
+		switch st1 & regStatus1Current5VMask {
+		case regStatus1Current5V1A5:
+			e.Add(typec.EventPower1A5)
+		case regStatus1Current5V2A4, regStatus1Current5V3A:
+			e.Add(typec.EventPower3A0)
+		default:
+			e.Add(typec.EventPower0A5)
+		}
+
+		if err = h.rxSourceCap(); err != nil {
+			return
+		}
+	}
+
+	// Request completion
+
+	if h.pending != 0 && (st1>>regStatus1ResponsePos)&regStatus1ResponseMask == responseSuccess &&
+		st0>>regStatus0VoltagePos == h.pending {
+		h.pending = 0
+		h.queue(h.message(pdmsg.TypePSReady))
+	}
+
+	if len(h.msgs) > 0 {
+		e.Add(typec.EventRx)
+	}
+	return
+}
+
+// Voltages in mV of the fixed supply PDOs supported by the controller, in
+// order of their selection value starting at 1, which is the encoding of the
+// voltage field of PD_STATUS0.
+var pdoVoltages = [...]uint16{5000, 9000, 12000, 15000, 18000, 20000}
+
+// PDO_SELECT field codes of SRC_PDO register for each of pdoVoltages, which
+// unlike PD_STATUS0 skip codes 4 to 7.
+var pdoSelectCodes = [len(pdoVoltages)]uint8{0b0001, 0b0010, 0b0011, 0b1000, 0b1001, 0b1010}
+
+// Currents in mA indexed by the current field of the PDO registers.
+var pdoCurrents = [...]uint16{
+	500, 700, 1000, 1250, 1500, 1750, 2000, 2250,
+	2500, 2750, 3000, 3250, 3500, 4000, 4500, 5000,
+}
+
+const (
+	goCommandRequest   = 0b00001
+	goCommandHardReset = 0b10000
+
+	responseSuccess = 0b001
+)
+
+const (
+	regStatus0           = 0x00
+	regStatus0VoltagePos = 4
+
+	regStatus1              = 0x01
+	regStatus1Attach        = 1 << 6
+	regStatus1ResponsePos   = 3
+	regStatus1ResponseMask  = 0b111
+	regStatus1Current5VMask = 0b11
+	regStatus1Current5V1A5  = 0b01
+	regStatus1Current5V2A4  = 0b10
+	regStatus1Current5V3A   = 0b11
+
+	regSrcPDO5V          = 0x02
+	regSrcPDODetected    = 1 << 7
+	regSrcPDOCurrentMask = 0b1111
+
+	regStatusCount = regSrcPDO5V + uint8(len(pdoVoltages)) - regStatus0
+
+	regSrcPDO          = 0x08
+	regSrcPDOSelectPos = 4
+
+	regGoCommand = 0x09
+)
@@ -0,0 +1,107 @@
+package tcpcdriver
+
+import (
+	"hash/crc32"
+
+	"github.com/oxplot/go-typec/pdmsg"
+)
+
+// Symbol is a 5 bit line symbol as transmitted on the CC line, before BMC
+// encoding. Bits are transmitted least significant bit first.
+type Symbol uint8
+
+// K-code symbols used in ordered sets and message framing.
+const (
+	SymbolSync1 Symbol = 0b11000
+	SymbolSync2 Symbol = 0b10001
+	SymbolSync3 Symbol = 0b00110
+	SymbolRST1  Symbol = 0b00111
+	SymbolRST2  Symbol = 0b11001
+	SymbolEOP   Symbol = 0b01101
+)
+
+// OrderedSet is a sequence of K-code symbols that starts a packet or signals
+// a reset.
+type OrderedSet [4]Symbol
+
+// Ordered sets defined by the standard.
+var (
+	OrderedSetSOP            = OrderedSet{SymbolSync1, SymbolSync1, SymbolSync1, SymbolSync2}
+	OrderedSetSOPPrime       = OrderedSet{SymbolSync1, SymbolSync1, SymbolSync3, SymbolSync3}
+	OrderedSetSOPDoublePrime = OrderedSet{SymbolSync1, SymbolSync3, SymbolSync1, SymbolSync3}
+	OrderedSetHardReset      = OrderedSet{SymbolRST1, SymbolRST1, SymbolRST1, SymbolRST2}
+	OrderedSetCableReset     = OrderedSet{SymbolRST1, SymbolSync1, SymbolRST1, SymbolSync3}
+)
+
+// SOPOrderedSet returns the ordered set for the start of packet type s.
+func SOPOrderedSet(s pdmsg.SOP) OrderedSet {
+	switch s {
+	case pdmsg.SOPPrime:
+		return OrderedSetSOPPrime
+	case pdmsg.SOPDoublePrime:
+		return OrderedSetSOPDoublePrime
+	default:
+		return OrderedSetSOP
+	}
+}
+
+var enc4b5b = [16]Symbol{
+	0b11110, 0b01001, 0b10100, 0b10101, 0b01010, 0b01011, 0b01110, 0b01111,
+	0b10010, 0b10011, 0b10110, 0b10111, 0b11010, 0b11011, 0b11100, 0b11101,
+}
+
+// Encode4b5b returns the data symbol for the lower 4 bits of n.
+func Encode4b5b(n uint8) Symbol {
+	return enc4b5b[n&0b1111]
+}
+
+// Decode4b5b returns the 4 bit value of a data symbol. ok is false if s is not
+// a data symbol.
+func Decode4b5b(s Symbol) (n uint8, ok bool) {
+	for i, v := range enc4b5b {
+		if v == s {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+// MaxFrameSymbols is the maximum number of symbols in a framed message, which
+// includes the ordered set, the header, the data objects, the CRC and the EOP.
+const MaxFrameSymbols = 4 + 2*(pdmsg.MaxMessageBytes+4) + 1
+
+// FrameMessage encodes m into symbols ready to be BMC encoded and transmitted,
+// starting with the ordered set os and ending with EOP. The CRC is calculated
+// and appended to the message. The preamble is not included. Returns the number
+// of symbols written to dst.
+//
+// dst must be at least MaxFrameSymbols long in order to accomodate the largest
+// possible message.
+func FrameMessage(os OrderedSet, m pdmsg.Message, dst []Symbol) int {
+	var b [pdmsg.MaxMessageBytes + 4]byte
+	l := int(m.ToBytes(b[:]))
+	crc := crc32.ChecksumIEEE(b[:l])
+	b[l] = byte(crc)
+	b[l+1] = byte(crc >> 8)
+	b[l+2] = byte(crc >> 16)
+	b[l+3] = byte(crc >> 24)
+	l += 4
+
+	n := copy(dst, os[:])
+	for _, v := range b[:l] {
+		dst[n] = Encode4b5b(v)
+		dst[n+1] = Encode4b5b(v >> 4)
+		n += 2
+	}
+	dst[n] = SymbolEOP
+	return n + 1
+}
+
+// MatchGoodCRC returns true if received is the GoodCRC acknowledging sent, i.e.
+// it's a GoodCRC control message with the same SOP and message ID as sent. Port
+// controllers that leave GoodCRC handling to the driver use this to determine
+// whether the transmission of a message was successful.
+func MatchGoodCRC(sent, received pdmsg.Message) bool {
+	return !received.IsData() && received.Type() == pdmsg.TypeGoodCRC &&
+		received.SOP == sent.SOP && received.ID() == sent.ID()
+}
@@ -0,0 +1,118 @@
+package tcpcdriver
+
+import (
+	"testing"
+
+	"github.com/oxplot/go-typec/pdmsg"
+)
+
+// dataSymbols are the 4b5b data symbols of values 0 to 15 as listed in the
+// specification.
+var dataSymbols = [16]Symbol{
+	0b11110, 0b01001, 0b10100, 0b10101, 0b01010, 0b01011, 0b01110, 0b01111,
+	0b10010, 0b10011, 0b10110, 0b10111, 0b11010, 0b11011, 0b11100, 0b11101,
+}
+
+func TestEncode4b5b(t *testing.T) {
+	for n, want := range dataSymbols {
+		if got := Encode4b5b(uint8(n)); got != want {
+			t.Errorf("Encode4b5b(%#x): got %05b, want %05b", n, got, want)
+		}
+		// Upper bits are ignored
+		if got := Encode4b5b(uint8(n) | 0xf0); got != want {
+			t.Errorf("Encode4b5b(%#x): got %05b, want %05b", n|0xf0, got, want)
+		}
+	}
+}
+
+func TestDecode4b5b(t *testing.T) {
+	for want, s := range dataSymbols {
+		if got, ok := Decode4b5b(s); !ok || got != uint8(want) {
+			t.Errorf("Decode4b5b(%05b): got %#x, %v, want %#x, true", s, got, ok, want)
+		}
+	}
+	for _, s := range []Symbol{SymbolSync1, SymbolSync2, SymbolSync3, SymbolRST1, SymbolRST2, SymbolEOP, 0b00000} {
+		if got, ok := Decode4b5b(s); ok {
+			t.Errorf("Decode4b5b(%05b): got %#x, true, want not ok", s, got)
+		}
+	}
+}
+
+// testRequest returns the request for 3A from the second PDO, which serializes
+// to 82102cb10420 and whose CRC is 0xf320e29f.
+func testRequest() pdmsg.Message {
+	var m pdmsg.Message
+	m.Header = 0x1082
+	m.Data[0] = 0x2004b12c
+	return m
+}
+
+func TestFrameMessage(t *testing.T) {
+	for _, c := range []struct {
+		sop pdmsg.SOP
+		os  OrderedSet
+	}{
+		{pdmsg.SOPPort, OrderedSet{SymbolSync1, SymbolSync1, SymbolSync1, SymbolSync2}},
+		{pdmsg.SOPPrime, OrderedSet{SymbolSync1, SymbolSync1, SymbolSync3, SymbolSync3}},
+		{pdmsg.SOPDoublePrime, OrderedSet{SymbolSync1, SymbolSync3, SymbolSync1, SymbolSync3}},
+	} {
+		var want []Symbol
+		want = append(want, c.os[:]...)
+		for _, b := range []byte{0x82, 0x10, 0x2c, 0xb1, 0x04, 0x20, 0x9f, 0xe2, 0x20, 0xf3} {
+			want = append(want, dataSymbols[b&0xf], dataSymbols[b>>4])
+		}
+		want = append(want, SymbolEOP)
+
+		var dst [MaxFrameSymbols]Symbol
+		n := FrameMessage(SOPOrderedSet(c.sop), testRequest(), dst[:])
+		if n != len(want) {
+			t.Fatalf("SOP %d: got %d symbols, want %d", c.sop, n, len(want))
+		}
+		for i := range want {
+			if dst[i] != want[i] {
+				t.Errorf("SOP %d: got symbol %d %05b, want %05b", c.sop, i, dst[i], want[i])
+			}
+		}
+	}
+}
+
+func TestFrameMessageMaxLength(t *testing.T) {
+	var m pdmsg.Message
+	m.SetType(pdmsg.TypeSourceCap)
+	m.SetDataObjectCount(pdmsg.MaxDataObjects)
+	var dst [MaxFrameSymbols]Symbol
+	if n := FrameMessage(OrderedSetSOP, m, dst[:]); n != 4+2*(2+4*pdmsg.MaxDataObjects+4)+1 {
+		t.Errorf("got %d symbols, want %d", n, 4+2*(2+4*pdmsg.MaxDataObjects+4)+1)
+	}
+}
+
+func TestMatchGoodCRC(t *testing.T) {
+	goodCRC := func(sop pdmsg.SOP, id uint8) pdmsg.Message {
+		var m pdmsg.Message
+		m.SOP = sop
+		m.SetType(pdmsg.TypeGoodCRC)
+		m.SetID(id)
+		return m
+	}
+	sent := testRequest()
+	sent.SetID(3)
+	sourceCap := goodCRC(pdmsg.SOPPort, 3)
+	sourceCap.SetDataObjectCount(1) // data message of the same type value
+	accept := goodCRC(pdmsg.SOPPort, 3)
+	accept.SetType(pdmsg.TypeAccept)
+	for _, c := range []struct {
+		name     string
+		received pdmsg.Message
+		want     bool
+	}{
+		{"match", goodCRC(pdmsg.SOPPort, 3), true},
+		{"other ID", goodCRC(pdmsg.SOPPort, 4), false},
+		{"other SOP", goodCRC(pdmsg.SOPPrime, 3), false},
+		{"data message", sourceCap, false},
+		{"other control message", accept, false},
+	} {
+		if got := MatchGoodCRC(sent, c.received); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
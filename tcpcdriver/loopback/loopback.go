@@ -0,0 +1,215 @@
+// Package loopback implements a type-C port controller which is attached to a
+// simulated power source instead of hardware, to try out the policy engine and
+// device policy managers without a port controller, e.g. in demos and
+// integration tests.
+//
+// The simulated source behaves as follows:
+//
+//   - On Init (i.e. attach and after hard reset), it reports attach with 3A Rp
+//     and sends its source capabilities.
+//   - It answers Get_Source_Cap with its source capabilities and Soft_Reset with
+//     Accept followed by its source capabilities.
+//   - It answers valid requests according to the response set with
+//     SetResponse, which is Accept followed by PS_RDY by default. Requests for
+//     a PDO it does not offer, or for more than the PDO offers, are rejected.
+//   - It answers all other control messages with Not_Supported and ignores all
+//     other data and extended messages.
+package loopback
+
+import (
+	"sync"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+)
+
+// Response is the response of the simulated source to valid requests.
+type Response uint8
+
+// Responses to valid requests.
+const (
+	ResponseAccept Response = iota // Accept followed by PS_RDY
+	ResponseReject                 // Reject
+	ResponseWait                   // Wait
+)
+
+// PortController is a port controller attached to a simulated source. All its
+// methods may be called concurrently from multiple goroutines.
+type PortController struct {
+	mu       sync.Mutex
+	caps     [pdmsg.MaxDataObjects]pdmsg.PDO
+	capsLen  uint8
+	response Response
+	events   typec.Event
+	nextID   uint8 // message ID of the next message sent by the source
+
+	// We use go channel here as a fixed size queue and drop messages when
+	// queue is full.
+	msgs chan pdmsg.Message
+}
+
+const msgQueueSize = 10
+
+// New creates a new port controller attached to a source offering the given
+// capabilities. Only the first pdmsg.MaxDataObjects PDOs are used, and the
+// first PDO should be a 5V fixed supply PDO as required by the standard.
+func New(caps ...pdmsg.PDO) *PortController {
+	p := &PortController{
+		msgs: make(chan pdmsg.Message, msgQueueSize),
+	}
+	p.capsLen = uint8(copy(p.caps[:], caps))
+	return p
+}
+
+// SetResponse sets the response of the source to valid requests.
+func (p *PortController) SetResponse(r Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.response = r
+}
+
+// Init simulates attach to the source, which then sends its capabilities.
+func (p *PortController) Init() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Flush the receive queue
+
+FlushReceiveQueue:
+	for {
+		select {
+		case <-p.msgs:
+		default:
+			break FlushReceiveQueue
+		}
+	}
+
+	p.nextID = 0
+	p.events = typec.EventAttached | typec.EventPower3A0
+	p.queueSourceCap()
+	return nil
+}
+
+// Tx passes the message to the source which queues its response.
+func (p *PortController) Tx(m pdmsg.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if m.SOP != pdmsg.SOPPort {
+		return typec.ErrTxFailed
+	}
+	if m.IsExtended() {
+		return nil
+	}
+	if m.IsData() {
+		if m.Type() == pdmsg.TypeRequest {
+			p.respond(pdmsg.RequestDO(m.Data[0]))
+		}
+		return nil
+	}
+	switch m.Type() {
+	case pdmsg.TypeGetSourceCap:
+		p.queueSourceCap()
+	case pdmsg.TypeSoftReset:
+		p.nextID = 0
+		p.queue(p.message(pdmsg.TypeAccept))
+		p.queueSourceCap()
+	default:
+		p.queue(p.message(pdmsg.TypeNotSupported))
+	}
+	return nil
+}
+
+// respond queues the response of the source to a request for rdo.
+func (p *PortController) respond(rdo pdmsg.RequestDO) {
+	pos := rdo.SelectedObjectPosition()
+	if pos == 0 || pos > p.capsLen || !validRequest(rdo, p.caps[pos-1]) {
+		p.queue(p.message(pdmsg.TypeReject))
+		return
+	}
+	switch p.response {
+	case ResponseReject:
+		p.queue(p.message(pdmsg.TypeReject))
+	case ResponseWait:
+		p.queue(p.message(pdmsg.TypeWait))
+	default:
+		p.queue(p.message(pdmsg.TypeAccept))
+		p.queue(p.message(pdmsg.TypePSReady))
+	}
+}
+
+// validRequest returns true if rdo requests no more than pdo offers.
+func validRequest(rdo pdmsg.RequestDO, pdo pdmsg.PDO) bool {
+	switch pdo.Type() {
+	case pdmsg.PDOTypeFixedSupply:
+		return rdo.FixedOperatingCurrent() <= pdmsg.FixedSupplyPDO(pdo).MaxCurrent()
+	case pdmsg.PDOTypeVariableSupply:
+		return rdo.FixedOperatingCurrent() <= pdmsg.VariableSupplyPDO(pdo).MaxCurrent()
+	case pdmsg.PDOTypeBattery:
+		return rdo.BatteryOperatingPower() <= pdmsg.BatteryPDO(pdo).MaxPower()
+	case pdmsg.PDOTypePPS:
+		s := pdmsg.PPSPDO(pdo)
+		v := rdo.PPSOutputVoltage()
+		return v >= s.MinVoltage() && v <= s.MaxVoltage() && rdo.PPSOutputCurrent() <= s.MaxCurrent()
+	}
+	return false
+}
+
+// message returns a message of type t from the source with the next message
+// ID.
+func (p *PortController) message(t pdmsg.Type) pdmsg.Message {
+	var m pdmsg.Message
+	m.SetPowerRole(pdmsg.PowerRoleSource)
+	m.SetDataRole(pdmsg.DataRoleDFP)
+	m.SetRevision(pdmsg.Revision30)
+	m.SetType(t)
+	m.SetID(p.nextID)
+	p.nextID = (p.nextID + 1) % 8
+	return m
+}
+
+// queueSourceCap queues the source capabilities message.
+func (p *PortController) queueSourceCap() {
+	m := p.message(pdmsg.TypeSourceCap)
+	m.SetDataObjectCount(p.capsLen)
+	for i, c := range p.caps[:p.capsLen] {
+		m.Data[i] = uint32(c)
+	}
+	p.queue(m)
+}
+
+// queue queues a message from the source without blocking (ie drop if queue is
+// full which should be rare).
+func (p *PortController) queue(m pdmsg.Message) {
+	select {
+	case p.msgs <- m:
+	default:
+	}
+}
+
+// Rx returns the next message sent by the source.
+func (p *PortController) Rx() (pdmsg.Message, error) {
+	select {
+	case n := <-p.msgs:
+		return n, nil
+	default:
+		return pdmsg.Message{}, typec.ErrRxEmpty
+	}
+}
+
+// SendReset does nothing as the source comes back from hard reset when the
+// policy engine calls Init.
+func (p *PortController) SendReset() error {
+	return nil
+}
+
+// Alert returns the pending events.
+func (p *PortController) Alert() (e typec.Event, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, p.events = p.events, typec.EventNone
+	if len(p.msgs) > 0 {
+		e.Add(typec.EventRx)
+	}
+	return
+}
@@ -0,0 +1,135 @@
+package loopback
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpe"
+)
+
+// fixedPDO returns a fixed supply PDO offering voltage v in mV and current c
+// in mA.
+func fixedPDO(v, c uint16) pdmsg.PDO {
+	p := pdmsg.NewFixedSupplyPDO()
+	p.SetVoltage(v)
+	p.SetMaxCurrent(c)
+	return pdmsg.PDO(p)
+}
+
+// startEngine runs a policy engine on p until the test ends, which requests
+// current in mA from the last PDO offered. The states entered by the engine
+// are sent to the returned channel.
+func startEngine(t *testing.T, p *PortController, current uint16) (*tcpe.PolicyEngine, <-chan string) {
+	states := make(chan string, 100)
+	pe := tcpe.New(p,
+		tcpe.WithCapabilityEvaluator(tcpe.CapabilityEvaluatorFunc(func(pdos []pdmsg.PDO) pdmsg.RequestDO {
+			rdo := pdmsg.EmptyRequestDO
+			rdo.SetSelectedObjectPosition(uint8(len(pdos)))
+			rdo.SetFixedOperatingCurrent(current)
+			rdo.SetFixedMaxOperatingCurrent(current)
+			return rdo
+		})),
+		tcpe.WithStateObserver(func(from, to string) {
+			select {
+			case states <- to:
+			default:
+			}
+		}),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pe.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return pe, states
+}
+
+// waitStates waits until the policy engine enters the given states in order
+// and fails if it enters state fail in the meantime.
+func waitStates(t *testing.T, states <-chan string, fail string, want ...string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for len(want) > 0 {
+		select {
+		case s := <-states:
+			if s == fail {
+				t.Fatalf("entered %s while waiting for %s", s, want[0])
+			}
+			if s == want[0] {
+				want = want[1:]
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %s", want[0])
+		}
+	}
+}
+
+// checkContract checks that the contract in effect is for voltage in mV, or
+// that there is none if voltage is 0.
+func checkContract(t *testing.T, pe *tcpe.PolicyEngine, voltage uint16) {
+	t.Helper()
+	pdo, _, ok := pe.Contract()
+	if voltage == 0 {
+		if ok {
+			t.Errorf("got contract for %#08x, want none", uint32(pdo))
+		}
+		return
+	}
+	if !ok {
+		t.Fatalf("got no contract, want %dmV", voltage)
+	}
+	if v := pdmsg.FixedSupplyPDO(pdo).Voltage(); v != voltage {
+		t.Errorf("got contract at %dmV, want %dmV", v, voltage)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	p := New(fixedPDO(5000, 3000), fixedPDO(9000, 2000))
+	pe, states := startEngine(t, p, 1000)
+	waitStates(t, states, "sink-hard-reset", "sink-select-cap", "sink-transition-sink", "sink-ready")
+	checkContract(t, pe, 9000)
+}
+
+func TestRejectAndWait(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		response Response
+	}{
+		{"reject", ResponseReject},
+		{"wait", ResponseWait},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p := New(fixedPDO(5000, 3000), fixedPDO(9000, 2000))
+			pe, states := startEngine(t, p, 1000)
+			waitStates(t, states, "sink-hard-reset", "sink-ready")
+
+			// With an explicit contract, the sink goes back to ready and
+			// keeps the contract.
+
+			p.SetResponse(c.response)
+			pe.RequestSourceCapabilities()
+			waitStates(t, states, "sink-hard-reset", "sink-select-cap", "sink-ready")
+			checkContract(t, pe, 9000)
+			if n := pe.Stats().Evaluations; n != 2 {
+				t.Errorf("got %d evaluations, want 2", n)
+			}
+		})
+	}
+}
+
+func TestRejectInvalidRequest(t *testing.T) {
+	// The source rejects requests for more than it offers, which with no
+	// contract sends the sink back to waiting for capabilities.
+
+	p := New(fixedPDO(5000, 3000), fixedPDO(9000, 2000))
+	pe, states := startEngine(t, p, 3000)
+	waitStates(t, states, "sink-ready", "sink-select-cap", "sink-wait-for-cap")
+	checkContract(t, pe, 0)
+}
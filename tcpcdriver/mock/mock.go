@@ -0,0 +1,128 @@
+// Package mock implements a scriptable type-C port controller which can be
+// used to exercise policy engines and device policy managers without any
+// hardware.
+//
+// Messages and events are queued with QueueRx and QueueEvent, to be returned
+// by Rx and Alert respectively. Messages sent by the policy engine are recorded
+// and can be inspected with Sent. To simulate a port partner, a Tx handler can
+// be set with SetTxHandler to respond to messages as they are sent.
+package mock
+
+import (
+	"sync"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+)
+
+// PortController is a scriptable type-C port controller. All its methods may be
+// called concurrently from multiple goroutines.
+type PortController struct {
+	mu        sync.Mutex
+	events    typec.Event
+	rx        []pdmsg.Message
+	sent      []pdmsg.Message
+	txHandler func(pdmsg.Message) error
+	inits     int
+	resets    int
+}
+
+// New creates a new mock port controller with empty queues.
+func New() *PortController {
+	return &PortController{}
+}
+
+// QueueEvent queues events to be returned by the next call to Alert.
+func (p *PortController) QueueEvent(e typec.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events.Add(e)
+}
+
+// QueueRx queues messages to be returned by Rx, in order, and queues EventRx.
+func (p *PortController) QueueRx(m ...pdmsg.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rx = append(p.rx, m...)
+	p.events.Add(typec.EventRx)
+}
+
+// SetTxHandler sets the function called with each message passed to Tx. The
+// error returned by f is returned by Tx. f may call QueueRx and QueueEvent to
+// respond to the message. With no handler set, Tx always succeeds.
+func (p *PortController) SetTxHandler(f func(pdmsg.Message) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.txHandler = f
+}
+
+// Sent returns a copy of all messages passed to Tx so far.
+func (p *PortController) Sent() []pdmsg.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]pdmsg.Message(nil), p.sent...)
+}
+
+// Inits returns the number of times Init has been called.
+func (p *PortController) Inits() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inits
+}
+
+// Resets returns the number of times SendReset has been called.
+func (p *PortController) Resets() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resets
+}
+
+// Init records the call. Unlike real port controllers, queued messages and
+// events are kept so they can be set up before the policy engine starts.
+func (p *PortController) Init() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inits++
+	return nil
+}
+
+// Tx records the message and passes it to the Tx handler if set.
+func (p *PortController) Tx(m pdmsg.Message) error {
+	p.mu.Lock()
+	p.sent = append(p.sent, m)
+	f := p.txHandler
+	p.mu.Unlock()
+	if f != nil {
+		return f(m)
+	}
+	return nil
+}
+
+// Rx returns the next queued message or typec.ErrRxEmpty if none is left.
+func (p *PortController) Rx() (pdmsg.Message, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.rx) == 0 {
+		return pdmsg.Message{}, typec.ErrRxEmpty
+	}
+	m := p.rx[0]
+	p.rx = p.rx[1:]
+	return m, nil
+}
+
+// SendReset records the call.
+func (p *PortController) SendReset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resets++
+	return nil
+}
+
+// Alert returns and clears the queued events.
+func (p *PortController) Alert() (typec.Event, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.events
+	p.events = typec.EventNone
+	return e, nil
+}
@@ -0,0 +1,40 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+)
+
+func TestQueueRxOrder(t *testing.T) {
+	p := New()
+	var msgs [3]pdmsg.Message
+	for i := range msgs {
+		msgs[i].SetType(pdmsg.TypePing)
+		msgs[i].SetID(uint8(i))
+	}
+	p.QueueRx(msgs[0], msgs[1])
+	p.QueueRx(msgs[2])
+
+	// All queued messages are announced by a single EventRx
+
+	if e, err := p.Alert(); err != nil || e != typec.EventRx {
+		t.Fatalf("got Alert() = %v, %v, want %v, nil", e, err, typec.EventRx)
+	}
+	if e, err := p.Alert(); err != nil || e != typec.EventNone {
+		t.Fatalf("got second Alert() = %v, %v, want %v, nil", e, err, typec.EventNone)
+	}
+	for i, want := range msgs {
+		m, err := p.Rx()
+		if err != nil {
+			t.Fatalf("Rx() %d: %v", i, err)
+		}
+		if m.ID() != want.ID() {
+			t.Errorf("Rx() %d: got ID %d, want %d", i, m.ID(), want.ID())
+		}
+	}
+	if _, err := p.Rx(); err != typec.ErrRxEmpty {
+		t.Errorf("got Rx() error %v on empty queue, want %v", err, typec.ErrRxEmpty)
+	}
+}
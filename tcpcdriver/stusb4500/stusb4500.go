@@ -0,0 +1,323 @@
+// Package stusb4500 implements type-C port controller driver for STUSB4500
+// standalone sink controller from STMicroelectronics.
+//
+// STUSB4500 runs its own policy engine which negotiates power based on the sink
+// PDOs stored in its registers. This driver exposes the messages received by
+// the controller and translates requests sent by the policy engine to sink
+// PDOs followed by a renegotiation. As such, the following limitations apply:
+//
+//   - Only fixed supply PDOs can be requested. Requests for other PDO types
+//     fail with typec.ErrTxFailed.
+//   - Data messages other than requests cannot be sent.
+//   - SendReset resets the controller, which causes the source to detect a
+//     detach followed by an attach, instead of sending hard reset signal.
+package stusb4500
+
+import (
+	"sync"
+	"time"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver"
+)
+
+// DefaultAddress is the I2C address of STUSB4500 with both ADDR pins tied low.
+const DefaultAddress = 0x28
+
+// STUSB4500 represents a type-C port controller for STUSB4500 IC. All its
+// methods may be called concurrently from multiple goroutines.
+type STUSB4500 struct {
+	regs tcpcdriver.Regs
+
+	mu sync.Mutex // guards access to the hardware and buffers
+
+	// Last source capabilities message received, used to translate requests
+	// to sink PDOs.
+	sourceCapMsg pdmsg.Message
+
+	// We use go channel here as a fixed size queue and drop messages when
+	// queue is full.
+	msgs chan pdmsg.Message
+
+	// Buffers defined once here to avoid heap allocations.
+	status [regStatusCount]byte
+	rxb    [pdmsg.MaxMessageBytes]byte
+}
+
+const msgQueueSize = 10
+
+// Option configures the controller at creation time.
+type Option func(*STUSB4500)
+
+// WithAddress sets the I2C address of the controller. The default is
+// DefaultAddress.
+func WithAddress(addr uint16) Option {
+	return func(s *STUSB4500) {
+		s.regs.Addr = addr
+	}
+}
+
+// New creates a new controller and allocates all necessary memory for all
+// future operations.
+func New(port tcpcdriver.I2C, opts ...Option) *STUSB4500 {
+	s := &STUSB4500{
+		regs: tcpcdriver.Regs{I2C: port, Addr: DefaultAddress},
+		msgs: make(chan pdmsg.Message, msgQueueSize),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Init initializes the controller.
+func (s *STUSB4500) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sourceCapMsg = pdmsg.Message{}
+
+	// Flush the receive queue
+
+FlushReceiveQueue:
+	for {
+		select {
+		case <-s.msgs:
+		default:
+			break FlushReceiveQueue
+		}
+	}
+
+	// Unmask the alerts we handle
+
+	if err := s.regs.WriteReg(regAlertStatusMask, ^uint8(regAlertHardReset|regAlertCCDetection|regAlertHWFault|regAlertPRTStatus)); err != nil {
+		return err
+	}
+
+	// Clear all pending alerts
+
+	return s.regs.ReadRegs(regAlertStatus, s.status[:])
+}
+
+// Tx transmits a message. Control messages are sent as is. Request messages
+// for fixed supply PDOs are translated to a sink PDO followed by a soft reset
+// which causes the controller to renegotiate with the source.
+func (s *STUSB4500) Tx(m pdmsg.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.SOP != pdmsg.SOPPort {
+		return typec.ErrTxFailed
+	}
+	if !m.IsData() {
+		return s.sendControl(m.Type())
+	}
+	if m.Type() != pdmsg.TypeRequest {
+		return typec.ErrTxFailed
+	}
+
+	// Find the requested PDO
+
+	rdo := pdmsg.RequestDO(m.Data[0])
+	pos := rdo.SelectedObjectPosition()
+	if pos == 0 || pos > s.sourceCapMsg.DataObjectCount() {
+		return typec.ErrTxFailed
+	}
+	pdo := pdmsg.PDO(s.sourceCapMsg.Data[pos-1])
+	if pdo.Type() != pdmsg.PDOTypeFixedSupply {
+		return typec.ErrTxFailed
+	}
+
+	// Set the highest priority sink PDO to the requested one. The first sink
+	// PDO is always 5V.
+
+	snk := pdmsg.NewFixedSupplyPDO()
+	snk.SetVoltage(pdmsg.FixedSupplyPDO(pdo).Voltage())
+	snk.SetMaxCurrent(rdo.FixedOperatingCurrent())
+	pdoNumb := uint8(2)
+	if pos == 1 {
+		pdoNumb = 1
+	}
+	if err := s.regs.WriteRegs(regDPMSnkPDO1+(pdoNumb-1)*4, le32(s.rxb[:4], uint32(snk))); err != nil {
+		return err
+	}
+	if err := s.regs.WriteReg(regDPMPDONumb, pdoNumb); err != nil {
+		return err
+	}
+
+	return s.sendControl(pdmsg.TypeSoftReset)
+}
+
+// sendControl sends a control message of type t.
+func (s *STUSB4500) sendControl(t pdmsg.Type) error {
+	if err := s.regs.WriteReg(regTxHeaderLow, uint8(t)); err != nil {
+		return err
+	}
+	return s.regs.WriteReg(regPDCommandCtrl, pdCommandSendMessage)
+}
+
+func le32(b []byte, v uint32) []byte {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+	return b
+}
+
+// Rx returns a received message.
+func (s *STUSB4500) Rx() (pdmsg.Message, error) {
+	select {
+	case n := <-s.msgs:
+		return n, nil
+	default:
+		return pdmsg.Message{}, typec.ErrRxEmpty
+	}
+}
+
+// rx reads the last received message from the controller.
+func (s *STUSB4500) rx(m *pdmsg.Message) error {
+	if err := s.regs.ReadRegs(regRxHeader, s.rxb[:2]); err != nil {
+		return err
+	}
+	m.Header = uint16(s.rxb[1])<<8 | uint16(s.rxb[0])
+	l := m.DataObjectCount()
+	if l == 0 {
+		return nil
+	}
+	if err := s.regs.ReadRegs(regRxDataObj, s.rxb[:l*4]); err != nil {
+		return err
+	}
+	for i := uint8(0); i < l; i++ {
+		o := i * 4
+		m.Data[i] = uint32(s.rxb[o]) | uint32(s.rxb[o+1])<<8 | uint32(s.rxb[o+2])<<16 | uint32(s.rxb[o+3])<<24
+	}
+	return nil
+}
+
+// SendReset resets the controller which causes the source to see a detach
+// followed by an attach. STUSB4500 does not allow sending hard reset signal
+// directly.
+func (s *STUSB4500) SendReset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.regs.WriteReg(regResetCtrl, regResetCtrlSWReset); err != nil {
+		return err
+	}
+	time.Sleep(resetDuration)
+	return s.regs.WriteReg(regResetCtrl, 0)
+}
+
+// Alert processes all pending interrupts and returns any event generated as a
+// result.
+func (s *STUSB4500) Alert() (e typec.Event, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Reading the status registers clears the alerts
+
+	if err = s.regs.ReadRegs(regAlertStatus, s.status[:]); err != nil {
+		return
+	}
+	alert := s.status[regAlertStatus-regAlertStatus]
+	portStatus := s.status[regPortStatus1-regAlertStatus]
+	ccStatus := s.status[regCCStatus-regAlertStatus]
+	prtStatus := s.status[regPRTStatus-regAlertStatus]
+
+	if alert&regAlertHardReset != 0 {
+		e.Add(typec.EventResetReceived)
+	}
+
+	if alert&regAlertHWFault != 0 {
+		e.Add(typec.EventFault)
+	}
+
+	// Attach and detach
+
+	if alert&regAlertCCDetection != 0 {
+		if portStatus&regPortStatus1Attach == 0 {
+			e.Add(typec.EventDetached)
+		} else {
+			e.Add(typec.EventAttached)
+
+			// Determine host current capabilities at 5V
+
+			cc := ccStatus & regCCStatusCC1Mask
+			if cc == 0 {
+				cc = (ccStatus >> regCCStatusCC2Pos) & regCCStatusCC1Mask
+			}
+			switch cc {
+			case 1:
+				e.Add(typec.EventPower0A5)
+			case 2:
+				e.Add(typec.EventPower1A5)
+			case 3:
+				e.Add(typec.EventPower3A0)
+			}
+		}
+	}
+
+	// Message received
+
+	if alert&regAlertPRTStatus != 0 && prtStatus&regPRTStatusMsgReceived != 0 {
+		var msg pdmsg.Message
+		if err = s.rx(&msg); err != nil {
+			return
+		}
+		if msg.IsData() && msg.Type() == pdmsg.TypeSourceCap {
+			s.sourceCapMsg = msg
+		}
+		if msg.IsData() || msg.Type() != pdmsg.TypeGoodCRC {
+			// Queue message without blocking (ie drop if queue is full which
+			// should be rare).
+			select {
+			case s.msgs <- msg:
+			default:
+			}
+			e.Add(typec.EventRx)
+		}
+	}
+
+	return
+}
+
+const (
+	resetDuration = 27 * time.Millisecond
+
+	pdCommandSendMessage = 0x26
+)
+
+const (
+	regAlertStatus      = 0x0B
+	regAlertHardReset   = 1 << 7
+	regAlertCCDetection = 1 << 6
+	regAlertHWFault     = 1 << 4
+	regAlertPRTStatus   = 1 << 1
+
+	regAlertStatusMask = 0x0C
+
+	regPortStatus1       = 0x0E
+	regPortStatus1Attach = 1 << 0
+
+	regCCStatus        = 0x11
+	regCCStatusCC1Mask = 0b11
+	regCCStatusCC2Pos  = 2
+
+	regPRTStatus            = 0x16
+	regPRTStatusMsgReceived = 1 << 2
+
+	regStatusCount = regPRTStatus - regAlertStatus + 1
+
+	regPDCommandCtrl = 0x1A
+
+	regResetCtrl        = 0x23
+	regResetCtrlSWReset = 1 << 0
+
+	regRxHeader  = 0x31
+	regRxDataObj = 0x33
+
+	regTxHeaderLow = 0x51
+
+	regDPMPDONumb = 0x70
+	regDPMSnkPDO1 = 0x85
+)
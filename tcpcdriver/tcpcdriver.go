@@ -25,3 +25,50 @@ type I2C interface {
 	// Performs only a write transfer.
 	Tx(addr uint16, w, r []byte) error
 }
+
+// MaxRegsTransfer is the maximum number of bytes that can be read or written
+// in a single call to Regs.ReadRegs or Regs.WriteRegs.
+const MaxRegsTransfer = 64
+
+// Regs provides access to 8-bit addressed registers of a device on an I2C
+// bus. It uses an internal buffer to avoid heap allocations on each transfer
+// and as such, it is not safe for concurrent use.
+type Regs struct {
+	I2C  I2C    // I2C bus the device is on
+	Addr uint16 // I2C address of the device
+
+	buf [MaxRegsTransfer + 1]byte
+}
+
+// ReadReg reads a single register.
+func (r *Regs) ReadReg(reg uint8) (uint8, error) {
+	r.buf[0] = reg
+	err := r.I2C.Tx(r.Addr, r.buf[:1], r.buf[1:2])
+	return r.buf[1], err
+}
+
+// WriteReg writes v to a single register.
+func (r *Regs) WriteReg(reg uint8, v uint8) error {
+	r.buf[0] = reg
+	r.buf[1] = v
+	return r.I2C.Tx(r.Addr, r.buf[:2], nil)
+}
+
+// ReadRegs reads len(d) bytes into d starting at register reg. d must be no
+// longer than MaxRegsTransfer.
+func (r *Regs) ReadRegs(reg uint8, d []byte) error {
+	r.buf[0] = reg
+	err := r.I2C.Tx(r.Addr, r.buf[:1], r.buf[1:len(d)+1])
+	if err == nil {
+		copy(d, r.buf[1:len(d)+1])
+	}
+	return err
+}
+
+// WriteRegs writes d starting at register reg. d must be no longer than
+// MaxRegsTransfer.
+func (r *Regs) WriteRegs(reg uint8, d []byte) error {
+	r.buf[0] = reg
+	copy(r.buf[1:], d)
+	return r.I2C.Tx(r.Addr, r.buf[:len(d)+1], nil)
+}
@@ -0,0 +1,303 @@
+// Package tps6598x implements type-C port controller driver for TPS65987D and
+// TPS65988 USB PD controllers from Texas Instruments.
+//
+// TPS6598x runs its own PD stack and negotiates power based on its own
+// configuration, exposing its status and the negotiated contract over I2C.
+// This driver is read-mostly and synthesizes the messages the policy engine
+// expects from the source based on the controller status:
+//
+//   - Source capabilities message is synthesized from the capabilities received
+//     by the controller on attach, whenever the controller reports new
+//     capabilities or a new contract, and in response to Get_Source_Cap.
+//   - Request messages for the object position of the active contract of the
+//     controller are immediately followed by synthesized Accept and PS_RDY
+//     messages. All other requests, including any made while no contract is
+//     in effect, are followed by a synthesized Reject message, since the
+//     contract is negotiated by the controller itself.
+//
+// As such, the following limitations apply:
+//
+//   - Control messages other than Get_Source_Cap and data messages other than
+//     requests cannot be sent and fail with typec.ErrTxFailed.
+//   - Hard reset is not signalled to the source.
+//   - Only the contract negotiated by the controller can be established,
+//     which is configured through its sink capabilities and auto negotiate
+//     sink registers, typically from the application customization in its
+//     flash.
+//   - EPR capabilities are not reported.
+package tps6598x
+
+import (
+	"sync"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver"
+)
+
+// I2C addresses of the host interface of TPS6598x, depending on its ADCIN
+// configuration.
+const (
+	AddressLow  = 0x20
+	AddressHigh = 0x24
+)
+
+// TPS6598x represents a type-C port controller for TPS65987D and TPS65988 ICs.
+// All its methods may be called concurrently from multiple goroutines.
+type TPS6598x struct {
+	regs tcpcdriver.Regs
+
+	mu       sync.Mutex // guards access to the hardware and buffers
+	attached bool
+	nextID   uint8 // message ID of the next synthesized message
+
+	// We use go channel here as a fixed size queue and drop messages when
+	// queue is full.
+	msgs chan pdmsg.Message
+
+	// Buffers defined once here to avoid heap allocations. The first byte of
+	// each register read or written is the byte count of the register.
+	buf [1 + regRxSourceCapLen]byte
+}
+
+const msgQueueSize = 10
+
+// New creates a new controller at the given I2C address.
+func New(port tcpcdriver.I2C, addr uint16) *TPS6598x {
+	return &TPS6598x{
+		regs: tcpcdriver.Regs{I2C: port, Addr: addr},
+		msgs: make(chan pdmsg.Message, msgQueueSize),
+	}
+}
+
+// Init initializes the controller.
+func (t *TPS6598x) Init() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attached = false
+
+	// Flush the receive queue
+
+FlushReceiveQueue:
+	for {
+		select {
+		case <-t.msgs:
+		default:
+			break FlushReceiveQueue
+		}
+	}
+
+	// Enable the interrupts we handle
+
+	mask := t.buf[:1+regIntEventLen]
+	for i := range mask {
+		mask[i] = 0
+	}
+	mask[0] = regIntEventLen
+	mask[1+intPlugEvent/8] |= 1 << (intPlugEvent % 8)
+	mask[1+intNewContractAsCons/8] |= 1 << (intNewContractAsCons % 8)
+	mask[1+intSourceCapMsgRcvd/8] |= 1 << (intSourceCapMsgRcvd % 8)
+	return t.regs.WriteRegs(regIntMask1, mask)
+}
+
+// Tx transmits a message. Request messages are answered based on the active
+// contract of the controller and Get_Source_Cap is answered from the
+// capabilities received by the controller. All other messages fail with
+// typec.ErrTxFailed.
+func (t *TPS6598x) Tx(m pdmsg.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if m.SOP != pdmsg.SOPPort {
+		return typec.ErrTxFailed
+	}
+	if !m.IsData() {
+		if m.Type() != pdmsg.TypeGetSourceCap {
+			return typec.ErrTxFailed
+		}
+		return t.rxSourceCap()
+	}
+	if m.IsExtended() || m.Type() != pdmsg.TypeRequest {
+		return typec.ErrTxFailed
+	}
+
+	rdo, err := t.activeRDO()
+	if err != nil {
+		return err
+	}
+	pos := pdmsg.RequestDO(m.Data[0]).SelectedObjectPosition()
+	if pos == 0 || pos != rdo.SelectedObjectPosition() {
+		t.queue(t.message(pdmsg.TypeReject))
+		return nil
+	}
+	t.queue(t.message(pdmsg.TypeAccept))
+	t.queue(t.message(pdmsg.TypePSReady))
+	return nil
+}
+
+// ActiveContract returns the PDO and RDO of the contract negotiated by the
+// controller. Both are zero if no contract is in effect.
+func (t *TPS6598x) ActiveContract() (pdmsg.PDO, pdmsg.RequestDO, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.regs.ReadRegs(regActiveContractPDO, t.buf[:1+4]); err != nil {
+		return 0, 0, err
+	}
+	pdo := pdmsg.PDO(le32(t.buf[1:]))
+	rdo, err := t.activeRDO()
+	return pdo, rdo, err
+}
+
+// activeRDO reads the RDO of the active contract, which is 0 if no contract is
+// in effect.
+func (t *TPS6598x) activeRDO() (pdmsg.RequestDO, error) {
+	if err := t.regs.ReadRegs(regActiveContractRDO, t.buf[:1+4]); err != nil {
+		return 0, err
+	}
+	return pdmsg.RequestDO(le32(t.buf[1:])), nil
+}
+
+func le32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+// message returns a message of type t from the source with the next message
+// ID.
+func (t *TPS6598x) message(typ pdmsg.Type) pdmsg.Message {
+	var m pdmsg.Message
+	m.SetPowerRole(pdmsg.PowerRoleSource)
+	m.SetDataRole(pdmsg.DataRoleDFP)
+	m.SetRevision(pdmsg.Revision30)
+	m.SetType(typ)
+	m.SetID(t.nextID)
+	t.nextID = (t.nextID + 1) % 8
+	return m
+}
+
+// queue queues a synthesized message without blocking (ie drop if queue is
+// full which should be rare).
+func (t *TPS6598x) queue(m pdmsg.Message) {
+	select {
+	case t.msgs <- m:
+	default:
+	}
+}
+
+// rxSourceCap reads the source capabilities received by the controller and
+// queues them as a source capabilities message. Nothing is queued if the
+// controller has not received any capabilities.
+func (t *TPS6598x) rxSourceCap() error {
+	b := t.buf[:1+regRxSourceCapLen]
+	if err := t.regs.ReadRegs(regRxSourceCap, b); err != nil {
+		return err
+	}
+	n := b[1] & regRxSourceCapNumMask
+	if n == 0 {
+		return nil
+	}
+	m := t.message(pdmsg.TypeSourceCap)
+	m.SetDataObjectCount(n)
+	for i := uint8(0); i < n; i++ {
+		m.Data[i] = le32(b[2+i*4:])
+	}
+	t.queue(m)
+	return nil
+}
+
+// Rx returns a received message.
+func (t *TPS6598x) Rx() (pdmsg.Message, error) {
+	select {
+	case n := <-t.msgs:
+		return n, nil
+	default:
+		return pdmsg.Message{}, typec.ErrRxEmpty
+	}
+}
+
+// SendReset does nothing as the controller handles hard resets itself. The
+// contract negotiated by the controller is reported again once the policy
+// engine calls Init.
+func (t *TPS6598x) SendReset() error {
+	return nil
+}
+
+// Alert processes all pending interrupts and returns any event generated as a
+// result.
+func (t *TPS6598x) Alert() (e typec.Event, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Read and clear the pending interrupts
+
+	ev := t.buf[:1+regIntEventLen]
+	if err = t.regs.ReadRegs(regIntEvent1, ev); err != nil {
+		return
+	}
+	ev[0] = regIntEventLen
+	if err = t.regs.WriteRegs(regIntClear1, ev); err != nil {
+		return
+	}
+	intPlug := ev[1+intPlugEvent/8]&(1<<(intPlugEvent%8)) != 0
+	intCaps := ev[1+intSourceCapMsgRcvd/8]&(1<<(intSourceCapMsgRcvd%8)) != 0 ||
+		ev[1+intNewContractAsCons/8]&(1<<(intNewContractAsCons%8)) != 0
+
+	// Attach and detach. The status is checked on first call regardless of
+	// interrupts to cover the negotiation completed before it.
+
+	if intPlug || !t.attached {
+		if err = t.regs.ReadRegs(regStatus, t.buf[:1+1]); err != nil {
+			return
+		}
+		attached := t.buf[1]&regStatusPlugPresent != 0
+		if attached != t.attached {
+			t.attached = attached
+			if !attached {
+				e.Add(typec.EventDetached)
+				return
+			}
+			e.Add(typec.EventAttached)
+			intCaps = true
+		}
+	}
+
+	// New capabilities or a new contract negotiated by the controller are
+	// synthesized as new source capabilities, for the policy engine to request
+	// the active contract.
+
+	if t.attached && intCaps {
+		if err = t.rxSourceCap(); err != nil {
+			return
+		}
+	}
+
+	if len(t.msgs) > 0 {
+		e.Add(typec.EventRx)
+	}
+	return
+}
+
+// Bit positions in interrupt event registers.
+const (
+	intPlugEvent         = 3
+	intNewContractAsCons = 13
+	intSourceCapMsgRcvd  = 14
+)
+
+const (
+	regIntEvent1   = 0x14
+	regIntMask1    = 0x16
+	regIntClear1   = 0x18
+	regIntEventLen = 11
+
+	regStatus            = 0x1A
+	regStatusPlugPresent = 1 << 0
+
+	regRxSourceCap        = 0x30
+	regRxSourceCapLen     = 1 + 7*4
+	regRxSourceCapNumMask = 0b111
+
+	regActiveContractPDO = 0x34
+	regActiveContractRDO = 0x35
+)
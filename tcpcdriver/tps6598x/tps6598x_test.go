@@ -0,0 +1,104 @@
+package tps6598x
+
+import (
+	"testing"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+)
+
+// fakeI2C simulates the register map of a TPS6598x. Each register holds its
+// byte count followed by its content, as read over I2C.
+type fakeI2C struct {
+	regs   map[uint8][]byte
+	writes int // number of register writes so far
+}
+
+func (d *fakeI2C) Tx(addr uint16, w, r []byte) error {
+	if len(w) > 1 {
+		d.writes++
+		d.regs[w[0]] = append([]byte(nil), w[1:]...)
+	}
+	copy(r, d.regs[w[0]])
+	return nil
+}
+
+// setReg32 sets register reg to the 32 bit value v.
+func (d *fakeI2C) setReg32(reg uint8, v uint32) {
+	d.regs[reg] = []byte{4, byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+// newTestController returns an initialized controller on a fake I2C bus with
+// an active contract for object position pos, or none if pos is 0.
+func newTestController(t *testing.T, pos uint8) (*TPS6598x, *fakeI2C) {
+	t.Helper()
+	d := &fakeI2C{regs: map[uint8][]byte{}}
+	rdo := pdmsg.EmptyRequestDO
+	if pos > 0 {
+		rdo.SetSelectedObjectPosition(pos)
+		rdo.SetFixedOperatingCurrent(1000)
+		rdo.SetFixedMaxOperatingCurrent(1000)
+	}
+	d.setReg32(regActiveContractRDO, uint32(rdo))
+	c := New(d, AddressLow)
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return c, d
+}
+
+// request returns a request message for object position pos.
+func request(pos uint8) pdmsg.Message {
+	rdo := pdmsg.EmptyRequestDO
+	rdo.SetSelectedObjectPosition(pos)
+	rdo.SetFixedOperatingCurrent(1000)
+	rdo.SetFixedMaxOperatingCurrent(1000)
+	var m pdmsg.Message
+	m.SetType(pdmsg.TypeRequest)
+	m.SetDataObjectCount(1)
+	m.Data[0] = uint32(rdo)
+	return m
+}
+
+func TestTxRequest(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		active uint8
+		pos    uint8
+		want   []pdmsg.Type
+	}{
+		{"active", 2, 2, []pdmsg.Type{pdmsg.TypeAccept, pdmsg.TypePSReady}},
+		{"other", 2, 1, []pdmsg.Type{pdmsg.TypeReject}},
+		{"no contract", 0, 1, []pdmsg.Type{pdmsg.TypeReject}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tc, _ := newTestController(t, c.active)
+			if err := tc.Tx(request(c.pos)); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range c.want {
+				m, err := tc.Rx()
+				if err != nil {
+					t.Fatalf("got %v, want message type %d", err, want)
+				}
+				if m.Type() != want || m.IsData() {
+					t.Errorf("got message type %d, want %d", m.Type(), want)
+				}
+			}
+			if _, err := tc.Rx(); err != typec.ErrRxEmpty {
+				t.Errorf("got %v after replies, want %v", err, typec.ErrRxEmpty)
+			}
+		})
+	}
+}
+
+func TestSendResetWritesNothing(t *testing.T) {
+	tc, d := newTestController(t, 1)
+	n := d.writes
+	if err := tc.SendReset(); err != nil {
+		t.Fatal(err)
+	}
+	if d.writes != n {
+		t.Errorf("got %d register writes, want none", d.writes-n)
+	}
+}
@@ -0,0 +1,127 @@
+// Package tusb322 implements type-C port controller driver for TUSB322I from
+// Texas Instruments.
+//
+// TUSB322I only handles CC detection and has no power delivery PHY. The driver
+// reports attachment, detachment and the current advertised by the source, but
+// cannot send or receive power delivery messages: Tx and SendReset always fail
+// with typec.ErrTxFailed and Rx always returns typec.ErrRxEmpty. This is enough
+// for the policy engine to negotiate non-PD power at 5V.
+package tusb322
+
+import (
+	"sync"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver"
+)
+
+// I2C addresses of TUSB322I based on the level of its ADDR pin.
+const (
+	AddressLow  = 0x47
+	AddressHigh = 0x67
+)
+
+// TUSB322 represents a type-C port controller for TUSB322I IC. All its methods
+// may be called concurrently from multiple goroutines.
+type TUSB322 struct {
+	regs tcpcdriver.Regs
+
+	mu       sync.Mutex // guards access to the hardware
+	attached bool
+}
+
+// New creates a new controller at the given I2C address.
+func New(port tcpcdriver.I2C, addr uint16) *TUSB322 {
+	return &TUSB322{
+		regs: tcpcdriver.Regs{I2C: port, Addr: addr},
+	}
+}
+
+// Init initializes the controller in sink (UFP) mode.
+func (t *TUSB322) Init() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attached = false
+	if err := t.regs.WriteReg(regGeneral, regGeneralSoftReset); err != nil {
+		return err
+	}
+	return t.regs.WriteReg(regGeneral, regGeneralModeUFP)
+}
+
+// Tx always fails since TUSB322I has no power delivery PHY.
+func (t *TUSB322) Tx(m pdmsg.Message) error {
+	return typec.ErrTxFailed
+}
+
+// Rx always returns typec.ErrRxEmpty since TUSB322I has no power delivery PHY.
+func (t *TUSB322) Rx() (pdmsg.Message, error) {
+	return pdmsg.Message{}, typec.ErrRxEmpty
+}
+
+// SendReset always fails since TUSB322I has no power delivery PHY.
+func (t *TUSB322) SendReset() error {
+	return typec.ErrTxFailed
+}
+
+// Alert processes pending interrupts and returns any event generated as a
+// result.
+func (t *TUSB322) Alert() (e typec.Event, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var st uint8
+	if st, err = t.regs.ReadReg(regConnStatus); err != nil {
+		return
+	}
+	if st&regConnStatusInterrupt != 0 {
+		if err = t.regs.WriteReg(regConnStatus, regConnStatusInterrupt); err != nil {
+			return
+		}
+	}
+
+	attached := (st>>regConnStatusAttachedPos)&regConnStatusAttachedMask == regConnStatusAttachedSnk
+	if attached == t.attached {
+		return
+	}
+	t.attached = attached
+	if !attached {
+		e.Add(typec.EventDetached)
+		return
+	}
+	e.Add(typec.EventAttached)
+
+	// Determine host current capabilities at 5V
+
+	var csr uint8
+	if csr, err = t.regs.ReadReg(regCSR); err != nil {
+		return
+	}
+	switch (csr >> regCSRCurrentDetectPos) & regCSRCurrentDetectMask {
+	case regCSRCurrentDetectMedium:
+		e.Add(typec.EventPower1A5)
+	case regCSRCurrentDetectHigh:
+		e.Add(typec.EventPower3A0)
+	default:
+		e.Add(typec.EventPower0A5)
+	}
+	return
+}
+
+const (
+	regCSR                    = 0x08
+	regCSRCurrentDetectPos    = 4
+	regCSRCurrentDetectMask   = 0b11
+	regCSRCurrentDetectMedium = 0b01
+	regCSRCurrentDetectHigh   = 0b11
+
+	regConnStatus             = 0x09
+	regConnStatusAttachedPos  = 6
+	regConnStatusAttachedMask = 0b11
+	regConnStatusAttachedSnk  = 0b10
+	regConnStatusInterrupt    = 1 << 4
+
+	regGeneral          = 0x0A
+	regGeneralModeUFP   = 0b01 << 4
+	regGeneralSoftReset = 1 << 3
+)
@@ -1,9 +1,24 @@
 // Package tcpe provides an implementation of USB Type-C power delivery policy
 // engine for sink devices.
+//
+// Policy engines share no mutable state. Multiple policy engines, each with its
+// own port controller, can run concurrently from separate goroutines, e.g. to
+// handle multiple ports of a hub sharing the same I2C bus.
+//
+// # Requests
+//
+// Methods that ask something of the source, i.e. Renegotiate, RequestProfile,
+// RequestSourceCapabilities, RequestStatus, RequestBatteryCapabilities,
+// RequestSourceCapabilitiesExtended and SendControl, queue a request which Run
+// carries out once an explicit contract is in effect. Requests made while the
+// contract is being negotiated are therefore deferred until it is accepted.
+// Requests are never sent to non-PD power sources, and pending requests are
+// discarded on detach and hard reset.
 package tcpe
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -11,9 +26,11 @@ import (
 	"github.com/oxplot/go-typec/pdmsg"
 )
 
+// Package level variables are set once on initialization and are only read
+// afterwards, and as such are safely shared between policy engines.
 var (
 	maxTimerExpiry = time.Unix(1<<63-62135596801, 999999999) // https://stackoverflow.com/a/32620397
-	defaultRDO     pdmsg.RequestDO
+	defaultRDO     pdmsg.RequestDO                           // minimum power at 5V
 )
 
 // CapabilityEvaluator is an interface that wraps the method EvaluateCapabilities.
@@ -23,6 +40,11 @@ type CapabilityEvaluator interface {
 	// EvaluateCapabilities must return pdmsg.EmptyRequestDO. Device policy
 	// manager is expected to respond quickly with the request data object.
 	//
+	// The returned RDO may have its capability mismatch flag set to let the
+	// source know the sink would like more power than it is offered. If no PDO
+	// is selected in such RDO (i.e. object position is 0), the policy engine
+	// requests the minimum power at 5V with the capability mismatch flag set.
+	//
 	// The passed PDO slice may be modified by the policy manager but must not
 	// be stored in the manager's state past the call to this method.
 	EvaluateCapabilities([]pdmsg.PDO) pdmsg.RequestDO
@@ -57,6 +79,103 @@ const (
 	// power with the source and source has indicated that the requested power is
 	// ready for use.
 	EventPowerReady Event = "power_ready"
+
+	// EventFault is fired when the port controller detects a fault condition.
+	EventFault Event = "fault"
+
+	// EventOverCurrent is fired when the source reports an over-current
+	// condition.
+	EventOverCurrent Event = "over_current"
+
+	// EventOverVoltage is fired when the source reports an over-voltage
+	// condition.
+	EventOverVoltage Event = "over_voltage"
+
+	// EventOverTemperature is fired when the source reports an
+	// over-temperature condition.
+	EventOverTemperature Event = "over_temperature"
+
+	// EventSourceAlert is fired for every alert sent by the source, including
+	// those that also fire one of the above events. The alert data object is
+	// available via LastAlert.
+	EventSourceAlert Event = "source_alert"
+
+	// EventFRSwap is fired when the port controller detects the fast role swap
+	// signal or the source sends a FR_Swap message. The policy engine does not
+	// perform the swap itself and only notifies the event handler.
+	EventFRSwap Event = "fr_swap"
+
+	// EventPRSwap is fired when the source requests a power role swap. As the
+	// policy engine only supports the sink role, the request is rejected.
+	EventPRSwap Event = "pr_swap"
+
+	// EventDRSwap is fired when a data role swap requested by the source is
+	// accepted. The new data role can be retrieved from DataRole.
+	EventDRSwap Event = "dr_swap"
+
+	// EventEPRModeEntered is fired when the source accepts entering Extended
+	// Power Range mode.
+	EventEPRModeEntered Event = "epr_mode_entered"
+
+	// EventEPRModeExited is fired when the source exits Extended Power Range
+	// mode.
+	EventEPRModeExited Event = "epr_mode_exited"
+
+	// EventNotSupported is fired when the source responds with Not_Supported to
+	// a message sent by the policy engine, e.g. when requesting source
+	// capabilities or entering EPR mode.
+	EventNotSupported Event = "not_supported"
+
+	// EventStatus is fired when the status of the source is received in
+	// response to RequestStatus. The status is available via Status.
+	EventStatus Event = "status"
+
+	// EventBatteryCapabilities is fired when the battery capabilities of the
+	// source are received in response to RequestBatteryCapabilities. The
+	// capabilities are available via BatteryCapabilities.
+	EventBatteryCapabilities Event = "battery_capabilities"
+
+	// EventSourceCapabilitiesExtended is fired when the extended capabilities
+	// of the source are received in response to
+	// RequestSourceCapabilitiesExtended. The capabilities are available via
+	// SourceCapabilitiesExtended.
+	EventSourceCapabilitiesExtended Event = "source_capabilities_extended"
+
+	// EventSourceCapabilitiesChanged is fired when the source sends new
+	// capabilities unprompted while a contract is in effect, e.g. when a
+	// multi-port charger reallocates power between its ports. The new
+	// capabilities are then passed to the capability evaluator as usual.
+	EventSourceCapabilitiesChanged Event = "source_capabilities_changed"
+
+	// EventNegotiationFailed is fired when negotiation with the source has
+	// failed with several consecutive hard resets, e.g. when the source never
+	// sends its capabilities or keeps rejecting requests. The policy engine
+	// keeps retrying afterwards. It is fired at most once until a contract is
+	// established or the source is detached.
+	EventNegotiationFailed Event = "negotiation_failed"
+
+	// EventNegotiationTimeout is fired when neither a contract is established
+	// nor non-PD power is accepted within the deadline set by
+	// SetNegotiationDeadline after attach. The policy engine keeps trying
+	// afterwards. It is fired at most once per attach.
+	EventNegotiationTimeout Event = "negotiation_timeout"
+
+	// EventGotoMin is fired when a PD 2.0 source requests the sink to reduce
+	// its load to the minimum operating current or power of the request in
+	// effect, which is only honored if the request has GiveBack set. The load
+	// must be reduced right away, as the source then lowers its output.
+	// EventPowerReady is fired once a new request is accepted, typically after
+	// the source sends new capabilities to restore power.
+	EventGotoMin Event = "goto_min"
+
+	// EventContractMismatch is fired when the source sends capabilities while a
+	// contract is in effect, in which the profile at the position of the
+	// contract no longer covers the request accepted by the source, e.g. its
+	// maximum current dropped below the requested operating current. This
+	// often indicates a source supplying less than it accepted. The contract
+	// is available via Contract and the new capabilities are then passed to the
+	// capability evaluator as usual.
+	EventContractMismatch Event = "contract_mismatch"
 )
 
 // EventHandler is an interface that wraps the method HandleEvent.
@@ -81,8 +200,25 @@ func init() {
 	defaultRDO.SetFixedOperatingCurrent(100)
 }
 
+// Stats is a snapshot of the protocol counters of a policy engine. All
+// counters start at zero when the policy engine is created and wrap around on
+// overflow.
+type Stats struct {
+	Tx          uint32 // Messages successfully sent
+	Rx          uint32 // Messages received, excluding discarded duplicates
+	TxFailed    uint32 // Messages failed to send
+	HardResets  uint32 // Hard resets sent to the source partner
+	SoftResets  uint32 // Soft resets sent to the source partner
+	Evaluations uint32 // Calls made to the capability evaluator
+}
+
+// maxPDOs is the maximum number of PDOs in source capabilities which is 7 SPR
+// PDOs followed by 4 EPR PDOs.
+const maxPDOs = 11
+
 // PolicyEngine implements USB Type-C power delivery policy engine for sink
-// devices. It uses polling to handle events from the port controller.
+// devices. It uses polling to handle events from the port controller. Each
+// policy engine must have its own port controller.
 type PolicyEngine struct {
 	pc typec.PortController
 	// On each timer start, expiry is set to the timer + now by the relevant
@@ -91,30 +227,221 @@ type PolicyEngine struct {
 	sourceCapMsg pdmsg.Message   // Set after source cap message is received
 	requestDO    pdmsg.RequestDO // Response from device policy manager
 	msgTpl       pdmsg.Message   // Messages to be sent, use this as template
-	pdoBuf       [pdmsg.MaxDataObjects]pdmsg.PDO
+	pdoBuf       [maxPDOs]pdmsg.PDO
+
+	// Extended message reassembly buffer and number of bytes in it.
+	extBuf [2 * pdmsg.MaxExtendedChunkBytes]byte
+	extLen int
+
+	// EPR source capabilities, set after EPR source cap message is received.
+	eprCaps    [maxPDOs]pdmsg.PDO
+	eprCapsLen uint8
+	// true if in EPR mode.
+	eprMode bool
+	// true if entering EPR mode has been attempted since startup.
+	eprAttempted bool
+	// true if EPR keep alive is sent and waiting on the acknowledgement.
+	keepAliveSent bool
+	// when the periodic request of a PPS contract is due in EPR mode, where
+	// the keep alive timer is running instead.
+	ppsDue time.Time
 
 	// true if an existing successful power negotiation is already in effect.
 	explicitContract bool
-	// true if received wait message at select cap state.
+	// true if received wait message at select cap state, with the request to
+	// send again once the sink request timer expires.
 	waitingOnSource bool
-
-	mu     sync.Mutex
-	events typec.Event
+	waitRDO         pdmsg.RequestDO
+	// true if the source has reduced power in response to GotoMin and is yet
+	// to restore it with a new contract.
+	gotoMin bool
+
+	// Number of retries and soft resets done to recover from errors since the
+	// last failure outside the recovery window, and time of the last failure.
+	failRetries    uint8
+	failSoftResets uint8
+	lastFailure    time.Time
+
+	// Number of consecutive hard resets sent without establishing a contract.
+	hardResetCount uint8
+
+	// true from a hard reset until the detach caused by the source dropping
+	// VBUS in response, which is part of the same negotiation.
+	hardResetDetach bool
+
+	// Number of times waiting for source capabilities timed out since attach.
+	waitCapTimeouts uint8
+
+	// Time of the last message received from the source, and whether the
+	// source capabilities are being requested to check the source is alive.
+	lastRx        time.Time
+	watchdogProbe bool
+
+	// Time of attach if power is yet to be negotiated, zero otherwise, and
+	// whether the negotiation deadline has passed since attach.
+	attachedAt time.Time
+	negOverdue bool
+
+	mu         sync.Mutex
+	events     typec.Event
+	requests   request
+	stats      Stats
+	acceptDRSw bool            // accept data role swap requests
+	dataRole   pdmsg.DataRole  // copy of msgTpl data role for DataRole
+	revision   pdmsg.Revision  // copy of msgTpl revision once negotiated
+	eprPDP     uint8           // sink PD power in watts for EPR mode, 0 to disable
+	status     pdmsg.Status    // last status received from the source
+	batteryRef uint8           // battery to request capabilities of
+	ppsRDO     pdmsg.RequestDO // request in effect if PPS, 0 otherwise
+	contract   struct {        // PDO and request of the contract in effect
+		pdo pdmsg.PDO
+		rdo pdmsg.RequestDO
+	}
+	srcCaps    [maxPDOs]pdmsg.PDO // last evaluated source capabilities
+	srcCapsLen uint8
+	profileRDO pdmsg.RequestDO // pending manually requested profile
+	minNonPD   uint16          // minimum acceptable non-PD current in mA
+	batteryCap pdmsg.BatteryCapabilities
+	srcCapExt  pdmsg.SourceCapabilitiesExtended
+	resetOnEnd bool                 // reset the port controller when Run returns
+	v5PDO      pdmsg.FixedSupplyPDO // non-PD max current at 5V available from the power source
+	nonPDPDO   pdmsg.PDO            // non-PD power set by the user, 0 to use v5PDO
+	recovery   struct {
+		retries    uint8 // times to retry the current state on error
+		softResets uint8 // soft resets to attempt after retries on error
+	}
+	waitCapRetries uint8         // hard resets to retry waiting for source capabilities
+	lastAlert      pdmsg.AlertDO // last alert received from the source
+	statusOnAlert  bool          // request status on operating condition change alerts
+	watchdog       time.Duration // source silence before liveness check, 0 to disable
+	negDeadline    time.Duration // max time from attach to power, 0 to disable
 
 	callbacks struct {
-		mu           sync.Mutex
-		capEvaluator CapabilityEvaluator
-		eventHandler EventHandler
+		mu            sync.Mutex
+		capEvaluator  CapabilityEvaluator
+		eventHandler  EventHandler
+		stateObserver func(from, to string)
+		msgObserver   func(m pdmsg.Message, tx bool)
 	}
 
-	v5PDO pdmsg.FixedSupplyPDO // non-PD max current at 5V available from the power source
-
 	nextTxID uint8
 	lastRxID uint8
+
+	ctx context.Context // context passed to Run
+}
+
+// Option configures the policy engine at creation time, before Run is called.
+type Option func(*PolicyEngine)
+
+// WithCapabilityEvaluator sets the capability evaluator. See
+// SetCapabilityEvaluator.
+func WithCapabilityEvaluator(ce CapabilityEvaluator) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetCapabilityEvaluator(ce)
+	}
+}
+
+// WithEventHandler sets the event handler. See SetEventHandler.
+func WithEventHandler(e EventHandler) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetEventHandler(e)
+	}
+}
+
+// WithStateObserver sets the state observer. See SetStateObserver.
+func WithStateObserver(f func(from, to string)) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetStateObserver(f)
+	}
+}
+
+// WithMessageObserver sets the message observer. See SetMessageObserver.
+func WithMessageObserver(f func(m pdmsg.Message, tx bool)) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetMessageObserver(f)
+	}
+}
+
+// WithDataRoleSwap sets whether data role swap requests are accepted. See
+// SetDataRoleSwap.
+func WithDataRoleSwap(accept bool) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetDataRoleSwap(accept)
+	}
+}
+
+// WithEPRSinkPDP enables EPR mode. See SetEPRSinkPDP.
+func WithEPRSinkPDP(pdp uint8) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetEPRSinkPDP(pdp)
+	}
+}
+
+// WithMinNonPDCurrent sets the minimum acceptable non-PD current. See
+// SetMinNonPDCurrent.
+func WithMinNonPDCurrent(current uint16) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetMinNonPDCurrent(current)
+	}
 }
 
-// New creates a new policy engine for a given port controller.
-func New(pc typec.PortController) *PolicyEngine {
+// WithResetOnExit sets whether Run resets the port controller on exit. See
+// SetResetOnExit.
+func WithResetOnExit(reset bool) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetResetOnExit(reset)
+	}
+}
+
+// WithRecoveryPolicy sets the error recovery policy. See SetRecoveryPolicy.
+func WithRecoveryPolicy(retries, softResets uint8) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetRecoveryPolicy(retries, softResets)
+	}
+}
+
+// WithWaitCapRetries sets the number of retries of waiting for source
+// capabilities. See SetWaitCapRetries.
+func WithWaitCapRetries(retries uint8) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetWaitCapRetries(retries)
+	}
+}
+
+// WithLivenessWatchdog enables the liveness watchdog. See
+// SetLivenessWatchdog.
+func WithLivenessWatchdog(d time.Duration) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetLivenessWatchdog(d)
+	}
+}
+
+// WithNegotiationDeadline sets the negotiation deadline. See
+// SetNegotiationDeadline.
+func WithNegotiationDeadline(d time.Duration) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetNegotiationDeadline(d)
+	}
+}
+
+// WithStatusOnAlert sets whether the status of the source is requested on
+// alerts. See SetStatusOnAlert.
+func WithStatusOnAlert(request bool) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetStatusOnAlert(request)
+	}
+}
+
+// WithNonPDProfile sets the non-PD power profile. See SetNonPDProfile.
+func WithNonPDProfile(pdo pdmsg.PDO) Option {
+	return func(pe *PolicyEngine) {
+		pe.SetNonPDProfile(pdo)
+	}
+}
+
+// New creates a new policy engine for a given port controller, configured with
+// the given options.
+func New(pc typec.PortController, opts ...Option) *PolicyEngine {
 	m := pdmsg.Message{}
 	m.SetPowerRole(pdmsg.PowerRoleSink)
 	m.SetDataRole(pdmsg.DataRoleUFP)
@@ -123,16 +450,23 @@ func New(pc typec.PortController) *PolicyEngine {
 	v5PDO := pdmsg.NewFixedSupplyPDO()
 	v5PDO.SetVoltage(5000)
 
-	return &PolicyEngine{
+	pe := &PolicyEngine{
 		pc:          pc,
 		timerExpiry: maxTimerExpiry,
 		msgTpl:      m,
 		v5PDO:       v5PDO,
 	}
+	for _, o := range opts {
+		o(pe)
+	}
+	return pe
 }
 
 // SetCapabilityEvaluator sets the capability evaluator to use. Passing nil will
-// result in the policy engine rejecting all power negotiations.
+// result in the policy engine rejecting all power negotiations. The new
+// evaluator is used from the next evaluation of source capabilities. Call
+// Renegotiate to have the source capabilities in effect re-evaluated
+// immediately.
 func (pe *PolicyEngine) SetCapabilityEvaluator(ce CapabilityEvaluator) {
 	pe.callbacks.mu.Lock()
 	pe.callbacks.capEvaluator = ce
@@ -147,6 +481,181 @@ func (pe *PolicyEngine) SetEventHandler(e EventHandler) {
 	pe.callbacks.mu.Unlock()
 }
 
+// SetStateObserver sets a function to be called on every state transition of
+// the policy engine with the names of the states transitioned from and to. It
+// is mostly used for debugging purposes. Pass nil to remove the existing
+// observer.
+//
+// The observer is called from the Run loop and must return quickly to not
+// violate the timing requirements of the protocol.
+func (pe *PolicyEngine) SetStateObserver(f func(from, to string)) {
+	pe.callbacks.mu.Lock()
+	pe.callbacks.stateObserver = f
+	pe.callbacks.mu.Unlock()
+}
+
+// SetMessageObserver sets a function to be called with every message sent to
+// and received from the port controller, with tx set to true for sent
+// messages. Messages that fail to send and received messages that are later
+// discarded as duplicates are included. It is mostly used for debugging and
+// protocol analysis. Pass nil to remove the existing observer.
+//
+// The observer is called from the Run loop and must return quickly to not
+// violate the timing requirements of the protocol.
+func (pe *PolicyEngine) SetMessageObserver(f func(m pdmsg.Message, tx bool)) {
+	pe.callbacks.mu.Lock()
+	pe.callbacks.msgObserver = f
+	pe.callbacks.mu.Unlock()
+}
+
+// SetDataRoleSwap sets whether data role swap requests from the source are
+// accepted. Requests are rejected by default.
+// SetDataRoleSwap may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetDataRoleSwap(accept bool) {
+	pe.mu.Lock()
+	pe.acceptDRSw = accept
+	pe.mu.Unlock()
+}
+
+// DataRole returns the current data role of the sink, which is UFP unless a
+// data role swap has been accepted.
+// DataRole may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) DataRole() pdmsg.DataRole {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.dataRole
+}
+
+// SetEPRSinkPDP enables entering Extended Power Range mode with EPR capable
+// sources, with pdp being the PD power of the sink in watts. Passing 0 disables
+// EPR mode, which is the default.
+//
+// With EPR mode enabled, once an explicit contract is established, the policy
+// engine enters EPR mode and passes the EPR source capabilities to the
+// capability evaluator. EPR source capabilities are made up of up to 7 SPR
+// PDOs, padded with zero PDOs, followed by up to 4 EPR PDOs at positions 8 and
+// above.
+// SetEPRSinkPDP may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetEPRSinkPDP(pdp uint8) {
+	pe.mu.Lock()
+	pe.eprPDP = pdp
+	pe.mu.Unlock()
+}
+
+// SetMinNonPDCurrent sets the minimum current in milliamps at 5V that a non-PD
+// power source must advertise for it to be passed to the capability evaluator.
+// Sources advertising less, e.g. 1500mA when 3000mA is set, are treated as if
+// no acceptable power is available. The default is 0 which accepts all non-PD
+// sources.
+// SetMinNonPDCurrent may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetMinNonPDCurrent(current uint16) {
+	pe.mu.Lock()
+	pe.minNonPD = current
+	pe.mu.Unlock()
+}
+
+// SetNonPDProfile sets the power available from non-PD power sources, e.g. a
+// 9V or 12V proprietary fast charging mode detected by external circuitry,
+// which is passed to the capability evaluator in place of the 5V power
+// advertised by the source over CC. SetMinNonPDCurrent does not apply to it.
+// Passing 0 reverts to the advertised 5V power, which is the default. Call
+// Renegotiate to have the new profile evaluated if a non-PD source is already
+// attached.
+// SetNonPDProfile may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetNonPDProfile(pdo pdmsg.PDO) {
+	pe.mu.Lock()
+	pe.nonPDPDO = pdo
+	pe.mu.Unlock()
+}
+
+// SetResetOnExit sets whether Run resets the port controller when its context
+// is cancelled. If set, a hard reset is sent to the source if a contract is in
+// effect, which returns the source to its default 5V output, and the port
+// controller is then re-initialized. Port controller is left as is by default.
+// SetResetOnExit may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetResetOnExit(reset bool) {
+	pe.mu.Lock()
+	pe.resetOnEnd = reset
+	pe.mu.Unlock()
+}
+
+// SetRecoveryPolicy sets how the policy engine recovers from errors, such as
+// failure to send a message. On error, the current state is first retried up to
+// retries times, then up to softResets soft resets are attempted if an explicit
+// contract is in effect, and only then a hard reset is sent. Unlike hard reset,
+// retries and soft resets do not cause the source to cut power. The counts
+// are reset once no error has occurred for a while (10 seconds). By default,
+// both are 0, meaning errors immediately lead to a hard reset.
+// SetRecoveryPolicy may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetRecoveryPolicy(retries, softResets uint8) {
+	pe.mu.Lock()
+	pe.recovery.retries = retries
+	pe.recovery.softResets = softResets
+	pe.mu.Unlock()
+}
+
+// SetLivenessWatchdog enables detection of sources that stop communicating
+// while a contract is in effect. If no message is received from the source for
+// d, its capabilities are requested and if it does not respond, a hard reset is
+// sent. Capabilities sent in response are evaluated as usual. Passing 0
+// disables the watchdog, which is the default.
+// SetLivenessWatchdog may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetLivenessWatchdog(d time.Duration) {
+	pe.mu.Lock()
+	pe.watchdog = d
+	pe.mu.Unlock()
+}
+
+// SetNegotiationDeadline sets the maximum time from attach until either a
+// contract is established or non-PD power is accepted, after which
+// EventNegotiationTimeout is fired. Unlike the timers of the PD protocol, this
+// covers the whole negotiation including retries and hard resets, as well as
+// states that have no timeout of their own. Passing 0 disables the deadline,
+// which is the default.
+// SetNegotiationDeadline may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetNegotiationDeadline(d time.Duration) {
+	pe.mu.Lock()
+	pe.negDeadline = d
+	pe.mu.Unlock()
+}
+
+// negotiationOverdue returns true if the negotiation deadline has passed since
+// attach.
+func (pe *PolicyEngine) negotiationOverdue() bool {
+	if pe.attachedAt.IsZero() || pe.negOverdue {
+		return false
+	}
+	pe.mu.Lock()
+	d := pe.negDeadline
+	pe.mu.Unlock()
+	return d > 0 && time.Since(pe.attachedAt) >= d
+}
+
+// watchdogDue returns true if the liveness of the source should be checked
+// given the current state cur.
+func (pe *PolicyEngine) watchdogDue(cur *state) bool {
+	if cur != stateSinkReady || !pe.explicitContract {
+		return false
+	}
+	pe.mu.Lock()
+	d := pe.watchdog
+	pe.mu.Unlock()
+	return d > 0 && time.Since(pe.lastRx) >= d
+}
+
+// SetWaitCapRetries sets how many times waiting for source capabilities is
+// retried, by sending a hard reset, when the source does not send its
+// capabilities in time after attach. Only once retries are exhausted, the
+// source is treated as non-PD if it advertises 5V power, or hard reset is sent
+// otherwise. This helps with slow sources that occasionally miss the deadline.
+// The default is 0, meaning no retries.
+// SetWaitCapRetries may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetWaitCapRetries(retries uint8) {
+	pe.mu.Lock()
+	pe.waitCapRetries = retries
+	pe.mu.Unlock()
+}
+
 // Reset resets the policy engine and in effect the port controller to their
 // initial states. This will cause the power to be lost and renogotiation to
 // happen.
@@ -157,7 +666,290 @@ func (pe *PolicyEngine) Reset() {
 	pe.mu.Unlock()
 }
 
+// setV5Power sets the non-PD max current at 5V available from the power source
+// based on power event e.
+func (pe *PolicyEngine) setV5Power(e typec.Event) {
+	var c uint16
+	switch e {
+	case typec.EventPower0A5:
+		c = 500
+	case typec.EventPower1A5:
+		c = 1500
+	case typec.EventPower3A0:
+		c = 3000
+	}
+	pe.mu.Lock()
+	pe.v5PDO.SetMaxCurrent(c)
+	pe.mu.Unlock()
+}
+
+// Renegotiate re-evaluates the last received source capabilities and, if the
+// resulting request differs from the one in effect, negotiates the new request
+// with the source without a reset and therefore without losing power. This is
+// useful for adjusting PPS output voltage and current on the fly, or applying
+// a change of the capability evaluator. With non-PD power sources, the 5V
+// power is re-evaluated instead.
+// The renegotiation is requested as described under Requests in the package
+// documentation.
+// Renegotiate may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) Renegotiate() {
+	pe.mu.Lock()
+	pe.requests.add(requestRenegotiate)
+	pe.mu.Unlock()
+}
+
+// ErrInvalidProfile is returned by RequestProfile if the requested profile is
+// not offered by the source.
+var ErrInvalidProfile = errors.New("tcpe: requested profile is not offered by the source")
+
+// RequestProfile negotiates rdo with the source without a reset, bypassing the
+// capability evaluator for this one request. rdo must select one of the PDOs
+// returned by SourceCapabilities and be within its limits, otherwise
+// ErrInvalidProfile is returned and nothing is requested. The negotiated
+// profile stays in effect until the source capabilities are evaluated again,
+// e.g. when the source resends them or Renegotiate is called.
+// The request is carried out as described under Requests in the package
+// documentation.
+// RequestProfile may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) RequestProfile(rdo pdmsg.RequestDO) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	p := rdo.SelectedObjectPosition()
+	if p == 0 || p > pe.srcCapsLen || !validRequest(rdo, pe.srcCaps[p-1]) {
+		return ErrInvalidProfile
+	}
+	pe.profileRDO = rdo
+	pe.requests.add(requestProfile)
+	return nil
+}
+
+// validRequest returns true if rdo requests power within the limits of pdo.
+// The maximum operating current or power, which holds the minimum instead with
+// GiveBack, may only exceed the limit if the capability mismatch flag is set.
+func validRequest(rdo pdmsg.RequestDO, pdo pdmsg.PDO) bool {
+	maxOK := rdo.IsGiveBack() || rdo.CapabilityMismatch()
+	switch pdo.Type() {
+	case pdmsg.PDOTypeFixedSupply:
+		c, lim := rdo.FixedOperatingCurrent(), pdmsg.FixedSupplyPDO(pdo).MaxCurrent()
+		return c > 0 && c <= lim && (maxOK || rdo.FixedMaxOperatingCurrent() <= lim)
+	case pdmsg.PDOTypeVariableSupply:
+		c, lim := rdo.FixedOperatingCurrent(), pdmsg.VariableSupplyPDO(pdo).MaxCurrent()
+		return c > 0 && c <= lim && (maxOK || rdo.FixedMaxOperatingCurrent() <= lim)
+	case pdmsg.PDOTypeBattery:
+		p, lim := rdo.BatteryOperatingPower(), pdmsg.BatteryPDO(pdo).MaxPower()
+		return p > 0 && p <= lim && (maxOK || rdo.BatteryMaxOperatingPower() <= lim)
+	case pdmsg.PDOTypePPS:
+		p := pdmsg.PPSPDO(pdo)
+		v, c := rdo.PPSOutputVoltage(), rdo.PPSOutputCurrent()
+		return v >= p.MinVoltage() && v <= p.MaxVoltage() && c > 0 && c <= p.MaxCurrent()
+	case pdmsg.PDOTypeEPRAVS:
+		p := pdmsg.EPRAVSPDO(pdo)
+		v, c := rdo.AVSOutputVoltage(), rdo.AVSOutputCurrent()
+		return v >= p.MinVoltage() && v <= p.MaxVoltage() && c > 0 && uint32(v)*uint32(c)/1000 <= p.MaxPower()
+	}
+	return false
+}
+
+// RequestSourceCapabilities asks the source to resend its capabilities which
+// are then evaluated as usual. This is useful for picking up changes in the
+// profiles offered by sources that share power between multiple ports.
+// The request is carried out as described under Requests in the package
+// documentation.
+// RequestSourceCapabilities may be called concurrently from multiple
+// goroutines.
+func (pe *PolicyEngine) RequestSourceCapabilities() {
+	pe.mu.Lock()
+	pe.requests.add(requestSourceCap)
+	pe.mu.Unlock()
+}
+
+// ErrUnsupportedControl is returned by SendControl for control message types
+// that cannot be sent on demand.
+var ErrUnsupportedControl = errors.New("tcpe: control message type cannot be sent on demand")
+
+// SendControl sends a control message of type t to the source, which is mostly
+// useful for conformance testing. Only Get_Source_Cap, Get_Status, Soft_Reset
+// and Ping are supported and other types return ErrUnsupportedControl. The
+// message is sent from the Run loop with the correct header and the responses
+// are handled as usual, e.g. the source capabilities sent in response to
+// Get_Source_Cap are evaluated. Get_Source_Cap and Get_Status are equivalent
+// to RequestSourceCapabilities and RequestStatus, respectively.
+// The message is sent as described under Requests in the package
+// documentation.
+// SendControl may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SendControl(t pdmsg.Type) error {
+	var r request
+	switch t {
+	case pdmsg.TypeGetSourceCap:
+		r = requestSourceCap
+	case pdmsg.TypeGetStatus:
+		r = requestStatus
+	case pdmsg.TypeSoftReset:
+		r = requestSoftReset
+	case pdmsg.TypePing:
+		r = requestPing
+	default:
+		return ErrUnsupportedControl
+	}
+	pe.mu.Lock()
+	pe.requests.add(r)
+	pe.mu.Unlock()
+	return nil
+}
+
+// RequestStatus asks the source for its status, such as its internal
+// temperature and present input. Once received, EventStatus is fired and the
+// status is available via Status. If the source does not support it,
+// EventNotSupported is fired instead.
+// The request is carried out as described under Requests in the package
+// documentation.
+// RequestStatus may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) RequestStatus() {
+	pe.mu.Lock()
+	pe.requests.add(requestStatus)
+	pe.mu.Unlock()
+}
+
+// Status returns the last status received from the source.
+// Status may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) Status() pdmsg.Status {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.status
+}
+
+// RequestBatteryCapabilities asks the source for the capabilities of one of its
+// batteries, such as its design capacity. batteryRef is the battery number with
+// fixed batteries numbered 0 to 3 and hot swappable batteries 4 to 7. Once
+// received, EventBatteryCapabilities is fired and the capabilities are
+// available via BatteryCapabilities. If the source does not support it,
+// EventNotSupported is fired instead.
+// The request is carried out as described under Requests in the package
+// documentation.
+// RequestBatteryCapabilities may be called concurrently from multiple
+// goroutines.
+func (pe *PolicyEngine) RequestBatteryCapabilities(batteryRef uint8) {
+	pe.mu.Lock()
+	pe.batteryRef = batteryRef
+	pe.requests.add(requestBatteryCap)
+	pe.mu.Unlock()
+}
+
+// BatteryCapabilities returns the last battery capabilities received from the
+// source.
+// BatteryCapabilities may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) BatteryCapabilities() pdmsg.BatteryCapabilities {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.batteryCap
+}
+
+// RequestSourceCapabilitiesExtended asks the source for its extended
+// capabilities, such as its vendor and product IDs, which identify the model of
+// the source. Once received, EventSourceCapabilitiesExtended is fired and the
+// capabilities are available via SourceCapabilitiesExtended. If the source does
+// not support it, EventNotSupported is fired instead.
+// The request is carried out as described under Requests in the package
+// documentation.
+// RequestSourceCapabilitiesExtended may be called concurrently from multiple
+// goroutines.
+func (pe *PolicyEngine) RequestSourceCapabilitiesExtended() {
+	pe.mu.Lock()
+	pe.requests.add(requestSourceCapExt)
+	pe.mu.Unlock()
+}
+
+// SourceCapabilitiesExtended returns the last extended capabilities received
+// from the source.
+// SourceCapabilitiesExtended may be called concurrently from multiple
+// goroutines.
+func (pe *PolicyEngine) SourceCapabilitiesExtended() pdmsg.SourceCapabilitiesExtended {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.srcCapExt
+}
+
+// PPSContract returns the output voltage in millivolts and current in
+// milliamps requested in the contract in effect, if the contract is for a
+// programmable (PPS) power supply. ok is false otherwise. Together with
+// Renegotiate, it allows for live adjustment of the PPS output.
+// PPSContract may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) PPSContract() (voltage, current uint16, ok bool) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if pe.ppsRDO == 0 {
+		return 0, 0, false
+	}
+	return pe.ppsRDO.PPSOutputVoltage(), pe.ppsRDO.PPSOutputCurrent(), true
+}
+
+// contractMismatch returns true if the source capabilities message m no longer
+// covers the request of the contract in effect.
+func (pe *PolicyEngine) contractMismatch(m pdmsg.Message) bool {
+	pe.mu.Lock()
+	rdo := pe.contract.rdo
+	pe.mu.Unlock()
+	p := rdo.SelectedObjectPosition()
+	if !pe.explicitContract || p == 0 || rdo == defaultRDO {
+		return false
+	}
+	if p > m.DataObjectCount() {
+		return true
+	}
+	return !validRequest(rdo, pdmsg.PDO(m.Data[p-1]))
+}
+
+// SourceCapabilities returns a copy of the last source capabilities received
+// from the source and passed to the capability evaluator, or nil if none have
+// been received since attach. In EPR mode, these are the EPR source
+// capabilities, laid out as passed to the capability evaluator. Positions of
+// the PDOs, starting at 1, can be used to select a PDO in the request returned
+// by the capability evaluator, e.g. to let the user override the choice of the
+// device policy manager followed by a call to Renegotiate.
+// SourceCapabilities may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SourceCapabilities() []pdmsg.PDO {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if pe.srcCapsLen == 0 {
+		return nil
+	}
+	caps := make([]pdmsg.PDO, pe.srcCapsLen)
+	copy(caps, pe.srcCaps[:pe.srcCapsLen])
+	return caps
+}
+
+// Stats returns a snapshot of the protocol counters.
+// Stats may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) Stats() Stats {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.stats
+}
+
+// Contract returns the PDO and request of the contract in effect, as accepted
+// by the source. ok is false if no contract has been accepted since attach.
+// Contract may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) Contract() (pdo pdmsg.PDO, rdo pdmsg.RequestDO, ok bool) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.contract.pdo, pe.contract.rdo, pe.contract.rdo != 0
+}
+
+// NegotiatedRevision returns the PD specification revision used with the
+// source, which is the lower of the revision of its capabilities message and
+// Revision30. Revision10 is returned until the source capabilities are
+// received after attach or reset.
+// NegotiatedRevision may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) NegotiatedRevision() pdmsg.Revision {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.revision
+}
+
 func (pe *PolicyEngine) evalCaps(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	pe.mu.Lock()
+	pe.stats.Evaluations++
+	pe.mu.Unlock()
 	pe.callbacks.mu.Lock()
 	defer pe.callbacks.mu.Unlock()
 	if pe.callbacks.capEvaluator != nil {
@@ -167,16 +959,19 @@ func (pe *PolicyEngine) evalCaps(pdos []pdmsg.PDO) pdmsg.RequestDO {
 }
 
 // Run starts the event loop of the policy engine and manages the state
-// transitions and delivery of events. Run blocks until ctx is done. Only one
-// call to Run must be in progress at any given time.
+// transitions and delivery of events. Run blocks until ctx is done, upon which
+// the current state is exited, e.g. stopping the BIST carrier. Only one call to
+// Run must be in progress at any given time.
 func (pe *PolicyEngine) Run(ctx context.Context) {
 	const loopSleepDuration = 3 * time.Millisecond
 	cur := stateSinkStartup // current state
 	entering := true
+	pe.ctx = ctx
 
 	for {
 		select {
 		case <-ctx.Done():
+			pe.exit(cur, !entering)
 			return
 		default:
 		}
@@ -200,16 +995,33 @@ func (pe *PolicyEngine) Run(ctx context.Context) {
 			if e, err = pe.pc.Alert(); err != nil {
 				goto Error
 			}
+			var r request
 			pe.mu.Lock()
 			pe.events.Add(e)
 			e = pe.events.Pop()
+			if e == typec.EventNone && (cur == stateSinkReady || cur == stateNoPD) {
+				r = pe.requests.pop()
+			}
 			pe.mu.Unlock()
 
-			if e == typec.EventNone {
+			if r != requestNone {
+
+				// Handle next user request
+
+				next, err = pe.handleRequest(cur, r)
+
+			} else if e == typec.EventNone {
 
 				// No pending events. Check on timers or sleep.
 
-				if time.Now().After(pe.timerExpiry) {
+				if pe.negotiationOverdue() {
+					pe.negOverdue = true // only fire once
+					pe.notifyEvent(EventNegotiationTimeout)
+				}
+				if pe.watchdogDue(cur) {
+					pe.watchdogProbe = true
+					next = stateSinkGetSourceCap
+				} else if time.Now().After(pe.timerExpiry) {
 					pe.timerExpiry = maxTimerExpiry // only run timer timeout event once
 					next, err = cur.Process(pe, pdmsg.Message{}, typec.EventTimerTimeout)
 				} else {
@@ -221,25 +1033,54 @@ func (pe *PolicyEngine) Run(ctx context.Context) {
 				// Handle next event
 
 				switch e {
-				case typec.EventPower0A5:
-					pe.v5PDO.SetMaxCurrent(500)
-				case typec.EventPower1A5:
-					pe.v5PDO.SetMaxCurrent(1500)
-				case typec.EventPower3A0:
-					pe.v5PDO.SetMaxCurrent(3000)
-				case typec.EventDetached, typec.EventResetReceived:
+				case typec.EventPower0A5, typec.EventPower1A5, typec.EventPower3A0:
+					pe.setV5Power(e)
+
+					// Source may change the advertised current while attached,
+					// e.g. when sharing power between multiple ports.
+
+					if cur == stateNoPD {
+						next = stateNoPD
+					}
+				case typec.EventDetached:
+					if pe.hardResetDetach {
+						pe.hardResetDetach = false
+					} else {
+						pe.hardResetCount = 0
+						pe.waitCapTimeouts = 0
+						pe.attachedAt = time.Time{}
+						pe.negOverdue = false
+					}
+					next = stateSinkStartup
+				case typec.EventResetReceived:
+					pe.hardResetDetach = true
 					next = stateSinkStartup
 				case typec.EventSendReset:
 					next = stateSinkHardReset
+				case typec.EventFault:
+					pe.notifyEvent(EventFault)
+				case typec.EventFRSwap:
+					pe.notifyEvent(EventFRSwap)
 				case typec.EventRx:
-					var m pdmsg.Message
-					if m, err = pe.rx(); err == nil {
-						next, err = cur.Process(pe, m, typec.EventRx)
-						pe.mu.Lock()
-						pe.events.Add(typec.EventRx) // there may be multiple messages waiting
-						pe.mu.Unlock()
-					} else if err == typec.ErrRxEmpty {
-						err = nil
+
+					// Process all queued messages in order until the state
+					// changes, in which case the rest are left to be processed
+					// by the next state.
+
+					for {
+						var m pdmsg.Message
+						if m, err = pe.rx(); err != nil {
+							if err == typec.ErrRxEmpty {
+								err = nil
+							}
+							break
+						}
+						if next, err = cur.Process(pe, m, typec.EventRx); next != nil || err != nil {
+							pe.mu.Lock()
+							pe.events.Add(typec.EventRx) // there may be more messages waiting
+							pe.mu.Unlock()
+							break
+						}
 					}
 				default:
 					next, err = cur.Process(pe, pdmsg.Message{}, e)
@@ -252,15 +1093,24 @@ func (pe *PolicyEngine) Run(ctx context.Context) {
 	Error:
 
 		if err != nil {
-			next = stateSinkHardReset
+
+			// Errors caused by ctx being done (e.g. aborted transmission) are
+			// not recovered from since Run is returning anyway.
+
+			if ctx.Err() != nil {
+				pe.exit(cur, !entering)
+				return
+			}
+			next = pe.recover(cur)
 		}
 
 		if next != nil {
 			if cur.Exit != nil {
 				if err = cur.Exit(pe); err != nil {
-					next = stateSinkHardReset
+					next = pe.recover(cur)
 				}
 			}
+			pe.notifyTransition(cur, next)
 			cur = next
 			entering = true
 		}
@@ -269,21 +1119,146 @@ func (pe *PolicyEngine) Run(ctx context.Context) {
 
 }
 
+// recover returns the state to go to in order to recover from an error in state
+// cur, based on the recovery policy.
+func (pe *PolicyEngine) recover(cur *state) *state {
+	pe.mu.Lock()
+	rp := pe.recovery
+	pe.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(pe.lastFailure) > recoveryWindow {
+		pe.failRetries = 0
+		pe.failSoftResets = 0
+	}
+	pe.lastFailure = now
+
+	if pe.failRetries < rp.retries && cur != stateSinkHardReset {
+		pe.failRetries++
+		return cur
+	}
+	if pe.failSoftResets < rp.softResets && pe.explicitContract && cur != stateSinkSoftReset {
+		pe.failSoftResets++
+		return stateSinkSoftReset
+	}
+	return stateSinkHardReset
+}
+
+// exit exits the current state cur, if entered, on Run return so that it
+// doesn't leave the port controller in a special mode such as BIST carrier. It
+// then resets the port controller if configured to do so.
+func (pe *PolicyEngine) exit(cur *state, entered bool) {
+	if entered && cur.Exit != nil {
+		_ = cur.Exit(pe)
+	}
+	pe.mu.Lock()
+	reset := pe.resetOnEnd
+	pe.mu.Unlock()
+	if !reset {
+		return
+	}
+	if pe.explicitContract {
+		pe.notifyEvent(EventPowerNotReady)
+		_ = pe.pc.SendReset()
+		pe.explicitContract = false
+	}
+	_ = pe.pc.Init()
+}
+
+// handleRequest handles a pending user request. It must only be called in the
+// sink ready or no PD states.
+func (pe *PolicyEngine) handleRequest(cur *state, r request) (*state, error) {
+	if cur == stateNoPD {
+		if r == requestRenegotiate {
+			return stateNoPD, nil
+		}
+		return nil, nil
+	}
+	switch r {
+	case requestRenegotiate:
+		if !pe.explicitContract {
+			return nil, nil
+		}
+		if rdo := pe.evaluateCapabilities(); rdo != pe.requestDO {
+			pe.requestDO = rdo
+			return stateSinkSelectCapabilities, nil
+		}
+	case requestProfile:
+		pe.mu.Lock()
+		rdo := pe.profileRDO
+		pe.mu.Unlock()
+
+		// Source capabilities may have changed since the request was made
+
+		if !pe.explicitContract || !validRequest(rdo, pe.pdoAt(rdo.SelectedObjectPosition())) {
+			return nil, nil
+		}
+		pe.requestDO = rdo
+		return stateSinkSelectCapabilities, nil
+	case requestSourceCap:
+		return stateSinkGetSourceCap, nil
+	case requestSoftReset:
+		return stateSinkSoftReset, nil
+	case requestPing:
+		return nil, pe.sendControl(pdmsg.TypePing)
+	case requestStatus, requestBatteryCap, requestSourceCapExt:
+		if pe.msgTpl.Revision() < pdmsg.Revision30 {
+			pe.notifyEvent(EventNotSupported)
+			return nil, nil
+		}
+		switch r {
+		case requestBatteryCap:
+			return stateSinkGetBatteryCap, nil
+		case requestSourceCapExt:
+			return stateSinkGetSourceCapExt, nil
+		}
+		return stateSinkGetStatus, nil
+	}
+	return nil, nil
+}
+
 func (pe *PolicyEngine) tx(m pdmsg.Message) error {
 	m.SetID(pe.nextTxID)
 	pe.nextTxID = (pe.nextTxID + 1) % 8
-	return pe.pc.Tx(m)
+	pe.notifyMessage(m, true)
+	var err error
+	if ctp, ok := pe.pc.(typec.ContextTxer); ok && pe.ctx != nil {
+		err = ctp.TxContext(pe.ctx, m)
+	} else {
+		err = pe.pc.Tx(m)
+	}
+	pe.mu.Lock()
+	if err == nil {
+		pe.stats.Tx++
+	} else {
+		pe.stats.TxFailed++
+	}
+	pe.mu.Unlock()
+	return err
 }
 
 func (pe *PolicyEngine) rx() (pdmsg.Message, error) {
-	// Discard duplicate messages
+	// Discard duplicate messages and those not from the port partner
 	for {
 		m, err := pe.pc.Rx()
 		if err != nil {
 			return pdmsg.Message{}, err
 		}
-		if m.ID() != pe.lastRxID {
+		pe.notifyMessage(m, false)
+
+		// Soft_Reset always has ID 0 and resets the message ID counters, so it
+		// must not be mistaken for a duplicate of a previous message with ID 0.
+
+		if m.SOP == pdmsg.SOPPort && isControl(m, pdmsg.TypeSoftReset) {
+			pe.nextTxID = 0
+			pe.lastRxID = 8
+		}
+		if m.SOP == pdmsg.SOPPort && m.ID() != pe.lastRxID {
 			pe.lastRxID = m.ID()
+			pe.lastRx = time.Now()
+			pe.mu.Lock()
+			pe.stats.Rx++
+			pe.mu.Unlock()
 			return m, nil
 		}
 	}
@@ -297,17 +1272,186 @@ func (pe *PolicyEngine) startTimer(d time.Duration) {
 // profile.
 func (pe *PolicyEngine) ppsNegotiated() bool {
 	p := pe.requestDO.SelectedObjectPosition()
-	return p > 0 && pdmsg.PDO(pe.sourceCapMsg.Data[p-1]).Type() == pdmsg.PDOTypePPS
+	return p > 0 && pe.pdoAt(p).Type() == pdmsg.PDOTypePPS
+}
+
+// keepContract sets the request back to that of the contract in effect, after
+// the source rejected or deferred a new request.
+func (pe *PolicyEngine) keepContract() {
+	pe.mu.Lock()
+	pe.requestDO = pe.contract.rdo
+	pe.mu.Unlock()
+}
+
+// pdoAt returns the PDO at position p (starting at 1) of the source
+// capabilities in effect, or 0 if there is no such PDO.
+func (pe *PolicyEngine) pdoAt(p uint8) pdmsg.PDO {
+	if pe.eprMode {
+		if p > 0 && p <= pe.eprCapsLen {
+			return pe.eprCaps[p-1]
+		}
+		return 0
+	}
+	if p > 0 && p <= pe.sourceCapMsg.DataObjectCount() {
+		return pdmsg.PDO(pe.sourceCapMsg.Data[p-1])
+	}
+	return 0
 }
 
+// evaluateCapabilities passes the last received source capabilities to the
+// capability evaluator and returns its response.
+func (pe *PolicyEngine) evaluateCapabilities() pdmsg.RequestDO {
+	var l uint8
+	if pe.eprMode {
+		l = pe.eprCapsLen
+		copy(pe.pdoBuf[:], pe.eprCaps[:l])
+	} else {
+		l = pe.sourceCapMsg.DataObjectCount()
+		for i, d := range pe.sourceCapMsg.Data[:l] {
+			pe.pdoBuf[i] = pdmsg.PDO(d)
+		}
+	}
+	pe.mu.Lock()
+	pe.srcCapsLen = uint8(copy(pe.srcCaps[:], pe.pdoBuf[:l]))
+	pe.mu.Unlock()
+	return pe.evalCaps(pe.pdoBuf[:l])
+}
+
+// sendRDO sends a request, or an EPR request in EPR mode, for rdo.
 func (pe *PolicyEngine) sendRDO(rdo pdmsg.RequestDO) error {
 	m := pe.msgTpl
-	m.SetType(pdmsg.TypeRequest)
-	m.SetDataObjectCount(1)
+	if m.Revision() >= pdmsg.Revision30 {
+		rdo.SetGiveBack(false) // deprecated in PD 3.0
+	}
+	if pe.eprMode {
+		m.SetType(pdmsg.TypeEPRRequest)
+		m.SetDataObjectCount(2)
+		m.Data[1] = uint32(pe.pdoAt(rdo.SelectedObjectPosition()))
+	} else {
+		pe.mu.Lock()
+		rdo.SetEPRModeCapable(pe.eprPDP > 0)
+		pe.mu.Unlock()
+		m.SetType(pdmsg.TypeRequest)
+		m.SetDataObjectCount(1)
+	}
 	m.Data[0] = uint32(rdo)
 	return pe.tx(m)
 }
 
+func (pe *PolicyEngine) sendControl(t pdmsg.Type) error {
+	m := pe.msgTpl
+	m.SetType(t)
+	return pe.tx(m)
+}
+
+// sendNotSupported responds to a message the sink does not support, with
+// Not_Supported for PD 3.0 and Reject for earlier revisions.
+func (pe *PolicyEngine) sendNotSupported() error {
+	if pe.msgTpl.Revision() < pdmsg.Revision30 {
+		return pe.sendControl(pdmsg.TypeReject)
+	}
+	return pe.sendControl(pdmsg.TypeNotSupported)
+}
+
+func (pe *PolicyEngine) sendExtendedControl(t pdmsg.ExtendedControlType) error {
+	m := pe.msgTpl
+	m.SetExtended(true)
+	m.SetType(pdmsg.TypeExtendedControl)
+	m.SetExtendedData([]byte{byte(t), 0})
+	return pe.tx(m)
+}
+
+// rxExtended adds the chunk carried by m to the reassembly buffer and returns
+// true once all chunks of the message are received. Until then, it requests
+// the next chunk from the source. The reassembled data is in
+// extBuf[:extLen].
+func (pe *PolicyEngine) rxExtended(m pdmsg.Message) (bool, error) {
+	h := m.ExtendedHeader()
+	if h.IsRequestChunk() || int(h.DataSize()) > len(pe.extBuf) {
+		return false, nil
+	}
+	n := int(h.ChunkNumber())
+	if n == 0 {
+		pe.extLen = 0
+	} else if n*pdmsg.MaxExtendedChunkBytes != pe.extLen {
+		return false, nil // out of order chunk
+	}
+	pe.extLen += m.ExtendedData(pe.extBuf[pe.extLen:])
+	if pe.extLen >= int(h.DataSize()) {
+		return true, nil
+	}
+
+	// Request the next chunk
+
+	r := pe.msgTpl
+	r.SetExtended(true)
+	r.SetType(m.Type())
+	var rh pdmsg.ExtendedHeader
+	rh.SetChunked(true)
+	rh.SetChunkNumber(uint8(n + 1))
+	rh.SetRequestChunk(true)
+	r.SetExtendedHeader(rh)
+	r.SetDataObjectCount(1)
+	return false, pe.tx(r)
+}
+
+// rxEPRSourceCap handles a chunk of EPR source capabilities message and
+// returns true once the complete capabilities are received.
+func (pe *PolicyEngine) rxEPRSourceCap(m pdmsg.Message) (bool, error) {
+	done, err := pe.rxExtended(m)
+	if !done || err != nil {
+		return false, err
+	}
+	pe.eprCapsLen = 0
+	for i := 0; i+4 <= pe.extLen && int(pe.eprCapsLen) < len(pe.eprCaps); i += 4 {
+		b := pe.extBuf[i:]
+		pe.eprCaps[pe.eprCapsLen] = pdmsg.PDO(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24)
+		pe.eprCapsLen++
+	}
+	return true, nil
+}
+
+// shouldEnterEPR returns true if EPR mode is enabled, the source is EPR capable
+// and EPR mode has not been attempted yet.
+func (pe *PolicyEngine) shouldEnterEPR() bool {
+	pe.mu.Lock()
+	pdp := pe.eprPDP
+	pe.mu.Unlock()
+	return pdp > 0 && !pe.eprMode && !pe.eprAttempted && pe.explicitContract &&
+		pdmsg.PDO(pe.sourceCapMsg.Data[0]).Type() == pdmsg.PDOTypeFixedSupply &&
+		pdmsg.FixedSupplyPDO(pe.sourceCapMsg.Data[0]).IsEPRModeCapable()
+}
+
+// isControl returns true if m is a control message of type t.
+func isControl(m pdmsg.Message, t pdmsg.Type) bool {
+	return !m.IsData() && m.Type() == t
+}
+
+// isData returns true if m is a data message of type t.
+func isData(m pdmsg.Message, t pdmsg.Type) bool {
+	return m.IsData() && !m.IsExtended() && m.Type() == t
+}
+
+// isSourceCap returns true if m is a well formed source capabilities message,
+// i.e. it has between 1 and 7 PDOs and the first PDO is fixed supply at 5V as
+// required by the spec. Malformed source capabilities, e.g. from counterfeit
+// chargers, are ignored rather than passed to the capability evaluator.
+func isSourceCap(m pdmsg.Message) bool {
+	if !isData(m, pdmsg.TypeSourceCap) {
+		return false
+	}
+	if n := m.DataObjectCount(); n < 1 || n > pdmsg.MaxDataObjects {
+		return false
+	}
+	p := pdmsg.PDO(m.Data[0])
+	return p.Type() == pdmsg.PDOTypeFixedSupply && pdmsg.FixedSupplyPDO(p).Voltage() == 5000
+}
+
+// isExtended returns true if m is an extended message of type t.
+func isExtended(m pdmsg.Message, t pdmsg.Type) bool {
+	return m.IsExtended() && m.Type() == t
+}
+
 func (pe *PolicyEngine) notifyEvent(e Event) {
 	pe.callbacks.mu.Lock()
 	defer pe.callbacks.mu.Unlock()
@@ -316,6 +1460,120 @@ func (pe *PolicyEngine) notifyEvent(e Event) {
 	}
 }
 
+// request is a set of pending requests made by the users of the policy engine
+// which are handled by the Run loop once the engine is in the sink ready state.
+type request uint8
+
+// Requests are listed in order of priority from highest to lowest.
+const (
+	requestNone        request = 0
+	requestRenegotiate request = 1 << (iota - 1)
+	requestProfile
+	requestSourceCap
+	requestStatus
+	requestBatteryCap
+	requestSourceCapExt
+	requestSoftReset
+	requestPing
+)
+
+// add adds the requests v to the set.
+func (r *request) add(v request) {
+	*r |= v
+}
+
+// pop returns the next high priority request and clears it.
+func (r *request) pop() request {
+	v := *r & -*r // lowest set bit
+	*r &^= v
+	return v
+}
+
+// swapDataRole accepts or rejects a data role swap request based on the
+// configuration.
+func (pe *PolicyEngine) swapDataRole() error {
+	pe.mu.Lock()
+	accept := pe.acceptDRSw
+	pe.mu.Unlock()
+	if !accept {
+		return pe.sendControl(pdmsg.TypeReject)
+	}
+	if err := pe.sendControl(pdmsg.TypeAccept); err != nil {
+		return err
+	}
+	r := pdmsg.DataRoleDFP
+	if pe.msgTpl.DataRole() == pdmsg.DataRoleDFP {
+		r = pdmsg.DataRoleUFP
+	}
+	pe.msgTpl.SetDataRole(r)
+	pe.mu.Lock()
+	pe.dataRole = r
+	pe.mu.Unlock()
+	if drs, ok := pe.pc.(typec.DataRoleSetter); ok {
+		if err := drs.SetDataRole(r); err != nil {
+			return err
+		}
+	}
+	pe.notifyEvent(EventDRSwap)
+	return nil
+}
+
+// LastAlert returns the last alert data object received from the source.
+// LastAlert may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) LastAlert() pdmsg.AlertDO {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.lastAlert
+}
+
+// SetStatusOnAlert sets whether the status of the source is requested, as with
+// RequestStatus, when the source alerts of a change in its operating condition
+// or input. It is disabled by default.
+// SetStatusOnAlert may be called concurrently from multiple goroutines.
+func (pe *PolicyEngine) SetStatusOnAlert(request bool) {
+	pe.mu.Lock()
+	pe.statusOnAlert = request
+	pe.mu.Unlock()
+}
+
+// notifyAlert records the alert data object and notifies the event handler of
+// the alert and the faults reported in it.
+func (pe *PolicyEngine) notifyAlert(ado pdmsg.AlertDO) {
+	t := ado.Type()
+	pe.mu.Lock()
+	pe.lastAlert = ado
+	if pe.statusOnAlert && t&(pdmsg.AlertOperatingConditionChange|pdmsg.AlertSourceInputChange) != 0 {
+		pe.requests.add(requestStatus)
+	}
+	pe.mu.Unlock()
+	pe.notifyEvent(EventSourceAlert)
+	if t&pdmsg.AlertOverCurrent != 0 {
+		pe.notifyEvent(EventOverCurrent)
+	}
+	if t&pdmsg.AlertOverVoltage != 0 {
+		pe.notifyEvent(EventOverVoltage)
+	}
+	if t&pdmsg.AlertOverTemperature != 0 {
+		pe.notifyEvent(EventOverTemperature)
+	}
+}
+
+func (pe *PolicyEngine) notifyMessage(m pdmsg.Message, tx bool) {
+	pe.callbacks.mu.Lock()
+	defer pe.callbacks.mu.Unlock()
+	if pe.callbacks.msgObserver != nil {
+		pe.callbacks.msgObserver(m, tx)
+	}
+}
+
+func (pe *PolicyEngine) notifyTransition(from, to *state) {
+	pe.callbacks.mu.Lock()
+	defer pe.callbacks.mu.Unlock()
+	if pe.callbacks.stateObserver != nil {
+		pe.callbacks.stateObserver(from.Name, to.Name)
+	}
+}
+
 // state represents a policy engine state.
 type state struct {
 	Name string
@@ -342,7 +1600,9 @@ type state struct {
 	Exit func(*PolicyEngine) error
 }
 
-// The state names are almost the same as those in the PD spec.
+// The state names are almost the same as those in the PD spec. States are
+// stateless and shared between all policy engines. All per port state lives in
+// PolicyEngine.
 var (
 	stateNoPD                     *state
 	stateSinkStartup              *state
@@ -352,6 +1612,13 @@ var (
 	stateSinkSelectCapabilities   *state
 	stateSinkTransitionSink       *state
 	stateSinkReady                *state
+	stateSinkGetSourceCap         *state
+	stateSinkEPRModeEntry         *state
+	stateSinkGetStatus            *state
+	stateSinkSoftReset            *state
+	stateSinkGetBatteryCap        *state
+	stateSinkGetSourceCapExt      *state
+	stateSinkBISTCarrier          *state
 	stateSinkHardReset            *state
 )
 
@@ -370,11 +1637,25 @@ func init() {
 	stateNoPD = &state{
 		Name: "no-pd",
 		Enter: func(pe *PolicyEngine) (*state, error) {
-			pe.pdoBuf[0] = pdmsg.PDO(pe.v5PDO)
+			pe.mu.Lock()
+			minCur := pe.minNonPD
+			v5PDO := pe.v5PDO
+			pdo := pe.nonPDPDO
+			pe.mu.Unlock()
+			if pdo == 0 {
+				if v5PDO.MaxCurrent() < minCur {
+					pe.notifyEvent(EventPowerNotReady)
+					return nil, nil
+				}
+				pdo = pdmsg.PDO(v5PDO)
+			}
+			pe.pdoBuf[0] = pdo
 			rdo := pe.evalCaps(pe.pdoBuf[:1])
-			if rdo == pdmsg.EmptyRequestDO {
+			if rdo.SelectedObjectPosition() == 0 {
 				pe.notifyEvent(EventPowerNotReady)
 			} else {
+				pe.attachedAt = time.Time{}
+				pe.negOverdue = false
 				pe.notifyEvent(EventAccepted)
 				pe.notifyEvent(EventPowerReady)
 			}
@@ -390,8 +1671,20 @@ func init() {
 		Enter: func(pe *PolicyEngine) (*state, error) {
 			pe.nextTxID = 0
 			pe.lastRxID = 8 // impossible ID meaning no message received yet
+			pe.msgTpl.SetDataRole(pdmsg.DataRoleUFP)
+			pe.eprMode = false
+			pe.eprAttempted = false
+			pe.mu.Lock()
+			pe.requests = requestNone
+			pe.dataRole = pdmsg.DataRoleUFP
+			pe.revision = pdmsg.Revision10
+			pe.contract.pdo, pe.contract.rdo = 0, 0
+			pe.ppsRDO = 0
+			pe.srcCapsLen = 0
+			pe.mu.Unlock()
 			pe.notifyEvent(EventPowerNotReady)
 			pe.explicitContract = false
+			pe.gotoMin = false
 			return stateSinkDiscovery, pe.pc.Init()
 		},
 	}
@@ -400,6 +1693,12 @@ func init() {
 		Name: "sink-discovery",
 		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
 			if e == typec.EventAttached {
+
+				// Reattach after hard reset is part of the same negotiation
+
+				if pe.attachedAt.IsZero() {
+					pe.attachedAt = time.Now()
+				}
 				return stateSinkWaitForCapabilities, nil
 			}
 			return nil, nil
@@ -415,19 +1714,31 @@ func init() {
 		},
 		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
 			if e == typec.EventTimerTimeout {
-				if pe.v5PDO.MaxCurrent() > 0 {
+				pe.mu.Lock()
+				v5Cur := pe.v5PDO.MaxCurrent()
+				nonPD := pe.nonPDPDO != 0
+				retries := pe.waitCapRetries
+				pe.mu.Unlock()
+				if pe.waitCapTimeouts < retries {
+					pe.waitCapTimeouts++
+					return stateSinkHardReset, nil
+				}
+				if v5Cur > 0 || nonPD {
 					return stateNoPD, nil
 				}
 				return stateSinkHardReset, nil
 			}
-			if e == typec.EventRx && m.IsData() && m.Type() == pdmsg.TypeSourceCap {
+			if e == typec.EventRx && isSourceCap(m) {
+				pe.waitCapTimeouts = 0
 				pe.sourceCapMsg = m
 				r := m.Revision()
-				if r < pdmsg.Revision30 {
-					pe.msgTpl.SetRevision(r)
-				} else {
-					pe.msgTpl.SetRevision(pdmsg.Revision30)
+				if r > pdmsg.Revision30 {
+					r = pdmsg.Revision30
 				}
+				pe.msgTpl.SetRevision(r)
+				pe.mu.Lock()
+				pe.revision = r
+				pe.mu.Unlock()
 				return stateSinkEvaluateCapabilities, nil
 			}
 			return nil, nil
@@ -437,11 +1748,7 @@ func init() {
 	stateSinkEvaluateCapabilities = &state{
 		Name: "sink-eval-cap",
 		Enter: func(pe *PolicyEngine) (*state, error) {
-			l := pe.sourceCapMsg.DataObjectCount()
-			for i, d := range pe.sourceCapMsg.Data[:l] {
-				pe.pdoBuf[i] = pdmsg.PDO(d)
-			}
-			pe.requestDO = pe.evalCaps(pe.pdoBuf[:l])
+			pe.requestDO = pe.evaluateCapabilities()
 			return stateSinkSelectCapabilities, nil
 		},
 	}
@@ -450,8 +1757,10 @@ func init() {
 		Name: "sink-select-cap",
 		Enter: func(pe *PolicyEngine) (*state, error) {
 			rdo := pe.requestDO
-			if rdo == pdmsg.EmptyRequestDO {
+			if rdo.SelectedObjectPosition() == 0 {
+				mismatch := rdo.CapabilityMismatch()
 				rdo = defaultRDO
+				rdo.SetCapabilityMismatch(mismatch)
 			}
 			if err := pe.sendRDO(rdo); err != nil {
 				return nil, err
@@ -466,19 +1775,30 @@ func init() {
 			if e == typec.EventRx && !m.IsData() {
 				switch m.Type() {
 				case pdmsg.TypeAccept:
+					rdo := pe.requestDO
+					if rdo.SelectedObjectPosition() == 0 {
+						rdo = defaultRDO
+					}
+					pe.mu.Lock()
+					pe.contract.pdo, pe.contract.rdo = pe.pdoAt(rdo.SelectedObjectPosition()), rdo
+					pe.mu.Unlock()
 					pe.notifyEvent(EventAccepted)
 					pe.waitingOnSource = false
 					pe.explicitContract = true
+					pe.gotoMin = false
 					return stateSinkTransitionSink, nil
 				case pdmsg.TypeReject:
 					pe.notifyEvent(EventRejected)
 					if pe.explicitContract {
+						pe.keepContract()
 						return stateSinkReady, nil
 					}
 					return stateSinkWaitForCapabilities, nil
 				case pdmsg.TypeWait:
 					pe.waitingOnSource = true
 					if pe.explicitContract {
+						pe.waitRDO = pe.requestDO
+						pe.keepContract()
 						return stateSinkReady, nil
 					}
 					return stateSinkWaitForCapabilities, nil
@@ -498,7 +1818,12 @@ func init() {
 			if e == typec.EventTimerTimeout {
 				return stateSinkHardReset, nil
 			}
-			if e == typec.EventRx && !m.IsData() && m.Type() == pdmsg.TypePSReady {
+			if e == typec.EventRx && isControl(m, pdmsg.TypePSReady) {
+				if pe.requestDO.SelectedObjectPosition() > 0 && !pe.gotoMin {
+					pe.attachedAt = time.Time{}
+					pe.negOverdue = false
+					pe.notifyEvent(EventPowerReady)
+				}
 				return stateSinkReady, nil
 			}
 			return nil, nil
@@ -508,11 +1833,25 @@ func init() {
 	stateSinkReady = &state{
 		Name: "sink-ready",
 		Enter: func(pe *PolicyEngine) (*state, error) {
-			if pe.requestDO != pdmsg.EmptyRequestDO {
-				pe.notifyEvent(EventPowerReady)
+			pe.hardResetCount = 0
+			pe.hardResetDetach = false
+			pe.watchdogProbe = false
+			pe.lastRx = time.Now()
+			pe.mu.Lock()
+			pe.ppsRDO = 0
+			if pe.ppsNegotiated() {
+				pe.ppsRDO = pe.requestDO
+			}
+			pe.mu.Unlock()
+			if pe.shouldEnterEPR() {
+				return stateSinkEPRModeEntry, nil
 			}
+			pe.keepAliveSent = false
 			if pe.waitingOnSource {
 				pe.startTimer(timerSinkRequest)
+			} else if pe.eprMode {
+				pe.ppsDue = time.Now().Add(timerSinkPPSPeriodic)
+				pe.startTimer(timerSinkEPRKeepAlive)
 			} else if pe.ppsNegotiated() {
 				pe.startTimer(timerSinkPPSPeriodic)
 			}
@@ -520,10 +1859,333 @@ func init() {
 		},
 		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
 			if e == typec.EventTimerTimeout {
+				if pe.eprMode && !pe.waitingOnSource {
+					if pe.keepAliveSent {
+						return stateSinkHardReset, nil
+					}
+
+					// The periodic PPS request, which the source answers
+					// like any other, is sent in place of a keep alive.
+
+					if pe.ppsNegotiated() && !time.Now().Before(pe.ppsDue) {
+						return stateSinkSelectCapabilities, nil
+					}
+					pe.keepAliveSent = true
+					pe.startTimer(timerSenderResponse)
+					return nil, pe.sendExtendedControl(pdmsg.ExtendedControlEPRKeepAlive)
+				}
+				if pe.waitingOnSource {
+					pe.requestDO = pe.waitRDO
+				}
 				return stateSinkSelectCapabilities, nil
-			} else if e == typec.EventRx && m.IsData() && m.Type() == pdmsg.TypeSourceCap {
+			} else if e == typec.EventRx && isExtended(m, pdmsg.TypeExtendedControl) {
+				var d [2]byte
+				if m.ExtendedData(d[:]) > 0 && pdmsg.ExtendedControlType(d[0]) == pdmsg.ExtendedControlEPRKeepAliveAck {
+					pe.keepAliveSent = false
+					pe.startTimer(timerSinkEPRKeepAlive)
+				}
+			} else if e == typec.EventRx && isData(m, pdmsg.TypeEPRMode) {
+				if pdmsg.EPRModeDO(m.Data[0]).Action() == pdmsg.EPRModeExit && pe.eprMode {
+					pe.eprMode = false
+					pe.notifyEvent(EventEPRModeExited)
+				}
+			} else if e == typec.EventRx && isExtended(m, pdmsg.TypeEPRSourceCap) {
+				if done, err := pe.rxEPRSourceCap(m); !done || err != nil {
+					return nil, err
+				}
+				if pe.eprMode {
+					pe.notifyEvent(EventSourceCapabilitiesChanged)
+					return stateSinkEvaluateCapabilities, nil
+				}
+			} else if e == typec.EventRx && isSourceCap(m) {
+				if !pe.eprMode && pe.contractMismatch(m) {
+					pe.notifyEvent(EventContractMismatch)
+				}
 				pe.sourceCapMsg = m
+				pe.notifyEvent(EventSourceCapabilitiesChanged)
 				return stateSinkEvaluateCapabilities, nil
+			} else if e == typec.EventRx && isControl(m, pdmsg.TypeSoftReset) {
+				if err := pe.sendControl(pdmsg.TypeAccept); err != nil {
+					return nil, err
+				}
+				return stateSinkWaitForCapabilities, nil
+			} else if e == typec.EventRx && isControl(m, pdmsg.TypePing) {
+				// Ping may be sent periodically by PD 2.0 sources and requires
+				// no response.
+			} else if e == typec.EventRx && isControl(m, pdmsg.TypeGotoMin) {
+				if !pe.requestDO.IsGiveBack() || pe.msgTpl.Revision() >= pdmsg.Revision30 {
+					return nil, pe.sendNotSupported()
+				}
+				pe.gotoMin = true
+				pe.notifyEvent(EventGotoMin)
+				return stateSinkTransitionSink, nil
+			} else if e == typec.EventRx && isControl(m, pdmsg.TypeGetSourceCap) {
+				return nil, pe.sendNotSupported()
+			} else if e == typec.EventRx && isControl(m, pdmsg.TypePRSwap) {
+				pe.notifyEvent(EventPRSwap)
+				return nil, pe.sendControl(pdmsg.TypeReject)
+			} else if e == typec.EventRx && isControl(m, pdmsg.TypeDRSwap) {
+				return nil, pe.swapDataRole()
+			} else if e == typec.EventRx && isControl(m, pdmsg.TypeFRSwap) {
+				pe.notifyEvent(EventFRSwap)
+			} else if e == typec.EventRx && isData(m, pdmsg.TypeAlert) {
+				pe.notifyAlert(pdmsg.AlertDO(m.Data[0]))
+			} else if e == typec.EventRx && isData(m, pdmsg.TypeBIST) {
+				// BIST test data mode requires no action by the sink other than
+				// ignoring messages until hard reset which is what we do anyway.
+				if _, ok := pe.pc.(typec.BISTTransmitter); ok && pdmsg.BISTDO(m.Data[0]).Mode() == pdmsg.BISTModeCarrier {
+					return stateSinkBISTCarrier, nil
+				}
+			}
+			return nil, nil
+		},
+	}
+
+	// Transmits BIST carrier mode pattern for the duration required by the
+	// standard. Only entered if the port controller implements
+	// typec.BISTTransmitter.
+	stateSinkBISTCarrier = &state{
+		Name: "sink-bist-carrier",
+		Enter: func(pe *PolicyEngine) (*state, error) {
+			pe.startTimer(timerBISTContMode)
+			return nil, pe.pc.(typec.BISTTransmitter).StartBIST()
+		},
+		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
+			if e == typec.EventTimerTimeout {
+				return stateSinkReady, nil
+			}
+			return nil, nil
+		},
+		Exit: func(pe *PolicyEngine) error {
+			return pe.pc.(typec.BISTTransmitter).StopBIST()
+		},
+	}
+
+	stateSinkGetSourceCap = &state{
+		Name: "sink-get-source-cap",
+		Enter: func(pe *PolicyEngine) (*state, error) {
+			var err error
+			if pe.eprMode {
+				err = pe.sendExtendedControl(pdmsg.ExtendedControlEPRGetSourceCap)
+			} else {
+				err = pe.sendControl(pdmsg.TypeGetSourceCap)
+			}
+			if err != nil {
+				return nil, err
+			}
+			pe.startTimer(timerSenderResponse)
+			return nil, nil
+		},
+		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
+			if e == typec.EventTimerTimeout {
+				// Source is alive if it sent anything in response to the probe
+
+				if pe.watchdogProbe && time.Since(pe.lastRx) >= timerSenderResponse {
+					return stateSinkHardReset, nil
+				}
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isSourceCap(m) {
+				pe.sourceCapMsg = m
+				return stateSinkEvaluateCapabilities, nil
+			}
+			if e == typec.EventRx && isControl(m, pdmsg.TypeNotSupported) {
+				pe.notifyEvent(EventNotSupported)
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isExtended(m, pdmsg.TypeEPRSourceCap) {
+				pe.startTimer(timerSenderResponse) // for the next chunk
+				if done, err := pe.rxEPRSourceCap(m); !done || err != nil {
+					return nil, err
+				}
+				return stateSinkEvaluateCapabilities, nil
+			}
+			return nil, nil
+		},
+	}
+
+	// Requests the source to enter EPR mode and waits for the EPR source
+	// capabilities that follow. On failure, returns to ready without EPR mode
+	// and does not try again until the next startup.
+	stateSinkEPRModeEntry = &state{
+		Name: "sink-epr-mode-entry",
+		Enter: func(pe *PolicyEngine) (*state, error) {
+			pe.eprAttempted = true
+			m := pe.msgTpl
+			m.SetType(pdmsg.TypeEPRMode)
+			m.SetDataObjectCount(1)
+			var d pdmsg.EPRModeDO
+			d.SetAction(pdmsg.EPRModeEnter)
+			pe.mu.Lock()
+			d.SetData(pe.eprPDP)
+			pe.mu.Unlock()
+			m.Data[0] = uint32(d)
+			if err := pe.tx(m); err != nil {
+				return nil, err
+			}
+			pe.startTimer(timerSinkEPREnter)
+			return nil, nil
+		},
+		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
+			if e == typec.EventTimerTimeout {
+				if pe.eprMode { // entered but no capabilities received
+					return stateSinkHardReset, nil
+				}
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isData(m, pdmsg.TypeEPRMode) {
+				switch pdmsg.EPRModeDO(m.Data[0]).Action() {
+				case pdmsg.EPRModeEnterSucceeded:
+					pe.eprMode = true
+					pe.eprCapsLen = 0
+					pe.notifyEvent(EventEPRModeEntered)
+					pe.startTimer(timerSinkWaitCap)
+				case pdmsg.EPRModeEnterFailed:
+					return stateSinkReady, nil
+				}
+			}
+			if e == typec.EventRx && isControl(m, pdmsg.TypeNotSupported) && !pe.eprMode {
+				pe.notifyEvent(EventNotSupported)
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isExtended(m, pdmsg.TypeEPRSourceCap) && pe.eprMode {
+				if done, err := pe.rxEPRSourceCap(m); !done || err != nil {
+					return nil, err
+				}
+				return stateSinkEvaluateCapabilities, nil
+			}
+			return nil, nil
+		},
+	}
+
+	stateSinkGetStatus = &state{
+		Name: "sink-get-status",
+		Enter: func(pe *PolicyEngine) (*state, error) {
+			if err := pe.sendControl(pdmsg.TypeGetStatus); err != nil {
+				return nil, err
+			}
+			pe.startTimer(timerSenderResponse)
+			return nil, nil
+		},
+		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
+			if e == typec.EventTimerTimeout {
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isControl(m, pdmsg.TypeNotSupported) {
+				pe.notifyEvent(EventNotSupported)
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isExtended(m, pdmsg.TypeStatus) {
+				pe.startTimer(timerSenderResponse) // for the next chunk
+				if done, err := pe.rxExtended(m); !done || err != nil {
+					return nil, err
+				}
+				s := pdmsg.ParseStatus(pe.extBuf[:pe.extLen])
+				pe.mu.Lock()
+				pe.status = s
+				pe.mu.Unlock()
+				pe.notifyEvent(EventStatus)
+				return stateSinkReady, nil
+			}
+			return nil, nil
+		},
+	}
+
+	stateSinkGetBatteryCap = &state{
+		Name: "sink-get-battery-cap",
+		Enter: func(pe *PolicyEngine) (*state, error) {
+			pe.mu.Lock()
+			ref := pe.batteryRef
+			pe.mu.Unlock()
+			m := pe.msgTpl
+			m.SetExtended(true)
+			m.SetType(pdmsg.TypeGetBatteryCap)
+			m.SetExtendedData([]byte{ref})
+			if err := pe.tx(m); err != nil {
+				return nil, err
+			}
+			pe.startTimer(timerSenderResponse)
+			return nil, nil
+		},
+		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
+			if e == typec.EventTimerTimeout {
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isControl(m, pdmsg.TypeNotSupported) {
+				pe.notifyEvent(EventNotSupported)
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isExtended(m, pdmsg.TypeBatteryCap) {
+				pe.startTimer(timerSenderResponse) // for the next chunk
+				if done, err := pe.rxExtended(m); !done || err != nil {
+					return nil, err
+				}
+				c := pdmsg.ParseBatteryCapabilities(pe.extBuf[:pe.extLen])
+				pe.mu.Lock()
+				pe.batteryCap = c
+				pe.mu.Unlock()
+				pe.notifyEvent(EventBatteryCapabilities)
+				return stateSinkReady, nil
+			}
+			return nil, nil
+		},
+	}
+
+	stateSinkGetSourceCapExt = &state{
+		Name: "sink-get-source-cap-ext",
+		Enter: func(pe *PolicyEngine) (*state, error) {
+			if err := pe.sendControl(pdmsg.TypeGetSourceCapExtended); err != nil {
+				return nil, err
+			}
+			pe.startTimer(timerSenderResponse)
+			return nil, nil
+		},
+		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
+			if e == typec.EventTimerTimeout {
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isControl(m, pdmsg.TypeNotSupported) {
+				pe.notifyEvent(EventNotSupported)
+				return stateSinkReady, nil
+			}
+			if e == typec.EventRx && isExtended(m, pdmsg.TypeSourceCapExtended) {
+				pe.startTimer(timerSenderResponse) // for the next chunk
+				if done, err := pe.rxExtended(m); !done || err != nil {
+					return nil, err
+				}
+				c := pdmsg.ParseSourceCapabilitiesExtended(pe.extBuf[:pe.extLen])
+				pe.mu.Lock()
+				pe.srcCapExt = c
+				pe.mu.Unlock()
+				pe.notifyEvent(EventSourceCapabilitiesExtended)
+				return stateSinkReady, nil
+			}
+			return nil, nil
+		},
+	}
+
+	// Resets the protocol layer of both ends without affecting power, after
+	// which the source sends its capabilities again.
+	stateSinkSoftReset = &state{
+		Name: "sink-soft-reset",
+		Enter: func(pe *PolicyEngine) (*state, error) {
+			pe.nextTxID = 0
+			pe.lastRxID = 8 // impossible ID meaning no message received yet
+			pe.mu.Lock()
+			pe.stats.SoftResets++
+			pe.mu.Unlock()
+			if err := pe.sendControl(pdmsg.TypeSoftReset); err != nil {
+				return nil, err
+			}
+			pe.startTimer(timerSenderResponse)
+			return nil, nil
+		},
+		Process: func(pe *PolicyEngine, m pdmsg.Message, e typec.Event) (*state, error) {
+			if e == typec.EventTimerTimeout {
+				return stateSinkHardReset, nil
+			}
+			if e == typec.EventRx && isControl(m, pdmsg.TypeAccept) {
+				return stateSinkWaitForCapabilities, nil
 			}
 			return nil, nil
 		},
@@ -533,6 +2195,15 @@ func init() {
 		Name: "sink-hard-reset",
 		Enter: func(pe *PolicyEngine) (*state, error) {
 			pe.notifyEvent(EventPowerNotReady)
+			pe.mu.Lock()
+			pe.stats.HardResets++
+			pe.mu.Unlock()
+			if pe.hardResetCount <= nHardResetCount {
+				if pe.hardResetCount++; pe.hardResetCount > nHardResetCount {
+					pe.notifyEvent(EventNegotiationFailed)
+				}
+			}
+			pe.hardResetDetach = true
 			_ = pe.pc.SendReset()
 			return stateSinkStartup, nil
 		},
@@ -540,11 +2211,22 @@ func init() {
 
 }
 
+// nHardResetCount is the number of consecutive hard resets after which
+// negotiation is considered failed (based on PD standard).
+const nHardResetCount = 2
+
+// recoveryWindow is the time without errors after which the recovery counts
+// are reset.
+const recoveryWindow = 10 * time.Second
+
 // Max value for timers used (based on PD standard).
 const (
-	timerPSTransition    = 550 * time.Millisecond
-	timerSenderResponse  = 32 * time.Millisecond
-	timerSinkPPSPeriodic = 10 * time.Second
-	timerSinkRequest     = 100 * time.Millisecond
-	timerSinkWaitCap     = 620 * time.Millisecond
+	timerBISTContMode     = 60 * time.Millisecond
+	timerPSTransition     = 550 * time.Millisecond
+	timerSenderResponse   = 32 * time.Millisecond
+	timerSinkPPSPeriodic  = 10 * time.Second
+	timerSinkEPREnter     = 500 * time.Millisecond
+	timerSinkEPRKeepAlive = 500 * time.Millisecond
+	timerSinkRequest      = 100 * time.Millisecond
+	timerSinkWaitCap      = 620 * time.Millisecond
 )
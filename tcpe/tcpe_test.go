@@ -0,0 +1,908 @@
+package tcpe
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oxplot/go-typec"
+	"github.com/oxplot/go-typec/pdmsg"
+	"github.com/oxplot/go-typec/tcpcdriver/mock"
+)
+
+// testSource simulates a source on a mock port controller. It attaches and
+// sends its capabilities whenever the policy engine enters discovery, unless
+// it is a non-PD source, and accepts all requests unless told otherwise.
+type testSource struct {
+	pc *mock.PortController
+
+	mu      sync.Mutex
+	nextID  uint8
+	ignore  int          // number of requests to leave unanswered
+	replies []pdmsg.Type // replies to the next requests instead of Accept
+	nonPD   bool         // attach without sending capabilities
+	drop    bool         // drop VBUS on hard reset, reported as detach
+	cap     pdmsg.Message
+	state   string
+	stateCh chan string
+}
+
+// newTestSource creates a source offering 5V and 9V at 3A and a policy engine
+// attached to it. The engine is not started.
+func newTestSource() (*testSource, *PolicyEngine) {
+	s := &testSource{
+		pc:      mock.New(),
+		stateCh: make(chan string, 100),
+	}
+	s.cap.SetType(pdmsg.TypeSourceCap)
+	s.cap.SetPowerRole(pdmsg.PowerRoleSource)
+	s.cap.SetDataRole(pdmsg.DataRoleDFP)
+	s.cap.SetRevision(pdmsg.Revision30)
+	s.cap.SetDataObjectCount(2)
+	for i, v := range []uint16{5000, 9000} {
+		p := pdmsg.NewFixedSupplyPDO()
+		p.SetVoltage(v)
+		p.SetMaxCurrent(3000)
+		s.cap.Data[i] = uint32(p)
+	}
+	s.pc.SetTxHandler(s.handleTx)
+	return s, s.newEngine(s.pc)
+}
+
+// newEngine creates a policy engine on pc, which must wrap s.pc. The engine
+// requests the highest voltage offered.
+func (s *testSource) newEngine(pc typec.PortController) *PolicyEngine {
+	pe := New(pc)
+	pe.SetCapabilityEvaluator(highestPDO)
+	pe.SetStateObserver(s.observeState)
+	return pe
+}
+
+// highestPDO requests 1A from the last PDO offered.
+var highestPDO = CapabilityEvaluatorFunc(func(pdos []pdmsg.PDO) pdmsg.RequestDO {
+	rdo := pdmsg.EmptyRequestDO
+	rdo.SetSelectedObjectPosition(uint8(len(pdos)))
+	rdo.SetFixedOperatingCurrent(1000)
+	rdo.SetFixedMaxOperatingCurrent(1000)
+	return rdo
+})
+
+// message returns a message of type t from the source with the next message
+// ID.
+func (s *testSource) message(t pdmsg.Type) pdmsg.Message {
+	m := s.cap
+	m.SetType(t)
+	m.SetDataObjectCount(0)
+	m.Data = [pdmsg.MaxDataObjects]uint32{}
+	m.SetID(s.nextID)
+	s.nextID = (s.nextID + 1) % 8
+	return m
+}
+
+// sourceCap returns the source capabilities message with the next message ID.
+func (s *testSource) sourceCap() pdmsg.Message {
+	m := s.cap
+	m.SetID(s.nextID)
+	s.nextID = (s.nextID + 1) % 8
+	return m
+}
+
+func (s *testSource) observeState(from, to string) {
+	s.mu.Lock()
+	s.state = to
+	if to == "sink-hard-reset" && s.drop {
+		s.pc.QueueEvent(typec.EventDetached)
+	}
+	if to == "sink-discovery" {
+		s.nextID = 0
+		s.pc.QueueEvent(typec.EventAttached)
+		if s.nonPD {
+			s.pc.QueueEvent(typec.EventPower3A0)
+		} else {
+			s.pc.QueueRx(s.sourceCap())
+		}
+	}
+	s.mu.Unlock()
+	select {
+	case s.stateCh <- to:
+	default:
+	}
+}
+
+func (s *testSource) handleTx(m pdmsg.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case m.IsData() && m.Type() == pdmsg.TypeRequest:
+		if s.ignore > 0 {
+			s.ignore--
+			return nil
+		}
+		if len(s.replies) > 0 {
+			s.pc.QueueRx(s.message(s.replies[0]))
+			s.replies = s.replies[1:]
+			return nil
+		}
+		s.pc.QueueRx(s.message(pdmsg.TypeAccept), s.message(pdmsg.TypePSReady))
+	case !m.IsData() && m.Type() == pdmsg.TypeGetSourceCap:
+		s.pc.QueueRx(s.sourceCap())
+	}
+	return nil
+}
+
+// currentState returns the state the policy engine last entered.
+func (s *testSource) currentState() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// waitState waits until the policy engine enters state name.
+func (s *testSource) waitState(t *testing.T, name string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case st := <-s.stateCh:
+			if st == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %s", name)
+		}
+	}
+}
+
+// run runs pe until the test ends.
+func run(t *testing.T, pe *PolicyEngine) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pe.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor waits until cond returns true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestMessageIDWraparound(t *testing.T) {
+	s, pe := newTestSource()
+	run(t, pe)
+	s.waitState(t, "sink-ready")
+
+	// Each Get_Source_Cap is followed by a request, and each source
+	// capabilities by Accept and PS_RDY, so both counters wrap around
+
+	const cycles = 4
+	for i := 1; i <= cycles; i++ {
+		pe.RequestSourceCapabilities()
+		waitFor(t, "evaluation", func() bool { return pe.Stats().Evaluations == uint32(i+1) })
+		s.waitState(t, "sink-ready")
+	}
+	sent := s.pc.Sent()
+	if len(sent) != 1+2*cycles {
+		t.Fatalf("got %d sent messages, want %d", len(sent), 1+2*cycles)
+	}
+	for i, m := range sent {
+		if m.ID() != uint8(i%8) {
+			t.Errorf("sent message %d: got ID %d, want %d", i, m.ID(), i%8)
+		}
+	}
+	if rx := pe.Stats().Rx; rx != 3*(1+cycles) {
+		t.Errorf("got %d received messages, want %d", rx, 3*(1+cycles))
+	}
+}
+
+func TestDuplicateMessageSuppression(t *testing.T) {
+	s, pe := newTestSource()
+
+	// Retransmission of source capabilities with the same ID, e.g. due to a
+	// lost GoodCRC
+
+	s.pc.QueueRx(s.sourceCap())
+	s.mu.Lock()
+	s.nextID = 0
+	s.mu.Unlock()
+	run(t, pe)
+	s.waitState(t, "sink-ready")
+	time.Sleep(20 * time.Millisecond) // let any duplicate be processed
+	if n := pe.Stats().Evaluations; n != 1 {
+		t.Errorf("got %d evaluations, want 1", n)
+	}
+	if n := len(s.pc.Sent()); n != 1 {
+		t.Errorf("got %d sent messages, want 1", n)
+	}
+	if n := pe.Stats().Rx; n != 3 {
+		t.Errorf("got %d received messages, want 3", n)
+	}
+}
+
+func TestInitialMessageIDAfterHardReset(t *testing.T) {
+	s, pe := newTestSource()
+
+	// The first request goes unanswered so the last message received before
+	// the hard reset is the source capabilities with ID 0, same as the first
+	// message after it.
+
+	s.ignore = 1
+	run(t, pe)
+	s.waitState(t, "sink-hard-reset")
+	s.waitState(t, "sink-ready")
+	if n := pe.Stats().Evaluations; n != 2 {
+		t.Errorf("got %d evaluations, want 2", n)
+	}
+	if n := s.pc.Resets(); n != 1 {
+		t.Errorf("got %d hard resets, want 1", n)
+	}
+	sent := s.pc.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("got %d sent messages, want 2", len(sent))
+	}
+	if sent[1].ID() != 0 {
+		t.Errorf("got ID %d for first message after hard reset, want 0", sent[1].ID())
+	}
+}
+
+func TestSoftResetAfterMessageIDZero(t *testing.T) {
+	s, pe := newTestSource()
+	run(t, pe)
+	s.waitState(t, "sink-ready")
+
+	// Two more negotiations leave ID 0 as the last received message ID
+
+	for i := 1; i <= 2; i++ {
+		pe.RequestSourceCapabilities()
+		waitFor(t, "evaluation", func() bool { return pe.Stats().Evaluations == uint32(i+1) })
+		s.waitState(t, "sink-ready")
+	}
+	s.mu.Lock()
+	if s.nextID != 1 {
+		t.Fatalf("got next source message ID %d, want 1", s.nextID)
+	}
+	s.nextID = 0
+	s.pc.QueueRx(s.message(pdmsg.TypeSoftReset), s.sourceCap())
+	s.mu.Unlock()
+	s.waitState(t, "sink-wait-for-cap")
+	s.waitState(t, "sink-ready")
+	if n := pe.Stats().Evaluations; n != 4 {
+		t.Errorf("got %d evaluations, want 4", n)
+	}
+	sent := s.pc.Sent()
+	if len(sent) != 7 {
+		t.Fatalf("got %d sent messages, want 7", len(sent))
+	}
+	if m := sent[5]; !isControl(m, pdmsg.TypeAccept) || m.ID() != 0 {
+		t.Errorf("got %v with ID %d after soft reset, want Accept with ID 0", m.Type(), m.ID())
+	}
+}
+
+func TestHardResetLimitWithDetach(t *testing.T) {
+	s, pe := newTestSource()
+	s.ignore = 100
+	s.drop = true
+	failed := make(chan struct{})
+	var once sync.Once
+	pe.SetEventHandler(EventHandlerFunc(func(e Event) {
+		if e == EventNegotiationFailed {
+			once.Do(func() { close(failed) })
+		}
+	}))
+	run(t, pe)
+	select {
+	case <-failed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no negotiation failure after %d hard resets", s.pc.Resets())
+	}
+	if n := s.pc.Resets(); n != nHardResetCount+1 {
+		t.Errorf("got negotiation failure after %d hard resets, want %d", n, nHardResetCount+1)
+	}
+}
+
+func TestNegotiationDeadlineWithDetach(t *testing.T) {
+	s, pe := newTestSource()
+	s.ignore = 100
+	s.drop = true
+	timeout := make(chan struct{})
+	var once sync.Once
+	pe.SetEventHandler(EventHandlerFunc(func(e Event) {
+		if e == EventNegotiationTimeout {
+			once.Do(func() { close(timeout) })
+		}
+	}))
+
+	// Each hard reset takes less than the deadline, so the deadline passes
+	// only if it is not restarted by the detach that follows the reset.
+
+	pe.SetNegotiationDeadline(150 * time.Millisecond)
+	run(t, pe)
+	select {
+	case <-timeout:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no negotiation timeout after %d hard resets", s.pc.Resets())
+	}
+}
+
+// profileRDO returns a request for 1A from the PDO at position p.
+func profileRDO(p uint8) pdmsg.RequestDO {
+	rdo := pdmsg.EmptyRequestDO
+	rdo.SetSelectedObjectPosition(p)
+	rdo.SetFixedOperatingCurrent(1000)
+	rdo.SetFixedMaxOperatingCurrent(1000)
+	return rdo
+}
+
+func TestValidRequest(t *testing.T) {
+	fixed := pdmsg.NewFixedSupplyPDO()
+	fixed.SetVoltage(5000)
+	fixed.SetMaxCurrent(2000)
+	variable := pdmsg.NewVariableSupplyPDO()
+	variable.SetMinVoltage(5000)
+	variable.SetMaxVoltage(12000)
+	variable.SetMaxCurrent(2000)
+	rdo := func(op, max uint16, f func(*pdmsg.RequestDO)) pdmsg.RequestDO {
+		r := pdmsg.EmptyRequestDO
+		r.SetSelectedObjectPosition(1)
+		r.SetFixedOperatingCurrent(op)
+		r.SetFixedMaxOperatingCurrent(max)
+		if f != nil {
+			f(&r)
+		}
+		return r
+	}
+	mismatch := func(r *pdmsg.RequestDO) { r.SetCapabilityMismatch(true) }
+	giveBack := func(r *pdmsg.RequestDO) { r.SetGiveBack(true) }
+	for _, pdo := range []pdmsg.PDO{pdmsg.PDO(fixed), pdmsg.PDO(variable)} {
+		for _, c := range []struct {
+			name string
+			rdo  pdmsg.RequestDO
+			want bool
+		}{
+			{"within", rdo(1000, 2000, nil), true},
+			{"no current", rdo(0, 2000, nil), false},
+			{"operating above max", rdo(2500, 2500, nil), false},
+			{"max above max", rdo(1000, 2500, nil), false},
+			{"max above max with mismatch", rdo(1000, 2500, mismatch), true},
+			{"min above max with give back", rdo(1000, 2500, giveBack), true},
+		} {
+			if got := validRequest(c.rdo, pdo); got != c.want {
+				t.Errorf("%s to PDO type %d: got %v, want %v", c.name, pdo.Type(), got, c.want)
+			}
+		}
+	}
+}
+
+func TestRejectKeepsContract(t *testing.T) {
+	s, pe := newTestSource()
+	var mu sync.Mutex
+	var powerReady int
+	pe.SetEventHandler(EventHandlerFunc(func(e Event) {
+		if e == EventPowerReady {
+			mu.Lock()
+			powerReady++
+			mu.Unlock()
+		}
+	}))
+	run(t, pe)
+	s.waitState(t, "sink-ready")
+
+	s.mu.Lock()
+	s.replies = []pdmsg.Type{pdmsg.TypeReject}
+	s.mu.Unlock()
+	if err := pe.RequestProfile(profileRDO(1)); err != nil {
+		t.Fatal(err)
+	}
+	s.waitState(t, "sink-select-cap")
+	s.waitState(t, "sink-ready")
+	if _, rdo, _ := pe.Contract(); rdo.SelectedObjectPosition() != 2 {
+		t.Errorf("got contract at position %d, want 2", rdo.SelectedObjectPosition())
+	}
+	mu.Lock()
+	if powerReady != 1 {
+		t.Errorf("got %d power ready events, want 1", powerReady)
+	}
+	mu.Unlock()
+
+	// The evaluator still picks the contract in effect, so there is nothing
+	// to renegotiate.
+
+	pe.Renegotiate()
+	time.Sleep(20 * time.Millisecond)
+	if n := len(s.pc.Sent()); n != 2 {
+		t.Errorf("got %d sent messages, want 2", n)
+	}
+}
+
+func TestWaitRepeatsRequest(t *testing.T) {
+	s, pe := newTestSource()
+	run(t, pe)
+	s.waitState(t, "sink-ready")
+
+	s.mu.Lock()
+	s.replies = []pdmsg.Type{pdmsg.TypeWait}
+	s.mu.Unlock()
+	if err := pe.RequestProfile(profileRDO(1)); err != nil {
+		t.Fatal(err)
+	}
+	s.waitState(t, "sink-select-cap")
+	s.waitState(t, "sink-ready")
+	if _, rdo, _ := pe.Contract(); rdo.SelectedObjectPosition() != 2 {
+		t.Errorf("got contract at position %d while waiting, want 2", rdo.SelectedObjectPosition())
+	}
+
+	// The deferred request is sent again once the sink request timer expires
+
+	s.waitState(t, "sink-select-cap")
+	s.waitState(t, "sink-ready")
+	sent := s.pc.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("got %d sent messages, want 3", len(sent))
+	}
+	if rdo := pdmsg.RequestDO(sent[2].Data[0]); rdo != profileRDO(1) {
+		t.Errorf("got repeated request %#08x, want %#08x", uint32(rdo), uint32(profileRDO(1)))
+	}
+	if _, rdo, _ := pe.Contract(); rdo.SelectedObjectPosition() != 1 {
+		t.Errorf("got contract at position %d, want 1", rdo.SelectedObjectPosition())
+	}
+}
+
+func TestNegotiatedRevision(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		source, want pdmsg.Revision
+	}{
+		{"2.0", pdmsg.Revision20, pdmsg.Revision20},
+		{"3.0", pdmsg.Revision30, pdmsg.Revision30},
+		{"reserved", pdmsg.Revision(0b11), pdmsg.Revision30},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, pe := newTestSource()
+			s.cap.SetRevision(c.source)
+			if r := pe.NegotiatedRevision(); r != pdmsg.Revision10 {
+				t.Errorf("got revision %d before negotiation, want %d", r, pdmsg.Revision10)
+			}
+			run(t, pe)
+			s.waitState(t, "sink-ready")
+			if r := pe.NegotiatedRevision(); r != c.want {
+				t.Errorf("got revision %d, want %d", r, c.want)
+			}
+			for _, m := range s.pc.Sent() {
+				if m.Revision() != c.want {
+					t.Errorf("got revision %d in sent message, want %d", m.Revision(), c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestContractMismatch(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		current uint16 // max current of 9V in the new capabilities
+		want    int    // number of mismatch events
+	}{
+		{"unchanged", 3000, 0},
+		{"at request", 1000, 0},
+		{"below request", 500, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, pe := newTestSource()
+			var mu sync.Mutex
+			var mismatches int
+			pe.SetEventHandler(EventHandlerFunc(func(e Event) {
+				if e == EventContractMismatch {
+					mu.Lock()
+					mismatches++
+					mu.Unlock()
+				}
+			}))
+			run(t, pe)
+			s.waitState(t, "sink-ready")
+
+			s.mu.Lock()
+			p := pdmsg.FixedSupplyPDO(s.cap.Data[1])
+			p.SetMaxCurrent(c.current)
+			s.cap.Data[1] = uint32(p)
+			s.pc.QueueRx(s.sourceCap())
+			s.mu.Unlock()
+			waitFor(t, "evaluation", func() bool { return pe.Stats().Evaluations == 2 })
+			s.waitState(t, "sink-ready")
+
+			mu.Lock()
+			defer mu.Unlock()
+			if mismatches != c.want {
+				t.Errorf("got %d contract mismatch events, want %d", mismatches, c.want)
+			}
+		})
+	}
+}
+
+// alertCounter counts the calls to Alert and records how many had been made
+// when each ping was returned by Rx.
+type alertCounter struct {
+	*mock.PortController
+	mu     sync.Mutex
+	alerts int
+	pings  []int
+}
+
+func (c *alertCounter) Alert() (typec.Event, error) {
+	c.mu.Lock()
+	c.alerts++
+	c.mu.Unlock()
+	return c.PortController.Alert()
+}
+
+func (c *alertCounter) Rx() (pdmsg.Message, error) {
+	m, err := c.PortController.Rx()
+	if err == nil && isControl(m, pdmsg.TypePing) {
+		c.mu.Lock()
+		c.pings = append(c.pings, c.alerts)
+		c.mu.Unlock()
+	}
+	return m, err
+}
+
+// roleRecorder records the data roles set on the port controller.
+type roleRecorder struct {
+	*mock.PortController
+	mu    sync.Mutex
+	roles []pdmsg.DataRole
+}
+
+func (r *roleRecorder) SetDataRole(role pdmsg.DataRole) error {
+	r.mu.Lock()
+	r.roles = append(r.roles, role)
+	r.mu.Unlock()
+	return nil
+}
+
+func TestDataRoleSwap(t *testing.T) {
+	for _, c := range []struct {
+		accept bool
+		reply  pdmsg.Type
+		role   pdmsg.DataRole
+		roles  int
+	}{
+		{true, pdmsg.TypeAccept, pdmsg.DataRoleDFP, 1},
+		{false, pdmsg.TypeReject, pdmsg.DataRoleUFP, 0},
+	} {
+		s, _ := newTestSource()
+		pc := &roleRecorder{PortController: s.pc}
+		pe := s.newEngine(pc)
+		pe.SetDataRoleSwap(c.accept)
+		run(t, pe)
+		s.waitState(t, "sink-ready")
+
+		s.mu.Lock()
+		s.pc.QueueRx(s.message(pdmsg.TypeDRSwap))
+		s.mu.Unlock()
+		waitFor(t, "reply to DR_Swap", func() bool { return len(s.pc.Sent()) == 2 })
+		if m := s.pc.Sent()[1]; !isControl(m, c.reply) {
+			t.Errorf("accept %v: got reply of type %d, want %d", c.accept, m.Type(), c.reply)
+		}
+		waitFor(t, "data role", func() bool {
+			pc.mu.Lock()
+			defer pc.mu.Unlock()
+			return pe.DataRole() == c.role && len(pc.roles) == c.roles
+		})
+		pc.mu.Lock()
+		if c.roles > 0 && pc.roles[0] != c.role {
+			t.Errorf("accept %v: got port controller data role %d, want %d", c.accept, pc.roles[0], c.role)
+		}
+		pc.mu.Unlock()
+	}
+}
+
+// bistRecorder counts the starts and stops of BIST carrier mode.
+type bistRecorder struct {
+	*mock.PortController
+	mu      sync.Mutex
+	started int
+	stopped int
+}
+
+func (b *bistRecorder) StartBIST() error {
+	b.mu.Lock()
+	b.started++
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *bistRecorder) StopBIST() error {
+	b.mu.Lock()
+	b.stopped++
+	b.mu.Unlock()
+	return nil
+}
+
+func TestRunStopsBISTCarrier(t *testing.T) {
+	s, _ := newTestSource()
+	pc := &bistRecorder{PortController: s.pc}
+	pe := s.newEngine(pc)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pe.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	s.waitState(t, "sink-ready")
+
+	s.mu.Lock()
+	m := s.message(pdmsg.TypeBIST)
+	s.mu.Unlock()
+	var bdo pdmsg.BISTDO
+	bdo.SetMode(pdmsg.BISTModeCarrier)
+	m.SetDataObjectCount(1)
+	m.Data[0] = uint32(bdo)
+	s.pc.QueueRx(m)
+	s.waitState(t, "sink-bist-carrier")
+
+	// Carrier mode is stopped when Run returns before the BIST timer expires
+
+	cancel()
+	<-done
+	if st := s.currentState(); st != "sink-bist-carrier" {
+		t.Fatalf("got state %s when Run returned, want sink-bist-carrier", st)
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.started != 1 || pc.stopped != 1 {
+		t.Errorf("got BIST carrier started %d and stopped %d times, want 1 and 1", pc.started, pc.stopped)
+	}
+}
+
+func TestEPRKeepAliveWithPPS(t *testing.T) {
+	s, pe := newTestSource()
+	pps := pdmsg.NewPPSPDO()
+	pps.SetMinVoltage(3300)
+	pps.SetMaxVoltage(11000)
+	pps.SetMaxCurrent(3000)
+	pe.eprMode = true
+	pe.eprCaps[0] = pdmsg.PDO(s.cap.Data[0])
+	pe.eprCaps[1] = pdmsg.PDO(pps)
+	pe.eprCapsLen = 2
+	pe.requestDO = pdmsg.EmptyRequestDO
+	pe.requestDO.SetSelectedObjectPosition(2)
+	pe.requestDO.SetPPSOutputVoltage(9000)
+	pe.requestDO.SetPPSOutputCurrent(1000)
+	if next, err := stateSinkReady.Enter(pe); next != nil || err != nil {
+		t.Fatalf("got %v, %v entering ready, want nil, nil", next, err)
+	}
+
+	// Keep alive is sent until the PPS request is due, which is then sent in
+	// its place.
+
+	if next, err := stateSinkReady.Process(pe, pdmsg.Message{}, typec.EventTimerTimeout); next != nil || err != nil {
+		t.Fatalf("got %v, %v on keep alive timeout, want nil, nil", next, err)
+	}
+	if sent := s.pc.Sent(); len(sent) != 1 || !isExtended(sent[0], pdmsg.TypeExtendedControl) {
+		t.Fatalf("got sent messages %+v, want a keep alive", sent)
+	}
+	pe.keepAliveSent = false // acknowledged
+	pe.ppsDue = time.Now()
+	if next, _ := stateSinkReady.Process(pe, pdmsg.Message{}, typec.EventTimerTimeout); next != stateSinkSelectCapabilities {
+		t.Errorf("got next state %v once PPS request is due, want %s", next, stateSinkSelectCapabilities.Name)
+	}
+}
+
+func TestRxBurst(t *testing.T) {
+	s, _ := newTestSource()
+	pc := &alertCounter{PortController: s.pc}
+	var mu sync.Mutex
+	var ids []uint8
+	pe := s.newEngine(pc)
+	pe.SetMessageObserver(func(m pdmsg.Message, tx bool) {
+		if !tx && isControl(m, pdmsg.TypePing) {
+			mu.Lock()
+			ids = append(ids, m.ID())
+			mu.Unlock()
+		}
+	})
+	run(t, pe)
+	s.waitState(t, "sink-ready")
+	waitFor(t, "negotiation", func() bool { return pe.Stats().Rx == 3 })
+
+	// Pings need no response and cause no state change, so the whole burst is
+	// processed by sink-ready without going back to the port controller for
+	// events in between.
+
+	s.mu.Lock()
+	burst := []pdmsg.Message{s.message(pdmsg.TypePing), s.message(pdmsg.TypePing), s.message(pdmsg.TypePing)}
+	s.pc.QueueRx(burst...)
+	s.mu.Unlock()
+	waitFor(t, "burst", func() bool { return pe.Stats().Rx == 3+uint32(len(burst)) })
+	pc.mu.Lock()
+	for i, n := range pc.pings {
+		if n != pc.pings[0] {
+			t.Errorf("ping %d received after %d alerts, want %d", i, n, pc.pings[0])
+		}
+	}
+	pc.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != len(burst) {
+		t.Fatalf("got %d pings, want %d", len(ids), len(burst))
+	}
+	for i, m := range burst {
+		if ids[i] != m.ID() {
+			t.Errorf("ping %d: got ID %d, want %d", i, ids[i], m.ID())
+		}
+	}
+	if n := len(s.pc.Sent()); n != 1 {
+		t.Errorf("got %d sent messages, want 1", n)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	for _, nonPD := range []bool{false, true} {
+		name, ready := "pd", "sink-ready"
+		if nonPD {
+			name, ready = "non-pd", "no-pd"
+		}
+		t.Run(name, func(t *testing.T) {
+			s, pe := newTestSource()
+			s.nonPD = nonPD
+			run(t, pe)
+			s.waitState(t, ready)
+			testConcurrentAccess(t, s, pe, !nonPD)
+			waitFor(t, ready, func() bool { return s.currentState() == ready })
+		})
+	}
+}
+
+// testConcurrentAccess exercises the policy engine from multiple goroutines
+// while Run processes power events, for the race detector to catch unguarded
+// access. Reset is called only if reset is true.
+func testConcurrentAccess(t *testing.T, s *testSource, pe *PolicyEngine, reset bool) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	loop := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f(i)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	loop(func(i int) {
+		if i%2 == 0 {
+			s.pc.QueueEvent(typec.EventPower1A5)
+		} else {
+			s.pc.QueueEvent(typec.EventPower3A0)
+		}
+	})
+
+	// Each setter runs in its own goroutine, as calls under the lock of the
+	// policy engine in the same goroutine would hide unguarded access from the
+	// race detector.
+
+	loop(func(i int) { pe.SetDataRoleSwap(i%2 == 0) })
+	loop(func(i int) { pe.SetEPRSinkPDP(uint8(i)) })
+	loop(func(i int) { pe.SetMinNonPDCurrent(uint16(i % 3000)) })
+	loop(func(i int) {
+		pdo := pdmsg.NewFixedSupplyPDO()
+		pdo.SetVoltage(9000)
+		pdo.SetMaxCurrent(uint16(i % 3000))
+		if i%4 == 0 {
+			pdo = 0
+		}
+		pe.SetNonPDProfile(pdmsg.PDO(pdo))
+	})
+	loop(func(int) { pe.SetCapabilityEvaluator(highestPDO) })
+	loop(func(int) { pe.SetEventHandler(nil) })
+	loop(func(int) { pe.SetMessageObserver(func(pdmsg.Message, bool) {}) })
+	loop(func(i int) { pe.SetResetOnExit(i%2 == 0) })
+	loop(func(i int) { pe.SetRecoveryPolicy(uint8(i%3), uint8(i%2)) })
+	loop(func(int) { pe.SetLivenessWatchdog(time.Hour) })
+	loop(func(int) { pe.SetNegotiationDeadline(time.Hour) })
+	loop(func(i int) { pe.SetWaitCapRetries(uint8(i % 3)) })
+	loop(func(i int) { pe.SetStatusOnAlert(i%2 == 0) })
+	loop(func(i int) {
+		if reset && i%50 == 0 {
+			pe.Reset()
+		} else if i%10 == 0 {
+			pe.Renegotiate()
+		}
+	})
+	loop(func(int) {
+		pe.Stats()
+		pe.Contract()
+		pe.SourceCapabilities()
+		pe.PPSContract()
+		pe.DataRole()
+		pe.NegotiatedRevision()
+		pe.LastAlert()
+		pe.Status()
+		pe.BatteryCapabilities()
+	})
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if reset && pe.Stats().HardResets == 0 {
+		t.Error("got no hard resets, want some")
+	}
+}
+
+func TestIndependentEngines(t *testing.T) {
+	sa, pa := newTestSource()
+	sb, pb := newTestSource()
+
+	// The second source also offers 15V
+
+	sb.cap.SetDataObjectCount(3)
+	p := pdmsg.NewFixedSupplyPDO()
+	p.SetVoltage(15000)
+	p.SetMaxCurrent(3000)
+	sb.cap.Data[2] = uint32(p)
+
+	// Each engine runs in its own goroutine. The first engine renegotiates
+	// while the second one is hard reset.
+
+	run(t, pa)
+	run(t, pb)
+	sa.waitState(t, "sink-ready")
+	sb.waitState(t, "sink-ready")
+	pb.Reset()
+	for i := 2; i <= 4; i++ {
+		pa.RequestSourceCapabilities()
+		waitFor(t, "evaluation", func() bool { return pa.Stats().Evaluations == uint32(i) })
+		sa.waitState(t, "sink-ready")
+	}
+	sb.waitState(t, "sink-hard-reset")
+	sb.waitState(t, "sink-ready")
+
+	for _, c := range []struct {
+		name        string
+		s           *testSource
+		pe          *PolicyEngine
+		voltage     uint16
+		caps        int
+		evaluations uint32
+		resets      int
+	}{
+		{"first", sa, pa, 9000, 2, 4, 0},
+		{"second", sb, pb, 15000, 3, 2, 1},
+	} {
+		waitFor(t, c.name+" contract", func() bool {
+			_, _, ok := c.pe.Contract()
+			return ok
+		})
+		pdo, _, _ := c.pe.Contract()
+		if v := pdmsg.FixedSupplyPDO(pdo).Voltage(); v != c.voltage {
+			t.Errorf("%s: got contract at %dmV, want %dmV", c.name, v, c.voltage)
+		}
+		if n := len(c.pe.SourceCapabilities()); n != c.caps {
+			t.Errorf("%s: got %d source capabilities, want %d", c.name, n, c.caps)
+		}
+		if n := c.pe.Stats().Evaluations; n != c.evaluations {
+			t.Errorf("%s: got %d evaluations, want %d", c.name, n, c.evaluations)
+		}
+		if n := c.s.pc.Resets(); n != c.resets {
+			t.Errorf("%s: got %d hard resets, want %d", c.name, n, c.resets)
+		}
+	}
+}
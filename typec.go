@@ -3,6 +3,7 @@
 package typec
 
 import (
+	"context"
 	"errors"
 
 	"github.com/oxplot/go-typec/pdmsg"
@@ -53,10 +54,14 @@ func (e Event) String() string {
 		return "Attached"
 	case EventDetached:
 		return "Detached"
+	case EventFault:
+		return "Fault"
 	case EventRx:
 		return "Rx"
 	case EventTimerTimeout:
 		return "TimerTimeout"
+	case EventFRSwap:
+		return "FRSwap"
 	default:
 		return "INVALID"
 	}
@@ -76,8 +81,14 @@ const (
 	EventPower3A0                        // 5V@3A non-PD power source
 	EventAttached                        // VBUS power detected
 	EventDetached                        // VBUS power lost
+	EventFault                           // Fault condition such as over-current or over-temperature detected
 	EventRx                              // Received a message
 	EventTimerTimeout                    // Active timer has timed out
+
+	// Events added later are lowest priority so the values of the above stay
+	// the same.
+
+	EventFRSwap // Fast role swap signal detected
 )
 
 // PortController provides an interface to operate a device, often an IC
@@ -96,6 +107,9 @@ const (
 //   - Detect and report host current provided by the source as EventPower*
 //     events.
 //
+// Port controllers that cannot communicate with cable plugs must fail Tx of
+// messages with non-SOP ordered sets with ErrTxFailed.
+//
 // Port controllers should try to avoid heap allocation after initialization
 // stage as much as possible, since they may be running on microcontrollers with
 // limited/expensive garbage collectors.
@@ -108,7 +122,8 @@ type PortController interface {
 	// reset).
 	Init() error
 
-	// Tx sends a power delivery message to the port partner. CRC is
+	// Tx sends a power delivery message to the port partner, or the cable plug
+	// based on the SOP field of the message. CRC is
 	// automatically calculated and appended to the header and the data. Tx will
 	// block until a GoodCRC response is received or all auto-retries have
 	// failed. ErrTxFailed will be returned if auto-retries fail. Alert must be
@@ -116,7 +131,8 @@ type PortController interface {
 	// result of the call to Tx.
 	Tx(pdmsg.Message) error
 
-	// Rx returns a single received message. If no messages are left, ErrRxEmpty
+	// Rx returns a single received message with its SOP field set to the type
+	// of ordered set it was received with. If no messages are left, ErrRxEmpty
 	// is returned. Rx does not return GoodCRC messages and instead, discards
 	// them internally. Alert must be called after each call to Rx to check for
 	// possible events generated as result of the call to Rx.
@@ -138,6 +154,41 @@ type PortController interface {
 	Alert() (Event, error)
 }
 
+// BISTTransmitter is optionally implemented by port controllers that can
+// transmit the BIST Carrier Mode test pattern, used for compliance testing.
+// Policy engines use it when the port partner requests BIST Carrier Mode.
+type BISTTransmitter interface {
+
+	// StartBIST starts continuous transmission of the BIST Carrier Mode
+	// pattern. Transmission continues until StopBIST is called.
+	StartBIST() error
+
+	// StopBIST stops transmission of the BIST Carrier Mode pattern.
+	StopBIST() error
+}
+
+// ContextTxer is optionally implemented by port controllers whose transmission
+// of messages can block for a significant time. Policy engines use it in place
+// of Tx so that transmission is aborted promptly when they are stopped.
+type ContextTxer interface {
+
+	// TxContext is the same as Tx except that it returns ctx.Err() as soon as
+	// ctx is done while waiting for the transmission to complete. The state of
+	// the port partner is unknown in that case.
+	TxContext(ctx context.Context, m pdmsg.Message) error
+}
+
+// DataRoleSetter is optionally implemented by port controllers that send
+// messages of their own, such as GoodCRC, whose header carries the data role.
+// Policy engines use it to update the data role after a data role swap. Init
+// resets the data role to UFP.
+type DataRoleSetter interface {
+
+	// SetDataRole sets the data role of the messages sent by the port
+	// controller itself.
+	SetDataRole(r pdmsg.DataRole) error
+}
+
 var (
 	// ErrTxFailed is returned by Tx() if all auto-retries have failed.
 	ErrTxFailed = errors.New("failed to send pd message")